@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,15 +19,42 @@ import (
 
 var (
 	port      = flag.String("port", "8080", "Server port")
-	iface     = flag.String("interface", "", "Network interface to capture (empty for all)")
+	iface     = flag.String("interface", "", "Comma separated network interfaces to capture (empty for the first active one)")
 	storePath = flag.String("storage", "./data", "Path to store historical data")
+	readFile  = flag.String("read", "", "Replay packets from a pcap/pcapng file instead of capturing live")
+	speed     = flag.Float64("replay-speed", 1, "Replay speed for -read (1 = real time, 0 = as fast as possible)")
+	homeNets  = flag.String("home-net", "", "Comma separated CIDRs treated as local when working out traffic direction")
+	bpfFilter = flag.String("bpf", "", "BPF filter expression applied to the capture (e.g. \"tcp port 443\")")
+	smoothing = flag.String("rate-smoothing", capture.SmoothingEWMA, "Per-connection rate smoothing: none, ewma or window")
+	rateAlpha = flag.Float64("rate-alpha", capture.DefaultRateOptions().Alpha, "EWMA weight of the newest sample, in (0, 1]")
+	rateWin   = flag.Int("rate-window", capture.DefaultRateOptions().Window, "Number of seconds averaged by the window smoothing")
+	idleTmo   = flag.Duration("flow-idle-timeout", capture.DefaultFlowOptions().IdleTimeout, "Expire flows idle for this long")
+	activeTmo = flag.Duration("flow-active-timeout", capture.DefaultFlowOptions().ActiveTimeout, "Export long-lived flows this often (0 disables)")
+	maxFlows  = flag.Int("max-flows", capture.DefaultFlowOptions().MaxFlows, "Maximum number of tracked flows per interface (0 for unlimited)")
+	eviction  = flag.String("flow-eviction", capture.EvictLRU, "Flow eviction policy once -max-flows is reached: lru or least-bytes")
+	fragTmo   = flag.Duration("frag-timeout", capture.DefaultFragmentOptions().Timeout, "Drop IP datagrams still incomplete after this long")
+	fragMax   = flag.Int("frag-max-datagrams", capture.DefaultFragmentOptions().MaxDatagrams, "Maximum number of IP datagrams reassembled at once per interface")
+	fragBytes = flag.Int("frag-max-bytes", capture.DefaultFragmentOptions().MaxBytes, "Maximum bytes of fragments buffered per interface")
+	procRoot  = flag.String("proc-root", capture.DefaultProcRoot, "procfs mount point used to attribute connections to processes")
+	procEvery = flag.Duration("process-refresh", 5*time.Second, "How often the process and socket tables are rescanned (0 disables process attribution)")
+	dockerAPI = flag.String("docker-socket", "", "Docker Engine API socket used to name containers (e.g. /var/run/docker.sock)")
+	podsFile  = flag.String("kube-pods-file", "", "Pod list in the format of the kubelet /pods endpoint, used to name pods")
+	decap     = flag.Bool("decap", false, "Account VXLAN, GENEVE, GRE and IP-in-IP traffic by the inner 5-tuple instead of the tunnel endpoints")
+	backend   = flag.String("capture-backend", capture.BackendPcap, "Live capture backend: pcap or afpacket (memory-mapped TPACKET_V3, Linux only)")
+	afpFrame  = flag.Int("afpacket-frame-size", capture.DefaultBackendOptions().FrameSize, "AF_PACKET ring frame size in bytes")
+	afpBlock  = flag.Int("afpacket-block-size", capture.DefaultBackendOptions().BlockSize, "AF_PACKET ring block size in bytes, a multiple of the frame and page sizes")
+	afpBlocks = flag.Int("afpacket-blocks", capture.DefaultBackendOptions().NumBlocks, "Number of blocks in the AF_PACKET ring")
+	afpBlkTmo = flag.Duration("afpacket-block-timeout", capture.DefaultBackendOptions().BlockTimeout, "Hand over partially filled AF_PACKET blocks after this long")
+	workers   = flag.Int("workers", 1, "Number of packet processing workers; flows are sharded over them (AF_PACKET fanout with -capture-backend afpacket)")
+	sampling  = flag.String("sampling", capture.SamplingNone, "Packet sampling: none, count (every Nth packet) or random (probability 1/N); counters are extrapolated")
+	sampleN   = flag.Uint64("sample-rate", 100, "N for -sampling, the number of packets each sampled one stands for")
 )
 
 func main() {
 	flag.Parse()
 
 	log.Printf("Traffic Monitor Server starting...")
-	log.Printf("Configuration: port=%s, interface=%s, storage=%s", *port, *iface, *storePath)
+	log.Printf("Configuration: port=%s, interface=%s, storage=%s, bpf=%q", *port, *iface, *storePath, *bpfFilter)
 
 	// Initialize storage
 	log.Printf("Initializing storage systems...")
@@ -36,12 +64,96 @@ func main() {
 
 	// Initialize capture manager
 	log.Printf("Initializing packet capture manager...")
-	captureManager := capture.NewManager(store)
+	homeNetworks, err := capture.ParseHomeNetworks(*homeNets)
+	if err != nil {
+		log.Fatalf("Invalid -home-net: %v", err)
+	}
+	rates := capture.RateOptions{
+		Smoothing: *smoothing,
+		Alpha:     *rateAlpha,
+		Window:    *rateWin,
+	}
+	if err := rates.Validate(); err != nil {
+		log.Fatalf("Invalid rate options: %v", err)
+	}
+	flows := capture.FlowOptions{
+		IdleTimeout:   *idleTmo,
+		ActiveTimeout: *activeTmo,
+		MaxFlows:      *maxFlows,
+		Eviction:      *eviction,
+	}
+	if err := flows.Validate(); err != nil {
+		log.Fatalf("Invalid flow options: %v", err)
+	}
+	fragments := capture.FragmentOptions{
+		Timeout:      *fragTmo,
+		MaxDatagrams: *fragMax,
+		MaxBytes:     *fragBytes,
+	}
+	if err := fragments.Validate(); err != nil {
+		log.Fatalf("Invalid fragment options: %v", err)
+	}
+	backendOpts := capture.BackendOptions{
+		Type:         *backend,
+		FrameSize:    *afpFrame,
+		BlockSize:    *afpBlock,
+		NumBlocks:    *afpBlocks,
+		BlockTimeout: *afpBlkTmo,
+	}
+	if err := backendOpts.Validate(); err != nil {
+		log.Fatalf("Invalid capture backend options: %v", err)
+	}
+	samplingOpts := capture.SamplingOptions{
+		Mode: *sampling,
+		Rate: *sampleN,
+	}
+	if err := samplingOpts.Validate(); err != nil {
+		log.Fatalf("Invalid sampling options: %v", err)
+	}
+	if *workers < 1 {
+		log.Fatalf("Invalid worker count %d", *workers)
+	}
+	var processes *capture.ProcessResolver
+	if *procEvery > 0 && *readFile == "" {
+		processes = capture.NewProcessResolver(capture.ProcessOptions{
+			Root:         *procRoot,
+			DockerSocket: *dockerAPI,
+			PodsFile:     *podsFile,
+		})
+		go processes.Run(context.Background(), *procEvery)
+	}
+	captureManager := capture.NewManager(store, capture.Options{
+		HomeNetworks: homeNetworks,
+		BPFFilter:    *bpfFilter,
+		Rates:        rates,
+		Flows:        flows,
+		Fragments:    fragments,
+		Processes:    processes,
+		Decapsulate:  *decap,
+		Backend:      backendOpts,
+		Workers:      *workers,
+		Sampling:     samplingOpts,
+	})
 	
-	// Start capture on the specified interface
-	log.Printf("Starting packet capture on interface '%s'...", *iface)
-	if err := captureManager.Start(*iface); err != nil {
-		log.Fatalf("Failed to start packet capture: %v", err)
+	if *readFile != "" {
+		// Replay a capture file through the same pipeline
+		log.Printf("Replaying capture file '%s' at speed %v...", *readFile, *speed)
+		if err := captureManager.StartReplay(*readFile, capture.ReplayOptions{Speed: *speed}); err != nil {
+			log.Fatalf("Failed to start replay: %v", err)
+		}
+	} else {
+		// Start capture on the specified interfaces
+		ifaces := strings.Split(*iface, ",")
+		log.Printf("Starting packet capture on interface '%s'...", ifaces[0])
+		if err := captureManager.Start(strings.TrimSpace(ifaces[0])); err != nil {
+			log.Fatalf("Failed to start packet capture: %v", err)
+		}
+		for _, name := range ifaces[1:] {
+			log.Printf("Starting packet capture on interface '%s'...", name)
+			if err := captureManager.AddInterface(strings.TrimSpace(name)); err != nil {
+				log.Fatalf("Failed to start packet capture: %v", err)
+			}
+		}
 	}
 	defer captureManager.Stop()
 	log.Printf("Packet capture started successfully")
@@ -56,8 +168,23 @@ func main() {
 	mux.HandleFunc("/api/traffic/realtime", handler.RealtimeTraffic)
 	mux.HandleFunc("/api/traffic/connections", handler.ConnectionList)
 	mux.HandleFunc("/api/traffic/history", handler.HistoricalTraffic)
+	mux.HandleFunc("/api/traffic/vlans", handler.VLANTraffic)
+	mux.HandleFunc("/api/traffic/macs", handler.MACTraffic)
+	mux.HandleFunc("/api/traffic/sni", handler.TrafficBySNI)
+	mux.HandleFunc("/api/dns/queries", handler.DNSQueries)
+	mux.HandleFunc("/api/dns/domains", handler.DNSDomains)
+	mux.HandleFunc("/api/dns/stats", handler.DNSStats)
+	mux.HandleFunc("/api/http/requests", handler.HTTPRequests)
+	mux.HandleFunc("/api/http/hosts", handler.HTTPHosts)
+	mux.HandleFunc("/api/http/status", handler.HTTPStatus)
+	mux.HandleFunc("/api/neighbors", handler.Neighbors)
+	mux.HandleFunc("/api/neighbors/events", handler.NeighborEvents)
 	mux.HandleFunc("/api/interfaces", handler.ListInterfaces)
 	mux.HandleFunc("/api/interfaces/switch", handler.SwitchInterface)
+	mux.HandleFunc("/api/interfaces/add", handler.AddInterface)
+	mux.HandleFunc("/api/interfaces/remove", handler.RemoveInterface)
+	mux.HandleFunc("/api/capture/filter", handler.CaptureFilter)
+	mux.HandleFunc("/api/capture/stats", handler.CaptureStats)
 	mux.HandleFunc("/ws", handler.WebSocketHandler)
 	
 	// Serve static files
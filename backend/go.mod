@@ -5,6 +5,7 @@ go 1.21.5
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 )
 
 require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
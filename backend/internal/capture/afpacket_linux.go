@@ -0,0 +1,156 @@
+//go:build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketSource reads from a memory-mapped TPACKET_V3 ring. The kernel fills
+// whole blocks of frames and we walk them in place, without a copy or a
+// system call per packet.
+type afpacketSource struct {
+	tpacket *afpacket.TPacket
+	promisc int // socket holding the interface in promiscuous mode, or -1
+}
+
+// fanoutGroups numbers the fanout groups of this process
+var fanoutGroups uint32
+
+// openAFPacket opens a ring per socket. Several sockets join a fanout group
+// hashing on the flow, with IPv4 fragments reassembled first so they go
+// where the rest of their flow goes.
+func openAFPacket(iface string, opts BackendOptions, sockets int) ([]packetSource, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	// Other link types (tun devices, ...) have no link-layer header on
+	// AF_PACKET sockets; libpcap handles them
+	if ifi.Flags&net.FlagLoopback == 0 && len(ifi.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("the %s backend only supports Ethernet interfaces", BackendAFPacket)
+	}
+
+	// Group ids are per network namespace; mix in the pid to stay clear of
+	// other processes
+	group := uint16(os.Getpid()<<4) + uint16(atomic.AddUint32(&fanoutGroups, 1))
+	sources := make([]packetSource, 0, sockets)
+	closeAll := func() {
+		for _, source := range sources {
+			source.close()
+		}
+	}
+	for i := 0; i < sockets; i++ {
+		tpacket, err := newTPacket(iface, opts)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		source := &afpacketSource{tpacket: tpacket, promisc: -1}
+		sources = append(sources, source)
+		if sockets > 1 {
+			if err := tpacket.SetFanout(afpacket.FanoutHashWithDefrag, group); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to join fanout group: %w", err)
+			}
+		}
+	}
+	promisc, err := promiscuous(ifi.Index)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("failed to enable promiscuous mode: %w", err)
+	}
+	sources[0].(*afpacketSource).promisc = promisc
+	return sources, nil
+}
+
+func newTPacket(iface string, opts BackendOptions) (*afpacket.TPacket, error) {
+	return afpacket.NewTPacket(
+		afpacket.OptInterface(iface),
+		afpacket.OptFrameSize(opts.FrameSize),
+		afpacket.OptBlockSize(opts.BlockSize),
+		afpacket.OptNumBlocks(opts.NumBlocks),
+		afpacket.OptBlockTimeout(opts.BlockTimeout),
+		afpacket.OptPollTimeout(sourceReadTimeout),
+		afpacket.TPacketVersion3,
+		// Put the 802.1Q tags stripped by the NIC back, so VLANs are seen
+		// the same as with libpcap. Only tagged frames are copied for it.
+		afpacket.OptAddVLANHeader(true),
+	)
+}
+
+// promiscuous puts the interface in promiscuous mode for as long as the
+// returned socket is open, the way libpcap does for its handles. The socket
+// has no protocol, so it doesn't receive anything itself.
+func promiscuous(ifindex int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+	// struct packet_mreq: ifindex, type, address length and address
+	mreq := make([]byte, 16)
+	binary.NativeEndian.PutUint32(mreq[0:], uint32(ifindex))
+	binary.NativeEndian.PutUint16(mreq[4:], syscall.PACKET_MR_PROMISC)
+	if err := syscall.SetsockoptString(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(mreq)); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (s *afpacketSource) readPacket() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.tpacket.ZeroCopyReadPacketData()
+	if err == afpacket.ErrTimeout {
+		return nil, ci, errReadTimeout
+	}
+	return data, ci, err
+}
+
+func (s *afpacketSource) linkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// setFilter compiles expr with libpcap and attaches the program to the
+// socket. An empty expression compiles to a program accepting everything.
+func (s *afpacketSource) setFilter(expr string) error {
+	instructions, err := pcap.CompileBPFFilter(s.linkType(), snapLen, expr)
+	if err != nil {
+		return err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return s.tpacket.SetBPF(raw)
+}
+
+// stats returns the socket counters, which the kernel resets on every read;
+// the TPacket accumulates them for us
+func (s *afpacketSource) stats() (sourceStats, error) {
+	_, v3, err := s.tpacket.SocketStats()
+	if err != nil {
+		return sourceStats{}, err
+	}
+	return sourceStats{
+		received: uint64(v3.Packets()),
+		dropped:  uint64(v3.Drops()),
+	}, nil
+}
+
+func (s *afpacketSource) close() {
+	s.tpacket.Close()
+	if s.promisc >= 0 {
+		syscall.Close(s.promisc)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package capture
+
+import "fmt"
+
+// openAFPacket needs AF_PACKET sockets, which only Linux has
+func openAFPacket(iface string, opts BackendOptions, sockets int) ([]packetSource, error) {
+	return nil, fmt.Errorf("the %s capture backend is only supported on Linux", BackendAFPacket)
+}
@@ -0,0 +1,266 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// Confidence of an application protocol label
+const (
+	ConfidenceConfirmed = 1.0 // payload signature on one of the protocol's ports
+	ConfidencePayload   = 0.9 // payload signature on another port
+	ConfidencePort      = 0.4 // well-known port only
+)
+
+// classifyPackets is how many packets with payload a flow gets to match a
+// signature before we settle for its port
+const classifyPackets = 8
+
+// Classifier recognises an application protocol. Match inspects the payload
+// of one packet; it may be nil for protocols that are only known by port.
+type Classifier struct {
+	// Protocol is the label, e.g. "HTTP"
+	Protocol string
+	// Transport restricts the classifier to "TCP" or "UDP"; empty means both
+	Transport string
+	// Ports are the well-known server ports, used as a fallback
+	Ports []uint16
+	// Match reports whether payload, sent by the client if fromClient,
+	// belongs to the protocol
+	Match func(payload []byte, fromClient bool) bool
+}
+
+func (c *Classifier) appliesTo(transport string) bool {
+	return c.Transport == "" || c.Transport == transport
+}
+
+func (c *Classifier) hasPort(port uint16) bool {
+	for _, p := range c.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	classifiersMu sync.RWMutex
+	classifiers   []*Classifier
+)
+
+// RegisterClassifier adds a classifier. Signatures are tried in registration
+// order, so more specific ones should be registered first.
+func RegisterClassifier(c *Classifier) {
+	classifiersMu.Lock()
+	defer classifiersMu.Unlock()
+	classifiers = append(classifiers, c)
+}
+
+// classifyPayload returns the classifier whose signature matches payload
+func classifyPayload(transport string, payload []byte, fromClient bool) *Classifier {
+	classifiersMu.RLock()
+	defer classifiersMu.RUnlock()
+	for _, c := range classifiers {
+		if c.Match != nil && c.appliesTo(transport) && c.Match(payload, fromClient) {
+			return c
+		}
+	}
+	return nil
+}
+
+// classifyPort returns the classifier registered for a server port
+func classifyPort(transport string, port uint16) *Classifier {
+	classifiersMu.RLock()
+	defer classifiersMu.RUnlock()
+	for _, c := range classifiers {
+		if c.appliesTo(transport) && c.hasPort(port) {
+			return c
+		}
+	}
+	return nil
+}
+
+// appState is the classification progress of a flow
+type appState struct {
+	packets int  // packets with payload inspected so far
+	done    bool // labelled from the payload, or gave up
+}
+
+// classify labels the flow from the payload of a packet. Until a signature
+// matches, the label comes from the server port.
+func (e *flowEntry) classify(info *packetInfo, fromClient bool) {
+	flow := e.flow
+	if e.app.done || (flow.Protocol != "TCP" && flow.Protocol != "UDP") {
+		return
+	}
+
+	if flow.AppProtocol == "" {
+		if c := classifyPort(flow.Protocol, flow.DstPort); c != nil {
+			flow.AppProtocol, flow.AppConfidence = c.Protocol, ConfidencePort
+		} else if c := classifyPort(flow.Protocol, flow.SrcPort); c != nil {
+			flow.AppProtocol, flow.AppConfidence = c.Protocol, ConfidencePort
+		}
+	}
+
+	if len(info.payload) == 0 {
+		return
+	}
+	e.app.packets++
+
+	if c := classifyPayload(flow.Protocol, info.payload, fromClient); c != nil {
+		flow.AppProtocol, flow.AppConfidence = c.Protocol, ConfidencePayload
+		if c.hasPort(flow.DstPort) || c.hasPort(flow.SrcPort) {
+			flow.AppConfidence = ConfidenceConfirmed
+		}
+		e.app.done = true
+		return
+	}
+	if e.app.packets >= classifyPackets {
+		e.app.done = true
+	}
+}
+
+func init() {
+	for _, c := range []*Classifier{
+		{Protocol: "TLS", Transport: "TCP", Ports: []uint16{443, 465, 636, 853, 989, 990, 993, 995, 8443}, Match: matchTLS},
+		{Protocol: "SSH", Transport: "TCP", Ports: []uint16{22}, Match: matchPrefix("SSH-")},
+		{Protocol: "HTTP", Transport: "TCP", Ports: []uint16{80, 8000, 8080, 8888}, Match: matchHTTP},
+		{Protocol: "QUIC", Transport: "UDP", Ports: []uint16{443}, Match: matchQUIC},
+		{Protocol: "DNS", Ports: []uint16{53, 5353, 5355}, Match: matchDNS},
+		{Protocol: "Postgres", Transport: "TCP", Ports: []uint16{5432}, Match: matchPostgres},
+		{Protocol: "MySQL", Transport: "TCP", Ports: []uint16{3306}, Match: matchMySQL},
+		{Protocol: "Redis", Transport: "TCP", Ports: []uint16{6379}, Match: matchRedis},
+		{Protocol: "SMB", Transport: "TCP", Ports: []uint16{445}, Match: matchSMB},
+		{Protocol: "NTP", Transport: "UDP", Ports: []uint16{123}, Match: matchNTP},
+		{Protocol: "DHCP", Transport: "UDP", Ports: []uint16{67, 68}},
+		{Protocol: "SNMP", Transport: "UDP", Ports: []uint16{161, 162}},
+		{Protocol: "SMTP", Transport: "TCP", Ports: []uint16{25, 587}},
+		{Protocol: "FTP", Transport: "TCP", Ports: []uint16{21}},
+		{Protocol: "LDAP", Ports: []uint16{389}},
+		{Protocol: "RDP", Transport: "TCP", Ports: []uint16{3389}},
+		{Protocol: "MongoDB", Transport: "TCP", Ports: []uint16{27017}},
+		{Protocol: "Kafka", Transport: "TCP", Ports: []uint16{9092}},
+		{Protocol: "Memcached", Ports: []uint16{11211}},
+		{Protocol: "BGP", Transport: "TCP", Ports: []uint16{179}},
+	} {
+		RegisterClassifier(c)
+	}
+}
+
+func matchPrefix(prefix string) func([]byte, bool) bool {
+	return func(payload []byte, _ bool) bool {
+		return bytes.HasPrefix(payload, []byte(prefix))
+	}
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// matchHTTP recognises HTTP/1.x requests and responses
+func matchHTTP(payload []byte, fromClient bool) bool {
+	if !fromClient {
+		return bytes.HasPrefix(payload, []byte("HTTP/1."))
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(payload, method) {
+			return bytes.Contains(payload[:min(len(payload), 2048)], []byte(" HTTP/1."))
+		}
+	}
+	return false
+}
+
+// matchTLS recognises a handshake record carrying a ClientHello or ServerHello
+func matchTLS(payload []byte, _ bool) bool {
+	// type(1) version(2) length(2) | handshake type(1)
+	return len(payload) >= 6 &&
+		payload[0] == 0x16 && payload[1] == 0x03 && payload[2] <= 0x04 &&
+		(payload[5] == 0x01 || payload[5] == 0x02)
+}
+
+// matchQUIC recognises long header packets of QUIC v1, v2 and the drafts
+func matchQUIC(payload []byte, _ bool) bool {
+	if len(payload) < 7 || payload[0]&0xc0 != 0xc0 {
+		return false
+	}
+	version := binary.BigEndian.Uint32(payload[1:5])
+	return version == 0x00000001 || version == 0x6b3343cf || version&0xffffff00 == 0xff000000
+}
+
+// matchDNS sanity checks a DNS header. Over TCP messages carry a two byte
+// length prefix.
+func matchDNS(payload []byte, _ bool) bool {
+	if len(payload) >= 14 && int(binary.BigEndian.Uint16(payload[:2])) == len(payload)-2 {
+		if validDNSHeader(payload[2:]) {
+			return true
+		}
+	}
+	return validDNSHeader(payload)
+}
+
+func validDNSHeader(msg []byte) bool {
+	if len(msg) < 12 {
+		return false
+	}
+	opcode := (msg[2] >> 3) & 0x0f
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+	// Standard queries and responses ask exactly one question
+	return opcode <= 5 && qdcount == 1 && ancount < 256 && msg[3]&0x40 == 0
+}
+
+// matchPostgres recognises the startup, SSL and GSS encryption requests
+func matchPostgres(payload []byte, fromClient bool) bool {
+	if !fromClient || len(payload) < 8 || int(binary.BigEndian.Uint32(payload[:4])) != len(payload) {
+		return false
+	}
+	switch binary.BigEndian.Uint32(payload[4:8]) {
+	case 0x00030000, 80877103, 80877104:
+		return true
+	}
+	return false
+}
+
+// matchMySQL recognises the server greeting: protocol version 10 followed by
+// the server version string
+func matchMySQL(payload []byte, fromClient bool) bool {
+	if fromClient || len(payload) < 6 {
+		return false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	return length == len(payload)-4 && payload[3] == 0 && payload[4] == 0x0a &&
+		payload[5] >= '0' && payload[5] <= '9'
+}
+
+// matchRedis recognises a RESP command array from the client
+func matchRedis(payload []byte, fromClient bool) bool {
+	if !fromClient || len(payload) < 8 || payload[0] != '*' {
+		return false
+	}
+	i := 1
+	for i < len(payload) && payload[i] >= '0' && payload[i] <= '9' {
+		i++
+	}
+	return i > 1 && bytes.HasPrefix(payload[i:], []byte("\r\n$"))
+}
+
+// matchSMB recognises SMB1/SMB2 after the NetBIOS session header
+func matchSMB(payload []byte, _ bool) bool {
+	if len(payload) < 8 || payload[0] != 0 {
+		return false
+	}
+	magic := payload[4:8]
+	return bytes.Equal(magic, []byte("\xffSMB")) || bytes.Equal(magic, []byte("\xfeSMB"))
+}
+
+// matchNTP recognises NTPv3/v4 client and server packets
+func matchNTP(payload []byte, _ bool) bool {
+	if len(payload) < 48 {
+		return false
+	}
+	version := (payload[0] >> 3) & 0x07
+	mode := payload[0] & 0x07
+	return (version == 3 || version == 4) && mode >= 1 && mode <= 5
+}
@@ -0,0 +1,170 @@
+package capture
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// replayFile replaces the synthetic trace of BenchmarkReplay:
+//
+//	go test ./internal/capture -run '^$' -bench Replay -replay trace.pcap
+var replayFile = flag.String("replay", "", "pcap/pcapng file for BenchmarkReplay to cycle through instead of a synthetic trace")
+
+// discardStorage drops everything but the packets processed
+type discardStorage struct {
+	processed uint64
+}
+
+func (*discardStorage) UpdateFlow(*models.Flow)                     {}
+func (*discardStorage) RemoveFlow(*models.Flow)                     {}
+func (*discardStorage) UpdateInterface(*models.InterfaceStats)      {}
+func (*discardStorage) UpdateVLANStats(string, []*models.VLANStats) {}
+func (*discardStorage) UpdateMACStats(string, []*models.MACStats)   {}
+func (*discardStorage) AddDNSQueries([]*models.DNSQuery)            {}
+func (*discardStorage) AddHTTPRequests([]*models.HTTPRequest)       {}
+func (*discardStorage) UpdateNeighbors(string, []*models.Neighbor)  {}
+func (*discardStorage) AddNeighborEvents([]*models.NeighborEvent)   {}
+
+func (s *discardStorage) UpdateCaptureStats(stats *models.CaptureStats) {
+	s.processed = stats.PacketsProcessed
+}
+
+// benchFrames are the frames a replay cycles through: those of -replay, or
+// 2000 TLS-like downloads of 24 segments each
+func benchFrames(b *testing.B) [][]byte {
+	b.Helper()
+	if *replayFile != "" {
+		return readFrames(b, *replayFile)
+	}
+
+	var frames [][]byte
+	data := string(make([]byte, 1200))
+	for i := 0; i < 2000; i++ {
+		conn := tcpConn{
+			client:     net.IPv4(10, 1, byte(i>>8), byte(i)),
+			server:     net.IPv4(203, 0, 113, byte(i%16)),
+			clientPort: uint16(40000 + i),
+			serverPort: 443,
+		}
+		frames = append(frames,
+			conn.frame(b, false, 100, 0, true, false, ""),
+			conn.frame(b, true, 500, 101, true, false, ""),
+			conn.frame(b, false, 101, 501, false, false, ""),
+		)
+		seq := uint32(501)
+		for j := 0; j < 20; j++ {
+			frames = append(frames, conn.frame(b, true, seq, 101, false, false, data))
+			seq += uint32(len(data))
+		}
+		frames = append(frames, conn.frame(b, false, 101, seq, false, false, ""))
+	}
+	return frames
+}
+
+func readFrames(b *testing.B, path string) [][]byte {
+	b.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	var r interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	}
+	if ng, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions); err == nil {
+		r = ng
+	} else {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if r, err = pcapgo.NewReader(f); err != nil {
+			b.Fatalf("read %s: %v", path, err)
+		}
+	}
+	var frames [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatalf("read %s: %v", path, err)
+		}
+		frames = append(frames, data)
+	}
+	if len(frames) == 0 {
+		b.Fatalf("no packets in %s", path)
+	}
+	return frames
+}
+
+// writeTrace writes n frames cycling through frames, 20µs apart, to a file
+func writeTrace(b *testing.B, frames [][]byte, n int) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "trace.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		b.Fatal(err)
+	}
+	at := testdataStart
+	for i := 0; i < n; i++ {
+		frame := frames[i%len(frames)]
+		ci := gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(frame), Length: len(frame)}
+		if err := w.WritePacket(ci, frame); err != nil {
+			b.Fatal(err)
+		}
+		at = at.Add(20 * time.Microsecond)
+	}
+	return path
+}
+
+// BenchmarkReplay replays a trace through the capture pipeline as fast as
+// possible; an op is a packet
+func BenchmarkReplay(b *testing.B) {
+	frames := benchFrames(b)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			path := writeTrace(b, frames, b.N)
+			opts := Options{
+				Rates:     DefaultRateOptions(),
+				Flows:     DefaultFlowOptions(),
+				Fragments: DefaultFragmentOptions(),
+				Backend:   DefaultBackendOptions(),
+				Workers:   workers,
+			}
+			pc, err := NewPacketCaptureFromFile(path, ReplayOptions{Speed: 0}, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pc.Close()
+
+			storage := &discardStorage{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			if err := pc.Start(context.Background(), storage); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			if storage.processed != uint64(b.N) {
+				b.Fatalf("%d packets processed, want %d", storage.processed, b.N)
+			}
+		})
+	}
+}
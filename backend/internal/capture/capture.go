@@ -3,6 +3,9 @@ package capture
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
@@ -12,16 +15,93 @@ import (
 )
 
 type Storage interface {
-	UpdateConnection(conn *models.Connection)
+	UpdateFlow(flow *models.Flow)
+	RemoveFlow(flow *models.Flow)
 	UpdateInterface(stats *models.InterfaceStats)
+	UpdateCaptureStats(stats *models.CaptureStats)
+	UpdateVLANStats(iface string, stats []*models.VLANStats)
+	UpdateMACStats(iface string, stats []*models.MACStats)
+	AddDNSQueries(queries []*models.DNSQuery)
+	AddHTTPRequests(requests []*models.HTTPRequest)
+	UpdateNeighbors(iface string, neighbors []*models.Neighbor)
+	AddNeighborEvents(events []*models.NeighborEvent)
 }
 
 type PacketCapture struct {
-	handle *pcap.Handle
-	iface  string
+	// sources has one source, or one per worker with AF_PACKET fanout
+	sources []packetSource
+	iface   string
+	replay  *ReplayOptions // nil for live captures
+	local   *LocalAddrs
+	opts    Options
+
+	// filterMu serializes filter changes, which come from the API goroutines
+	filterMu sync.RWMutex
+	filter   string
+
+	// onExpire is called for flows leaving the flow table
+	onExpire FlowExpiredFunc
+	// hostnames are the addresses learned from DNS answers; nil disables
+	// domain annotation
+	hostnames *hostnameCache
+
+	// The sources are closed by Start once it has started reading, since
+	// reads can't be interrupted safely
+	closeMu sync.Mutex
+	started bool
+	closed  bool
+
+	// Accounting state. Packets are spread over the shards by flow; with a
+	// single shard it is processed on the Start goroutine, otherwise each
+	// shard is owned by a worker of the pool.
+	shards      []*shard
+	pool        *workerPool    // nil with a single shard
+	neighbors   *neighborTable // shared by the shards
+	lastDropped uint64         // total drops at the previous tick
 }
 
-func NewPacketCapture(iface string) (*PacketCapture, error) {
+// Options configures a PacketCapture
+type Options struct {
+	// HomeNetworks are CIDRs treated as local when working out packet direction
+	HomeNetworks []*net.IPNet
+	// BPFFilter narrows what the kernel hands to us; empty captures everything
+	BPFFilter string
+	// Rates selects how per-flow rates are smoothed
+	Rates RateOptions
+	// Flows bounds the lifetime and number of tracked flows
+	Flows FlowOptions
+	// Fragments bounds IP reassembly
+	Fragments FragmentOptions
+	// Processes attributes local flows to processes; nil disables it
+	Processes *ProcessResolver
+	// Decapsulate accounts VXLAN, GENEVE, GRE and IP-in-IP traffic by the
+	// inner 5-tuple instead of as one flow between the tunnel endpoints
+	Decapsulate bool
+	// Backend selects how live interfaces are read
+	Backend BackendOptions
+	// Workers spreads packet processing over this many goroutines, each with
+	// its own share of the flows; 0 or 1 processes packets on the capture
+	// goroutine
+	Workers int
+	// Sampling processes only a share of the packets and extrapolates
+	Sampling SamplingOptions
+}
+
+// ReplayOptions controls how packets are played back from a capture file.
+type ReplayOptions struct {
+	// Speed scales the original inter-packet gaps: 1 replays in real time,
+	// 10 replays ten times faster and 0 replays as fast as possible.
+	Speed float64
+}
+
+func NewPacketCapture(iface string, opts Options) (*PacketCapture, error) {
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("invalid worker count %d", opts.Workers)
+	}
+	if err := opts.Sampling.Validate(); err != nil {
+		return nil, err
+	}
+
 	// If no interface specified, get the first active one
 	if iface == "" {
 		devices, err := pcap.FindAllDevs()
@@ -40,142 +120,505 @@ func NewPacketCapture(iface string) (*PacketCapture, error) {
 		}
 	}
 
-	handle, err := pcap.OpenLive(iface, 65536, true, pcap.BlockForever)
+	sources, err := openSources(iface, opts.Backend, opts.Workers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open device %s: %w", iface, err)
 	}
 
-	return &PacketCapture{
-		handle: handle,
-		iface:  iface,
-	}, nil
+	pc := &PacketCapture{
+		sources: sources,
+		iface:   iface,
+		local:   NewLocalAddrs(iface, opts.HomeNetworks),
+		opts:    opts,
+	}
+	if err := pc.SetFilter(opts.BPFFilter); err != nil {
+		pc.closeSources()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// NewPacketCaptureFromFile opens a pcap or pcapng file for replay through the
+// same pipeline used for live captures.
+func NewPacketCaptureFromFile(path string, replay ReplayOptions, opts Options) (*PacketCapture, error) {
+	if replay.Speed < 0 {
+		return nil, fmt.Errorf("invalid replay speed %v", replay.Speed)
+	}
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("invalid worker count %d", opts.Workers)
+	}
+	if err := opts.Sampling.Validate(); err != nil {
+		return nil, err
+	}
+
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %w", path, err)
+	}
+
+	pc := &PacketCapture{
+		sources: []packetSource{&pcapSource{handle: handle}},
+		iface:   path,
+		replay:  &replay,
+		// A file has no interface addresses, only home networks apply
+		local: NewLocalAddrs("", opts.HomeNetworks),
+		opts:  opts,
+	}
+	if err := pc.SetFilter(opts.BPFFilter); err != nil {
+		pc.closeSources()
+		return nil, err
+	}
+	return pc, nil
 }
 
 func (pc *PacketCapture) Start(ctx context.Context, storage Storage) error {
-	packetSource := gopacket.NewPacketSource(pc.handle, pc.handle.LinkType())
-	
-	stats := &models.InterfaceStats{
-		Interface: pc.iface,
+	pc.closeMu.Lock()
+	if pc.closed {
+		pc.closeMu.Unlock()
+		return nil
+	}
+	pc.started = true
+	pc.closeMu.Unlock()
+	defer pc.closeSources()
+
+	pc.neighbors = newNeighborTable(pc.iface)
+	pc.shards = make([]*shard, max(pc.opts.Workers, 1))
+	for i := range pc.shards {
+		pc.shards[i] = newShard(pc, pc.linkType())
+	}
+
+	// Let exporters see the flows that were still open
+	defer func() {
+		for _, s := range pc.shards {
+			s.flows.expireAll(EndShutdown)
+			pc.notifyExpired(s.flows.takeExpired())
+		}
+	}()
+
+	if len(pc.shards) > 1 {
+		pc.pool = newWorkerPool(ctx, pc.shards, pc.sources)
+		// Runs before the flows are expired above
+		defer pc.pool.stop()
+	}
+
+	if pc.replay != nil {
+		return pc.replayFile(ctx, storage)
 	}
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	connections := make(map[string]*models.Connection)
+	lastTick := time.Now()
+	if pc.pool != nil && pc.pool.fanout {
+		// The workers read their own sockets
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-pc.pool.errs:
+				return fmt.Errorf("failed to read packet: %w", err)
+			case now := <-ticker.C:
+				pc.flush(storage, now, now.Sub(lastTick))
+				lastTick = now
+				pc.local.RefreshIfStale()
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			// Use the real elapsed time; ticks can be late under load
+			pc.flush(storage, now, now.Sub(lastTick))
+			lastTick = now
+			pc.local.RefreshIfStale()
+		default:
+		}
 
+		// Reads time out regularly, so the checks above run on idle links
+		data, ci, err := pc.sources[0].readPacket()
+		switch {
+		case err == errReadTimeout:
+			// Don't hold frames back from the workers on a quiet link
+			if pc.pool != nil {
+				pc.pool.sendPending()
+			}
+			continue
+		case err == io.EOF:
+			pc.flush(storage, time.Now(), time.Since(lastTick))
+			return nil
+		case err != nil:
+			return fmt.Errorf("failed to read packet: %w", err)
+		}
+		pc.process(data, ci)
+	}
+}
+
+// replayFile drives the pipeline from a capture file. Ticks follow the packet
+// timestamps rather than the wall clock, so a given file always produces the
+// same sequence of per-second samples regardless of the replay speed.
+func (pc *PacketCapture) replayFile(ctx context.Context, storage Storage) error {
+	var firstTS, startWall, nextTick, lastTS time.Time
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case packet := <-packetSource.Packets():
-			pc.processPacket(packet, connections, stats)
-		case <-ticker.C:
-			// Update storage with current stats
-			storage.UpdateInterface(stats)
-			for _, conn := range connections {
-				storage.UpdateConnection(conn)
+		default:
+		}
+
+		data, ci, err := pc.sources[0].readPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet: %w", err)
+		}
+
+		ts := ci.Timestamp
+		if firstTS.IsZero() {
+			firstTS = ts
+			startWall = time.Now()
+			nextTick = ts.Add(time.Second)
+		}
+
+		// Sleep until the packet is due when pacing the replay
+		if pc.replay.Speed > 0 {
+			due := startWall.Add(time.Duration(float64(ts.Sub(firstTS)) / pc.replay.Speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-timer.C:
+				}
 			}
-			// Reset per-second counters
-			stats.InBytesPerSec = 0
-			stats.OutBytesPerSec = 0
-			stats.InPacketsPerSec = 0
-			stats.OutPacketsPerSec = 0
 		}
+
+		if !ts.Before(nextTick) {
+			pc.flush(storage, nextTick, time.Second)
+			// Skip over idle gaps instead of emitting a sample per silent second
+			nextTick = nextTick.Add(ts.Sub(nextTick).Truncate(time.Second) + time.Second)
+		}
+
+		pc.process(data, ci)
+		lastTS = ts
+	}
+
+	// Flush the final partial second
+	pc.flush(storage, lastTS, time.Second)
+	fmt.Printf("[Capture] Finished replaying '%s'\n", pc.iface)
+	return nil
+}
+
+// process hands a frame to its shard unless it is sampled out. data is only
+// valid until the next read.
+func (pc *PacketCapture) process(data []byte, ci gopacket.CaptureInfo) {
+	if pc.pool != nil {
+		pc.pool.dispatch(data, ci)
+		return
 	}
+	pc.shards[0].processFrame(data, ci)
 }
 
-func (pc *PacketCapture) processPacket(packet gopacket.Packet, connections map[string]*models.Connection, stats *models.InterfaceStats) {
+// flush has every shard compute its rates over interval, expire stale flows
+// as of now and push them to storage, then merges the shards' counters,
+// pushes them too and resets the per-second ones.
+func (pc *PacketCapture) flush(storage Storage, now time.Time, interval time.Duration) {
+	var samples []shardSample
+	if pc.pool != nil {
+		if samples = pc.pool.flush(storage, now, interval); samples == nil {
+			return
+		}
+	} else {
+		samples = []shardSample{pc.shards[0].flush(storage, now, interval)}
+	}
+
+	stats := &models.InterfaceStats{Interface: pc.iface}
+	vlans := newVLANCounters(pc.iface)
+	macs := make([][]*models.MACStats, len(samples))
+	for i, sample := range samples {
+		mergeTraffic(stats, &sample.stats)
+		vlans.merge(sample.vlans, sample.tagged)
+		macs[i] = sample.macs
+	}
+	vlanStats, macStats := vlans.snapshot(), mergeMACStats(macs)
+	if sampling := pc.opts.Sampling; sampling.enabled() {
+		markSampled(stats, sampling.Rate)
+		for _, s := range vlanStats {
+			markSampled(&s.InterfaceStats, sampling.Rate)
+		}
+		for _, s := range macStats {
+			markSampled(&s.InterfaceStats, sampling.Rate)
+		}
+	}
+	storage.UpdateInterface(stats)
+	storage.UpdateVLANStats(pc.iface, vlanStats)
+	storage.UpdateMACStats(pc.iface, macStats)
+
+	pc.neighbors.expire(now)
+	if neighbors, changed := pc.neighbors.snapshot(); changed {
+		storage.UpdateNeighbors(pc.iface, neighbors)
+	}
+	if events := pc.neighbors.take(); len(events) > 0 {
+		storage.AddNeighborEvents(events)
+	}
+	storage.UpdateCaptureStats(pc.captureStats(samples, now))
+}
+
+// processFrame accounts a frame read from the source. data is only valid
+// until the next read.
+func (s *shard) processFrame(data []byte, ci gopacket.CaptureInfo) {
+	sampled := s.sampler.keep()
+	if !sampled && !seenUnsampled(data, s.linkType) {
+		return
+	}
+	if sampled && s.linkType == layers.LinkTypeEthernet {
+		if frame, ok := s.decoder.decode(data, s.pc.opts.Decapsulate); ok {
+			s.processDecoded(frame, len(data), ci)
+			return
+		}
+	}
+
+	// Full decoding copies data, so the packet may be kept
+	packet := gopacket.NewPacket(data, s.linkType, gopacket.Default)
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	s.processPacket(packet, sampled)
+}
+
+// processDecoded accounts a frame decoded by the fast path the same way
+// processPacket does with fully decoded ones
+func (s *shard) processDecoded(frame decodedFrame, packetLen int, ci gopacket.CaptureInfo) {
+	s.counters.received++
+	timestamp := captureTime(ci)
+	srcMAC, dstMAC := frame.eth.SrcMAC, frame.eth.DstMAC
+	s.macs.add(srcMAC, dstMAC, frame.etherType, packetLen, s.weight, timestamp)
+
+	isIncoming := s.pc.local.IsIncoming(srcMAC, dstMAC, frame.srcIP, frame.dstIP)
+	encap := encapsulation{vlan: frame.vlan}
+	addTraffic(s.stats, packetLen, s.weight, isIncoming)
+	s.vlans.add(encap.vlan, packetLen, s.weight, isIncoming)
+	// Fragments never get here, but the pending ones still time out
+	s.defrag.expire(timestamp)
+
+	info := &packetInfo{
+		srcIP:     s.decoder.addrString(frame.srcIP),
+		dstIP:     s.decoder.addrString(frame.dstIP),
+		length:    packetLen,
+		frames:    1,
+		weight:    s.weight,
+		timestamp: timestamp,
+		srcMAC:    srcMAC,
+		dstMAC:    dstMAC,
+		encap:     encap,
+	}
+	if tcp := frame.tcp; tcp != nil {
+		info.srcPort, info.dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
+		info.protocol = "TCP"
+		info.tcp = tcp
+		info.payload = tcp.Payload
+	} else {
+		udp := frame.udp
+		info.srcPort, info.dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+		info.protocol = "UDP"
+		info.payload = udp.Payload
+	}
+	s.track(info, frame.network)
+}
+
+// processPacket accounts a fully decoded frame. Frames that weren't sampled
+// only feed the neighbor table and the reassembly.
+func (s *shard) processPacket(packet gopacket.Packet, sampled bool) {
+	if sampled {
+		s.counters.received++
+	}
+	packetLen := len(packet.Data())
+	timestamp := packetTime(packet)
+
+	var srcMAC, dstMAC net.HardwareAddr
+	if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok {
+		srcMAC = eth.SrcMAC
+		dstMAC = eth.DstMAC
+		// Every frame counts towards its addresses, IP or not
+		if sampled {
+			s.macs.add(eth.SrcMAC, eth.DstMAC, frameType(packet, eth), packetLen, s.weight, timestamp)
+		}
+	}
+
 	// Extract network layer
 	networkLayer := packet.NetworkLayer()
 	if networkLayer == nil {
+		// ARP has no network layer as far as gopacket is concerned
+		if s.pc.neighbors.observeARP(packet) {
+			return
+		}
+		// Count packets the decoder gave up on before reaching the network layer
+		if sampled && packet.ErrorLayer() != nil {
+			s.counters.decoderDropped++
+		}
 		return
 	}
 
 	var srcIP, dstIP string
 	var isIncoming bool
-	packetLen := len(packet.Data())
 
-	// Determine if packet is incoming or outgoing based on local interface IPs
+	// Determine if packet is incoming or outgoing based on local interface addresses
 	if ipLayer, ok := networkLayer.(*layers.IPv4); ok {
 		srcIP = ipLayer.SrcIP.String()
 		dstIP = ipLayer.DstIP.String()
-		// Simple heuristic: if destination is local, it's incoming
-		// In production, we'd check against actual interface IPs
-		isIncoming = isLocalIP(dstIP)
+		isIncoming = s.pc.local.IsIncoming(srcMAC, dstMAC, ipLayer.SrcIP, ipLayer.DstIP)
 	} else if ipLayer, ok := networkLayer.(*layers.IPv6); ok {
 		srcIP = ipLayer.SrcIP.String()
 		dstIP = ipLayer.DstIP.String()
-		isIncoming = isLocalIP(dstIP)
+		isIncoming = s.pc.local.IsIncoming(srcMAC, dstMAC, ipLayer.SrcIP, ipLayer.DstIP)
+		s.pc.neighbors.observeNDP(packet, ipLayer)
 	} else {
 		return
 	}
 
-	// Update interface stats
-	if isIncoming {
-		stats.InBytes += uint64(packetLen)
-		stats.InBytesPerSec += uint64(packetLen)
-		stats.InPackets++
-		stats.InPacketsPerSec++
-	} else {
-		stats.OutBytes += uint64(packetLen)
-		stats.OutBytesPerSec += uint64(packetLen)
-		stats.OutPackets++
-		stats.OutPacketsPerSec++
+	// Update interface and per-VLAN stats
+	encap := decodeEncapsulation(packet)
+	if sampled {
+		addTraffic(s.stats, packetLen, s.weight, isIncoming)
+		s.vlans.add(encap.vlan, packetLen, s.weight, isIncoming)
+	}
+
+	// Fragments are held back until their datagram is complete, and the
+	// datagram is sampled as a whole
+	dgram, ok := s.defrag.process(packet, packetLen, timestamp)
+	if !ok {
+		return
+	}
+	if dgram.frames > 1 {
+		sampled = s.datagrams.keep()
+	}
+	if !sampled {
+		return
 	}
 
-	// Extract transport layer
-	transportLayer := packet.TransportLayer()
-	if transportLayer == nil {
+	// Flows are accounted by the outer headers, or the inner ones of
+	// tunnelled packets when decapsulating
+	view := selectLayers(dgram.packet, s.pc.opts.Decapsulate)
+	if view.tunnel != nil {
+		flow := view.network.NetworkFlow()
+		srcIP, dstIP = flow.Src().String(), flow.Dst().String()
+	}
+	if len(view.transport) == 0 {
 		return
 	}
 
 	var srcPort, dstPort uint16
 	var protocol string
+	var tcp *layers.TCP
+	var icmp *icmpInfo
+	var payload []byte
 
-	switch transport := transportLayer.(type) {
+	// Extract transport layer; ICMP isn't one as far as gopacket is concerned
+	switch transport := view.transport[0].(type) {
 	case *layers.TCP:
 		srcPort = uint16(transport.SrcPort)
 		dstPort = uint16(transport.DstPort)
 		protocol = "TCP"
+		tcp = transport
+		payload = transport.Payload
 	case *layers.UDP:
 		srcPort = uint16(transport.SrcPort)
 		dstPort = uint16(transport.DstPort)
 		protocol = "UDP"
+		payload = transport.Payload
+	case *layers.GRE:
+		// Tunnels we aren't looking into are flows of their own
+		protocol = "GRE"
+	case *layers.IPv4, *layers.IPv6:
+		protocol = "IPIP"
 	default:
+		protocol, icmp = decodeICMP(view.transport)
+		if icmp == nil {
+			return
+		}
+		srcPort = icmp.keyPort()
+		dstPort = srcPort
+	}
+
+	info := &packetInfo{
+		srcIP:     srcIP,
+		dstIP:     dstIP,
+		srcPort:   srcPort,
+		dstPort:   dstPort,
+		protocol:  protocol,
+		length:    dgram.length,
+		frames:    dgram.frames,
+		weight:    s.weight,
+		timestamp: timestamp,
+		srcMAC:    srcMAC,
+		dstMAC:    dstMAC,
+		tcp:       tcp,
+		payload:   payload,
+		icmp:      icmp,
+		encap:     encap,
+		tunnel:    view.tunnel,
+	}
+	s.track(info, view.network)
+}
+
+// track hands a packet to the flow table and the protocol trackers
+func (s *shard) track(info *packetInfo, network gopacket.NetworkLayer) {
+	entry := s.flows.update(info)
+	s.dns.observe(info)
+	if info.weight == 1 {
+		// Sampled streams can't be reassembled
+		s.http.observe(entry, info, network)
+	}
+}
+
+// notifyExpired hands expired flows to the subscriber, if any
+func (pc *PacketCapture) notifyExpired(flows []*models.Flow) {
+	if pc.onExpire == nil {
 		return
 	}
+	for _, flow := range flows {
+		pc.onExpire(flow)
+	}
+}
 
-	// Create connection key
-	connKey := fmt.Sprintf("%s:%d-%s:%d-%s", srcIP, srcPort, dstIP, dstPort, protocol)
-	
-	// Update connection stats
-	conn, exists := connections[connKey]
-	if !exists {
-		conn = &models.Connection{
-			SrcIP:     srcIP,
-			SrcPort:   srcPort,
-			DstIP:     dstIP,
-			DstPort:   dstPort,
-			Protocol:  protocol,
-			StartTime: time.Now(),
-		}
-		connections[connKey] = conn
+// packetTime returns the capture timestamp, falling back to the wall clock
+func packetTime(packet gopacket.Packet) time.Time {
+	return captureTime(packet.Metadata().CaptureInfo)
+}
+
+func captureTime(ci gopacket.CaptureInfo) time.Time {
+	if !ci.Timestamp.IsZero() {
+		return ci.Timestamp
 	}
+	return time.Now()
+}
 
-	conn.Bytes += uint64(packetLen)
-	conn.BytesPerSec = uint64(packetLen) // Will be averaged in storage
-	conn.Packets++
-	conn.LastSeen = time.Now()
+// linkType is the link type of the frames read from the sources
+func (pc *PacketCapture) linkType() layers.LinkType {
+	return pc.sources[0].linkType()
 }
 
-func (pc *PacketCapture) Close() {
-	if pc.handle != nil {
-		pc.handle.Close()
+func (pc *PacketCapture) closeSources() {
+	for _, source := range pc.sources {
+		source.close()
 	}
 }
 
-// Simple check for local IPs - in production, we'd check actual interface IPs
-func isLocalIP(ip string) bool {
-	// Check for common private IP ranges
-	return len(ip) > 0 && (ip[0:3] == "192" || ip[0:3] == "172" || ip[0:2] == "10" || ip == "127.0.0.1" || ip == "::1")
-}
\ No newline at end of file
+// Close releases the sources of a capture that was never started; a running
+// capture closes them itself once its context is cancelled
+func (pc *PacketCapture) Close() {
+	pc.closeMu.Lock()
+	defer pc.closeMu.Unlock()
+
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	if !pc.started {
+		pc.closeSources()
+	}
+}
@@ -0,0 +1,125 @@
+package capture
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// frameDecoder decodes the bulk of the traffic, TCP and UDP over IPv4 or IPv6
+// behind at most one VLAN tag, into preallocated layers without allocating.
+// Everything else (ARP, ICMP, fragments, extension headers, tunnels, ...) is
+// left to gopacket's full decoding.
+type frameDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	eth   layers.Ethernet
+	dot1q layers.Dot1Q
+	ip4   layers.IPv4
+	ip6   layers.IPv6
+	tcp   layers.TCP
+	udp   layers.UDP
+
+	// addrs caches the text form of the addresses seen, which flows are
+	// keyed by
+	addrs map[netip.Addr]string
+}
+
+// maxAddrStrings bounds the address cache of a decoder, which is emptied
+// when full
+const maxAddrStrings = 65536
+
+func newFrameDecoder() *frameDecoder {
+	d := &frameDecoder{
+		decoded: make([]gopacket.LayerType, 0, 8),
+		addrs:   make(map[netip.Addr]string),
+	}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+		&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp)
+	// Stop quietly at the application layer
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decodedFrame points into the decoder's layers, which are overwritten by
+// the next frame
+type decodedFrame struct {
+	eth          *layers.Ethernet
+	vlan         vlanTag
+	etherType    layers.EthernetType // behind the VLAN tag
+	network      gopacket.NetworkLayer
+	srcIP, dstIP net.IP
+	tcp          *layers.TCP // one of tcp and udp is set
+	udp          *layers.UDP
+}
+
+// decode decodes an Ethernet frame, reporting whether it is one the fast path
+// handles. With decap, VXLAN and GENEVE are left to the full decoding, which
+// looks inside them.
+func (d *frameDecoder) decode(data []byte, decap bool) (decodedFrame, bool) {
+	var f decodedFrame
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return f, false
+	}
+	// Ethernet, an optional tag, IP and the transport; a layer type showing
+	// up twice (QinQ, IP-in-IP) was overwritten and takes the slow path
+	ls := d.decoded
+	if len(ls) == 0 || ls[0] != layers.LayerTypeEthernet {
+		return f, false
+	}
+	f.eth = &d.eth
+	f.etherType = d.eth.EthernetType
+	ls = ls[1:]
+	if len(ls) > 0 && ls[0] == layers.LayerTypeDot1Q {
+		f.etherType = d.dot1q.Type
+		// VLAN 0 is a priority tag, not a VLAN
+		f.vlan.outer = d.dot1q.VLANIdentifier
+		ls = ls[1:]
+	}
+	if len(ls) != 2 {
+		return f, false
+	}
+
+	switch ls[0] {
+	case layers.LayerTypeIPv4:
+		f.network, f.srcIP, f.dstIP = &d.ip4, d.ip4.SrcIP, d.ip4.DstIP
+	case layers.LayerTypeIPv6:
+		f.network, f.srcIP, f.dstIP = &d.ip6, d.ip6.SrcIP, d.ip6.DstIP
+	default:
+		return f, false
+	}
+
+	switch ls[1] {
+	case layers.LayerTypeTCP:
+		f.tcp = &d.tcp
+	case layers.LayerTypeUDP:
+		if next := d.udp.NextLayerType(); decap && (next == layers.LayerTypeVXLAN || next == layers.LayerTypeGeneve) {
+			return f, false
+		}
+		f.udp = &d.udp
+	default:
+		return f, false
+	}
+	return f, true
+}
+
+// addrString returns ip.String(), from the cache for the addresses seen
+// recently: most frames are between a few busy hosts
+func (d *frameDecoder) addrString(ip net.IP) string {
+	addr, ok := addrKey(ip)
+	if !ok {
+		return ip.String()
+	}
+	if s, ok := d.addrs[addr]; ok {
+		return s
+	}
+	if len(d.addrs) >= maxAddrStrings {
+		clear(d.addrs)
+	}
+	s := ip.String()
+	d.addrs[addr] = s
+	return s
+}
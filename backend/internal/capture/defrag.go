@@ -0,0 +1,336 @@
+package capture
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FragmentOptions bounds the memory spent on incomplete IP datagrams, so a
+// stream of fragments that never complete can't exhaust the process
+type FragmentOptions struct {
+	// Timeout drops datagrams that are still incomplete after this long
+	Timeout time.Duration
+	// MaxDatagrams caps the number of datagrams being reassembled at once
+	MaxDatagrams int
+	// MaxBytes caps the fragment data held while waiting for the rest
+	MaxBytes int
+}
+
+// DefaultFragmentOptions returns the limits used when none are configured.
+// They match the Linux defaults of ipfrag_time and ipfrag_high_thresh.
+func DefaultFragmentOptions() FragmentOptions {
+	return FragmentOptions{
+		Timeout:      30 * time.Second,
+		MaxDatagrams: 4096,
+		MaxBytes:     4 << 20,
+	}
+}
+
+// Validate checks the reassembly limits
+func (o FragmentOptions) Validate() error {
+	if o.Timeout <= 0 {
+		return fmt.Errorf("fragment timeout must be positive, got %v", o.Timeout)
+	}
+	if o.MaxDatagrams <= 0 {
+		return fmt.Errorf("pending datagram limit must be positive, got %d", o.MaxDatagrams)
+	}
+	if o.MaxBytes <= 0 {
+		return fmt.Errorf("fragment memory limit must be positive, got %d", o.MaxBytes)
+	}
+	return nil
+}
+
+// maxDatagramSize is what the 16-bit length field of the rebuilt header can
+// describe: the whole IPv4 datagram, or the IPv6 payload including extension
+// headers. Jumbograms can't be fragmented.
+const maxDatagramSize = 65535
+
+// datagram is a packet ready for flow accounting, possibly rebuilt from
+// fragments
+type datagram struct {
+	packet gopacket.Packet
+	frames int // frames it arrived in
+	length int // bytes on the wire, over all frames
+}
+
+// fragmentKey identifies the fragments of one datagram (RFC 791, RFC 8200)
+type fragmentKey struct {
+	v6       bool
+	src, dst string
+	id       uint32
+	protocol uint8 // IPv4 only, IPv6 keys on the addresses and id
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// pendingDatagram collects the fragments of one datagram
+type pendingDatagram struct {
+	key     fragmentKey
+	started time.Time
+	elem    *list.Element // position in the age list
+
+	// header is the unfragmentable part of the first fragment: the IPv4
+	// header, or the IPv6 header plus the extension headers before the
+	// fragment header
+	header []byte
+	// nextHeaderAt is the offset in header of the next-header field to
+	// patch when the fragment header is removed (IPv6 only)
+	nextHeaderAt int
+	nextHeader   uint8
+
+	frags  []fragment
+	size   int // bytes buffered
+	total  int // payload length, -1 until the last fragment arrived
+	frames int
+	length int
+}
+
+// defragmenter reassembles IPv4 and IPv6 datagrams. gopacket's ip4defrag
+// has no IPv6 support and no overall memory bound, so both families share
+// this one.
+type defragmenter struct {
+	opts    FragmentOptions
+	pending map[fragmentKey]*pendingDatagram
+	age     *list.List // oldest first
+	size    int        // bytes buffered over all datagrams
+
+	reassembled uint64
+	dropped     uint64 // fragments discarded: timed out, over limits or malformed
+}
+
+func newDefragmenter(opts FragmentOptions) *defragmenter {
+	defaults := DefaultFragmentOptions()
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+	if opts.MaxDatagrams <= 0 {
+		opts.MaxDatagrams = defaults.MaxDatagrams
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaults.MaxBytes
+	}
+	return &defragmenter{
+		opts:    opts,
+		pending: make(map[fragmentKey]*pendingDatagram),
+		age:     list.New(),
+	}
+}
+
+// process passes unfragmented packets through and holds fragments back until
+// their datagram is complete. ok is false while the datagram is incomplete.
+func (d *defragmenter) process(packet gopacket.Packet, length int, now time.Time) (datagram, bool) {
+	d.expire(now)
+
+	whole := datagram{packet: packet, frames: 1, length: length}
+	ls := packet.Layers()
+	for i, layer := range ls {
+		switch ip := layer.(type) {
+		case *layers.IPv4:
+			if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+				return whole, true
+			}
+			return d.addIPv4(ip, length, now)
+		case *layers.IPv6:
+			if frag, header, nextHeaderAt := findIPv6Fragment(ip, ls[i+1:]); frag != nil {
+				return d.addIPv6(ip, frag, header, nextHeaderAt, length, now)
+			}
+			return whole, true
+		}
+	}
+	return whole, true
+}
+
+// findIPv6Fragment walks the extension headers that may precede a fragment
+// header (RFC 8200 section 4.1). It returns the fragment header, if any, and
+// the unfragmentable part of the packet in front of it.
+func findIPv6Fragment(ip *layers.IPv6, exts []gopacket.Layer) (*layers.IPv6Fragment, []byte, int) {
+	header := append([]byte(nil), ip.Contents...)
+	nextHeaderAt := 6
+	for _, ext := range exts {
+		switch ext.LayerType() {
+		case layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Routing, layers.LayerTypeIPv6Destination:
+			nextHeaderAt = len(header)
+			header = append(header, ext.LayerContents()...)
+		case layers.LayerTypeIPv6Fragment:
+			return ext.(*layers.IPv6Fragment), header, nextHeaderAt
+		default:
+			return nil, nil, 0
+		}
+	}
+	return nil, nil, 0
+}
+
+func (d *defragmenter) addIPv4(ip *layers.IPv4, length int, now time.Time) (datagram, bool) {
+	key := fragmentKey{
+		src:      string(ip.SrcIP.To4()),
+		dst:      string(ip.DstIP.To4()),
+		id:       uint32(ip.Id),
+		protocol: uint8(ip.Protocol),
+	}
+	pending := d.pendingFor(key, now)
+	if ip.FragOffset == 0 {
+		pending.header = append([]byte(nil), ip.Contents...)
+	}
+	return d.add(pending, int(ip.FragOffset)*8, ip.Payload, ip.Flags&layers.IPv4MoreFragments != 0, length)
+}
+
+func (d *defragmenter) addIPv6(ip *layers.IPv6, frag *layers.IPv6Fragment, header []byte, nextHeaderAt, length int, now time.Time) (datagram, bool) {
+	key := fragmentKey{
+		v6:  true,
+		src: string(ip.SrcIP.To16()),
+		dst: string(ip.DstIP.To16()),
+		id:  frag.Identification,
+	}
+	pending := d.pendingFor(key, now)
+	if frag.FragmentOffset == 0 {
+		pending.header = header
+		pending.nextHeaderAt = nextHeaderAt
+		pending.nextHeader = uint8(frag.NextHeader)
+	}
+	return d.add(pending, int(frag.FragmentOffset)*8, frag.Payload, frag.MoreFragments, length)
+}
+
+// pendingFor returns the datagram a fragment belongs to, making room for a
+// new one if needed
+func (d *defragmenter) pendingFor(key fragmentKey, now time.Time) *pendingDatagram {
+	if pending, ok := d.pending[key]; ok {
+		return pending
+	}
+	for len(d.pending) >= d.opts.MaxDatagrams {
+		d.drop(d.age.Front().Value.(*pendingDatagram))
+	}
+	pending := &pendingDatagram{key: key, started: now, total: -1}
+	pending.elem = d.age.PushBack(pending)
+	d.pending[key] = pending
+	return pending
+}
+
+// add stores a fragment and returns the datagram once it is complete
+func (d *defragmenter) add(pending *pendingDatagram, offset int, data []byte, more bool, length int) (datagram, bool) {
+	end := offset + len(data)
+	// Only the last fragment may have a length that isn't a multiple of 8,
+	// and nothing may follow it. Empty ones would be kept without counting
+	// towards MaxBytes.
+	malformed := end > maxDatagramSize || (more && (len(data) == 0 || len(data)%8 != 0))
+	if pending.total >= 0 && (end > pending.total || (!more && end != pending.total)) {
+		malformed = true
+	}
+	if malformed {
+		d.drop(pending)
+		d.dropped++
+		return datagram{}, false
+	}
+
+	for _, f := range pending.frags {
+		fEnd := f.offset + len(f.data)
+		if f.offset == offset && fEnd == end {
+			// Retransmitted duplicate: account the bytes, keep the data
+			pending.frames++
+			pending.length += length
+			return datagram{}, false
+		}
+		if offset < fEnd && f.offset < end {
+			// Overlapping fragments are an evasion technique (RFC 5722)
+			d.drop(pending)
+			d.dropped++
+			return datagram{}, false
+		}
+	}
+
+	pending.frags = append(pending.frags, fragment{offset: offset, data: append([]byte(nil), data...)})
+	pending.size += len(data)
+	pending.frames++
+	pending.length += length
+	d.size += len(data)
+	if !more {
+		pending.total = end
+	}
+	if pending.oversized() {
+		// The length field would wrap around
+		d.drop(pending)
+		return datagram{}, false
+	}
+
+	if packet, ok := pending.assemble(); ok {
+		d.remove(pending)
+		d.reassembled++
+		return datagram{packet: packet, frames: pending.frames, length: pending.length}, true
+	}
+
+	for d.size > d.opts.MaxBytes && d.age.Len() > 0 {
+		d.drop(d.age.Front().Value.(*pendingDatagram))
+	}
+	return datagram{}, false
+}
+
+// oversized reports whether the rebuilt datagram would be too long for its
+// length field, once both its header and its end are known
+func (p *pendingDatagram) oversized() bool {
+	if p.total < 0 || p.header == nil {
+		return false
+	}
+	length := len(p.header) + p.total
+	if p.key.v6 {
+		length -= 40
+	}
+	return length > maxDatagramSize
+}
+
+// assemble rebuilds the datagram if every fragment has arrived
+func (p *pendingDatagram) assemble() (gopacket.Packet, bool) {
+	if p.total < 0 || p.header == nil || p.size != p.total {
+		return nil, false
+	}
+	// The fragments don't overlap, so full coverage means no holes
+	sort.Slice(p.frags, func(i, j int) bool { return p.frags[i].offset < p.frags[j].offset })
+
+	data := make([]byte, 0, len(p.header)+p.total)
+	data = append(data, p.header...)
+	for _, f := range p.frags {
+		data = append(data, f.data...)
+	}
+
+	if p.key.v6 {
+		data[p.nextHeaderAt] = p.nextHeader
+		binary.BigEndian.PutUint16(data[4:6], uint16(len(data)-40))
+		return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default), true
+	}
+
+	// Clear the fragment flags and offset and fix up the length
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[6] &^= 0x3f
+	data[7] = 0
+	return gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default), true
+}
+
+// expire drops datagrams that didn't complete in time
+func (d *defragmenter) expire(now time.Time) {
+	for d.age.Len() > 0 {
+		oldest := d.age.Front().Value.(*pendingDatagram)
+		if now.Sub(oldest.started) < d.opts.Timeout {
+			return
+		}
+		d.drop(oldest)
+	}
+}
+
+// drop discards an incomplete datagram
+func (d *defragmenter) drop(pending *pendingDatagram) {
+	d.dropped += uint64(pending.frames)
+	d.remove(pending)
+}
+
+func (d *defragmenter) remove(pending *pendingDatagram) {
+	d.size -= pending.size
+	d.age.Remove(pending.elem)
+	delete(d.pending, pending.key)
+}
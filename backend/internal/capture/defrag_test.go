@@ -0,0 +1,305 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ipv4Fragment builds the fragment of datagram id carrying payload at offset
+// bytes. options pads the header with that many bytes of IP options.
+func ipv4Fragment(t *testing.T, id uint16, offset int, more bool, payload []byte, options int) gopacket.Packet {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:    4,
+		TTL:        64,
+		Id:         id,
+		Protocol:   layers.IPProtocolUDP,
+		SrcIP:      net.IPv4(192, 0, 2, 1),
+		DstIP:      net.IPv4(192, 0, 2, 2),
+		FragOffset: uint16(offset / 8),
+	}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	if options > 0 {
+		// No-operation options
+		ip.Options = []layers.IPv4Option{{OptionType: 1, OptionLength: 1}}
+		for i := 1; i < options; i++ {
+			ip.Options = append(ip.Options, layers.IPv4Option{OptionType: 1, OptionLength: 1})
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// ipv6Fragment builds an IPv6 fragment by hand; gopacket can't serialize
+// fragment headers. destOpts puts an 8-byte destination options header in
+// front of the fragment header.
+func ipv6Fragment(t *testing.T, id uint32, offset int, more bool, payload []byte, destOpts bool) gopacket.Packet {
+	t.Helper()
+	data := make([]byte, 40, 56+len(payload))
+	data[0] = 6 << 4
+	data[6] = uint8(layers.IPProtocolIPv6Fragment)
+	data[7] = 64
+	copy(data[8:], net.ParseIP("2001:db8::1"))
+	copy(data[24:], net.ParseIP("2001:db8::2"))
+	if destOpts {
+		data[6] = uint8(layers.IPProtocolIPv6Destination)
+		// Next header, length and a PadN option filling the rest
+		data = append(data, uint8(layers.IPProtocolIPv6Fragment), 0, 1, 4, 0, 0, 0, 0)
+	}
+	fragOffset := uint16(offset/8) << 3
+	if more {
+		fragOffset |= 1
+	}
+	data = append(data, uint8(layers.IPProtocolUDP), 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-6:], fragOffset)
+	binary.BigEndian.PutUint32(data[len(data)-4:], id)
+	data = append(data, payload...)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)-40))
+	return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+}
+
+// udpDatagram is a UDP header and payload of n bytes in total, so that
+// reassembled datagrams decode down to UDP
+func udpDatagram(n int) []byte {
+	data := make([]byte, n)
+	binary.BigEndian.PutUint16(data[0:], 5000)
+	binary.BigEndian.PutUint16(data[2:], 6000)
+	binary.BigEndian.PutUint16(data[4:], uint16(n))
+	for i := 8; i < n; i++ {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestDefragmenterReassembles(t *testing.T) {
+	payload := udpDatagram(3000)
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		frags []gopacket.Packet
+		v6    bool
+	}{
+		{
+			name: "ipv4 in order",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 1, 1480, true, payload[1480:2960], 0),
+				ipv4Fragment(t, 1, 2960, false, payload[2960:], 0),
+			},
+		},
+		{
+			name: "ipv4 out of order",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 2, 2960, false, payload[2960:], 0),
+				ipv4Fragment(t, 2, 1480, true, payload[1480:2960], 0),
+				ipv4Fragment(t, 2, 0, true, payload[:1480], 0),
+			},
+		},
+		{
+			name: "ipv6",
+			v6:   true,
+			frags: []gopacket.Packet{
+				ipv6Fragment(t, 7, 1448, false, payload[1448:], false),
+				ipv6Fragment(t, 7, 0, true, payload[:1448], false),
+			},
+		},
+		{
+			name: "ipv6 after a destination options header",
+			v6:   true,
+			frags: []gopacket.Packet{
+				ipv6Fragment(t, 8, 0, true, payload[:1448], true),
+				ipv6Fragment(t, 8, 1448, false, payload[1448:], true),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDefragmenter(DefaultFragmentOptions())
+			wireBytes := 0
+			var dgram datagram
+			var ok bool
+			for i, frag := range tt.frags {
+				wireBytes += len(frag.Data())
+				dgram, ok = d.process(frag, len(frag.Data()), now)
+				if last := i == len(tt.frags)-1; ok != last {
+					t.Fatalf("fragment %d: complete = %v, want %v", i, ok, last)
+				}
+			}
+
+			if dgram.frames != len(tt.frags) || dgram.length != wireBytes {
+				t.Errorf("datagram of %d frames and %d bytes, want %d and %d", dgram.frames, dgram.length, len(tt.frags), wireBytes)
+			}
+			udp, _ := dgram.packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if udp == nil {
+				t.Fatalf("reassembled datagram doesn't decode to UDP: %v", dgram.packet)
+			}
+			if got := append(append([]byte(nil), udp.Contents...), udp.Payload...); !bytes.Equal(got, payload) {
+				t.Errorf("reassembled payload differs")
+			}
+			if tt.v6 {
+				ip := dgram.packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+				if ip.Length != uint16(len(dgram.packet.Data())-40) {
+					t.Errorf("rebuilt IPv6 header has length %d", ip.Length)
+				}
+			} else {
+				ip := dgram.packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				if ip.Length != uint16(20+len(payload)) || ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0 {
+					t.Errorf("rebuilt IPv4 header has length %d, flags %v and offset %d", ip.Length, ip.Flags, ip.FragOffset)
+				}
+			}
+			if d.reassembled != 1 || d.dropped != 0 || d.size != 0 || len(d.pending) != 0 {
+				t.Errorf("reassembled %d, dropped %d, %d bytes in %d datagrams left", d.reassembled, d.dropped, d.size, len(d.pending))
+			}
+		})
+	}
+}
+
+func TestDefragmenterRejects(t *testing.T) {
+	payload := udpDatagram(3000)
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		opts  FragmentOptions
+		frags []gopacket.Packet
+		// at is the time of each fragment after now; zero for all at once
+		at      []time.Duration
+		dropped uint64
+		pending int
+	}{
+		{
+			name: "overlapping fragments",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 1, 1472, false, payload[1472:], 0),
+			},
+			dropped: 2,
+		},
+		{
+			name: "duplicate fragment is kept",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+			},
+			pending: 1,
+		},
+		{
+			name: "data after the last fragment",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 1480, false, payload[1480:2960], 0),
+				ipv4Fragment(t, 1, 2960, true, payload[2960:2968], 0),
+			},
+			dropped: 2,
+		},
+		{
+			name: "empty non-final fragment",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 1, 2960, true, nil, 0),
+			},
+			dropped: 2,
+		},
+		{
+			name: "non-final fragment not a multiple of 8",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1479], 0),
+			},
+			dropped: 1,
+		},
+		{
+			// Fits in 65535 bytes of payload, but not with the header
+			name: "ipv4 total length over 65535",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 65472, false, make([]byte, 56), 0),
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+			},
+			dropped: 2,
+		},
+		{
+			name: "ipv4 options push the length over 65535",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 40),
+				ipv4Fragment(t, 1, 65472, false, make([]byte, 16), 40),
+			},
+			dropped: 2,
+		},
+		{
+			name: "ipv6 extension headers push the length over 65535",
+			frags: []gopacket.Packet{
+				ipv6Fragment(t, 1, 0, true, payload[:1448], true),
+				ipv6Fragment(t, 1, 65520, false, make([]byte, 8), true),
+			},
+			dropped: 2,
+		},
+		{
+			name: "incomplete datagram times out",
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 2, 0, true, payload[:1480], 0),
+			},
+			at:      []time.Duration{0, 31 * time.Second},
+			dropped: 1,
+			pending: 1,
+		},
+		{
+			name: "datagram limit drops the oldest",
+			opts: FragmentOptions{Timeout: time.Minute, MaxDatagrams: 2, MaxBytes: 1 << 20},
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 2, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 3, 0, true, payload[:1480], 0),
+			},
+			dropped: 1,
+			pending: 2,
+		},
+		{
+			name: "memory limit drops the oldest",
+			opts: FragmentOptions{Timeout: time.Minute, MaxDatagrams: 10, MaxBytes: 2000},
+			frags: []gopacket.Packet{
+				ipv4Fragment(t, 1, 0, true, payload[:1480], 0),
+				ipv4Fragment(t, 2, 0, true, payload[:1480], 0),
+			},
+			dropped: 1,
+			pending: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts.Timeout == 0 {
+				opts = DefaultFragmentOptions()
+			}
+			d := newDefragmenter(opts)
+			for i, frag := range tt.frags {
+				at := now
+				if tt.at != nil {
+					at = now.Add(tt.at[i])
+				}
+				if _, ok := d.process(frag, len(frag.Data()), at); ok {
+					t.Fatalf("fragment %d completed a datagram", i)
+				}
+			}
+			if d.dropped != tt.dropped || len(d.pending) != tt.pending {
+				t.Errorf("dropped %d fragments with %d datagrams pending, want %d and %d", d.dropped, len(d.pending), tt.dropped, tt.pending)
+			}
+			if d.reassembled != 0 {
+				t.Errorf("reassembled %d datagrams", d.reassembled)
+			}
+		})
+	}
+}
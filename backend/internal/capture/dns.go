@@ -0,0 +1,268 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// dnsTimeout is how long a query waits for its response
+	dnsTimeout = 5 * time.Second
+	// maxPendingDNS bounds the queries awaiting a response per capture
+	maxPendingDNS = 10000
+)
+
+const (
+	// maxHostnames bounds the address → name map shared by the captures
+	maxHostnames = 100000
+	// minHostnameTTL keeps short-lived answers around long enough for the
+	// connections they lead to; clients often cache past the TTL anyway
+	minHostnameTTL = 5 * time.Minute
+	// domainAttempts is how many ticks a flow gets to find its domain, in
+	// case the answer is processed just after the first packet
+	domainAttempts = 3
+)
+
+// dnsPorts are the server ports of DNS, mDNS and LLMNR
+var dnsPorts = map[uint16]bool{53: true, 5353: true, 5355: true}
+
+// dnsRCodes are the names of the common response codes
+var dnsRCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+func rcodeName(code layers.DNSResponseCode) string {
+	if name, ok := dnsRCodes[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", code)
+}
+
+// dnsKey matches a response to its query
+type dnsKey struct {
+	client     string
+	clientPort uint16
+	server     string
+	id         uint16
+}
+
+// dnsTracker pairs the DNS queries and responses of a capture. Each shard
+// owns one and only touches it from its worker.
+type dnsTracker struct {
+	iface     string
+	pending   map[dnsKey]*models.DNSQuery
+	done      []*models.DNSQuery // finished since the last flush
+	hostnames *hostnameCache     // may be nil
+}
+
+func newDNSTracker(iface string, hostnames *hostnameCache) *dnsTracker {
+	return &dnsTracker{
+		iface:     iface,
+		pending:   make(map[dnsKey]*models.DNSQuery),
+		hostnames: hostnames,
+	}
+}
+
+// observe parses the DNS messages in the payload of a packet to or from a
+// DNS port. Over TCP only messages that fit in the segment are seen.
+func (d *dnsTracker) observe(info *packetInfo) {
+	if len(info.payload) == 0 || !(dnsPorts[info.srcPort] || dnsPorts[info.dstPort]) {
+		return
+	}
+
+	switch info.protocol {
+	case "UDP":
+		d.parse(info, info.payload)
+	case "TCP":
+		// Each message carries a two byte length prefix
+		data := info.payload
+		for len(data) >= 2 {
+			length := int(binary.BigEndian.Uint16(data))
+			if length == 0 || len(data) < 2+length {
+				return
+			}
+			d.parse(info, data[2:2+length])
+			data = data[2+length:]
+		}
+	}
+}
+
+func (d *dnsTracker) parse(info *packetInfo, data []byte) {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	if msg.OpCode != layers.DNSOpCodeQuery || len(msg.Questions) == 0 {
+		return
+	}
+	question := msg.Questions[0]
+	name := normalizeName(question.Name)
+
+	if !msg.QR {
+		if len(d.pending) >= maxPendingDNS {
+			return
+		}
+		key := dnsKey{info.srcIP, info.srcPort, info.dstIP, msg.ID}
+		d.pending[key] = &models.DNSQuery{
+			Timestamp:  info.timestamp,
+			Interface:  d.iface,
+			Transport:  info.protocol,
+			ClientIP:   info.srcIP,
+			ClientPort: info.srcPort,
+			ServerIP:   info.dstIP,
+			ID:         msg.ID,
+			Name:       name,
+			Type:       question.Type.String(),
+		}
+		return
+	}
+
+	key := dnsKey{info.dstIP, info.dstPort, info.srcIP, msg.ID}
+	query, ok := d.pending[key]
+	if ok {
+		delete(d.pending, key)
+		query.LatencyMs = float64(info.timestamp.Sub(query.Timestamp)) / float64(time.Millisecond)
+	} else {
+		query = &models.DNSQuery{
+			Timestamp:  info.timestamp,
+			Interface:  d.iface,
+			Transport:  info.protocol,
+			ClientIP:   info.dstIP,
+			ClientPort: info.dstPort,
+			ServerIP:   info.srcIP,
+			ID:         msg.ID,
+			Name:       name,
+			Type:       question.Type.String(),
+		}
+	}
+	query.RCode = rcodeName(msg.ResponseCode)
+
+	for _, answer := range msg.Answers {
+		switch answer.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			query.Answers = append(query.Answers, answer.IP.String())
+			// Connections go to the name the client asked for, not to the
+			// end of its CNAME chain
+			if d.hostnames != nil {
+				d.hostnames.add(answer.IP, name, time.Duration(answer.TTL)*time.Second, info.timestamp)
+			}
+		case layers.DNSTypeCNAME:
+			query.Answers = append(query.Answers, normalizeName(answer.CNAME))
+		case layers.DNSTypePTR:
+			query.Answers = append(query.Answers, normalizeName(answer.PTR))
+		}
+	}
+	d.done = append(d.done, query)
+}
+
+// expire gives up on queries whose response is overdue as of now
+func (d *dnsTracker) expire(now time.Time) {
+	for key, query := range d.pending {
+		if now.Sub(query.Timestamp) > dnsTimeout {
+			query.RCode = models.RCodeTimeout
+			d.done = append(d.done, query)
+			delete(d.pending, key)
+		}
+	}
+}
+
+// take returns the lookups finished since the last call
+func (d *dnsTracker) take() []*models.DNSQuery {
+	done := d.done
+	d.done = nil
+	return done
+}
+
+// normalizeName lower cases a name and drops the trailing dot
+func normalizeName(name []byte) string {
+	return strings.TrimSuffix(strings.ToLower(string(name)), ".")
+}
+
+// hostnameEntry is a name an address resolved to
+type hostnameEntry struct {
+	name    string
+	expires time.Time
+}
+
+// hostnameCache maps addresses to the names they were looked up by. It is
+// shared by all captures, since the lookup and the connection can be seen
+// on different interfaces.
+type hostnameCache struct {
+	mu      sync.RWMutex
+	entries map[string]hostnameEntry
+}
+
+func newHostnameCache() *hostnameCache {
+	return &hostnameCache{entries: make(map[string]hostnameEntry)}
+}
+
+// add records that ip resolved to name with the given TTL
+func (c *hostnameCache) add(ip net.IP, name string, ttl time.Duration, now time.Time) {
+	if ip == nil || name == "" {
+		return
+	}
+	expires := now.Add(max(ttl, minHostnameTTL))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxHostnames {
+		c.evict(now)
+	}
+	c.entries[ip.String()] = hostnameEntry{name: name, expires: expires}
+}
+
+// evict drops expired entries, or an arbitrary tenth of them if none are
+func (c *hostnameCache) evict(now time.Time) {
+	for addr, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, addr)
+		}
+	}
+	excess := len(c.entries) - maxHostnames*9/10
+	for addr := range c.entries {
+		if excess <= 0 {
+			break
+		}
+		delete(c.entries, addr)
+		excess--
+	}
+}
+
+// lookup returns the name ip last resolved from, if still valid at now
+func (c *hostnameCache) lookup(ip string, now time.Time) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[ip]
+	if !ok || now.After(entry.expires) {
+		return ""
+	}
+	return entry.name
+}
+
+// annotateDomains labels new flows with the domain that resolved to the
+// server address
+func (s *shard) annotateDomains(now time.Time) {
+	if s.pc.hostnames == nil {
+		return
+	}
+	for _, entry := range s.flows.flows {
+		if entry.flow.Domain != "" || entry.domainAttempts >= domainAttempts {
+			continue
+		}
+		entry.domainAttempts++
+		entry.flow.Domain = s.pc.hostnames.lookup(entry.flow.DstIP, now)
+	}
+}
@@ -0,0 +1,60 @@
+package capture
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// snapLen is the capture length used when opening live handles
+const snapLen = 65536
+
+// FilterError reports a BPF expression that failed to compile
+type FilterError struct {
+	Filter string
+	Err    error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid BPF filter %q: %v", e.Filter, e.Err)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateFilter compiles expr for the given link type without applying it.
+// An empty expression is valid and means "capture everything".
+func ValidateFilter(linkType layers.LinkType, expr string) error {
+	if expr == "" {
+		return nil
+	}
+	if _, err := pcap.CompileBPFFilter(linkType, snapLen, expr); err != nil {
+		return &FilterError{Filter: expr, Err: err}
+	}
+	return nil
+}
+
+// SetFilter validates expr against the sources' link type and applies it
+func (pc *PacketCapture) SetFilter(expr string) error {
+	if err := ValidateFilter(pc.linkType(), expr); err != nil {
+		return err
+	}
+	pc.filterMu.Lock()
+	defer pc.filterMu.Unlock()
+	for _, source := range pc.sources {
+		if err := source.setFilter(expr); err != nil {
+			return &FilterError{Filter: expr, Err: err}
+		}
+	}
+	pc.filter = expr
+	return nil
+}
+
+// Filter returns the BPF expression currently applied to the capture
+func (pc *PacketCapture) Filter() string {
+	pc.filterMu.RLock()
+	defer pc.filterMu.RUnlock()
+	return pc.filter
+}
@@ -0,0 +1,32 @@
+package capture
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSetFilterConcurrentWithFilter(t *testing.T) {
+	pc, err := NewPacketCaptureFromFile("testdata/midstream.pcap", ReplayOptions{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := pc.SetFilter(""); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if filter := pc.Filter(); filter != "" {
+				t.Errorf("filter %q, want none", filter)
+			}
+		}()
+	}
+	wg.Wait()
+}
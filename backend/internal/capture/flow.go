@@ -0,0 +1,310 @@
+package capture
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// How the client side of a flow was identified
+const (
+	InitiatorSYN         = "syn"          // saw the TCP handshake
+	InitiatorPort        = "port"         // well-known port is the server
+	InitiatorICMP        = "icmp"         // sender of the ICMP request
+	InitiatorFirstPacket = "first_packet" // sender of the first packet we saw
+)
+
+// FlowKey identifies a flow regardless of direction. The endpoints are kept
+// in a canonical order so both directions of a session map to the same key.
+type FlowKey struct {
+	Protocol string
+	AddrA    string
+	PortA    uint16
+	AddrB    string
+	PortB    uint16
+	// The same addresses on different VLANs or overlay networks are
+	// different networks
+	VLAN   vlanTag
+	Tunnel uint32 // VNI or GRE key of the tunnel the flow was carried in
+}
+
+// NewFlowKey builds the canonical key for a packet. The returned bool is true
+// when the packet's source is endpoint A.
+func NewFlowKey(protocol, srcIP string, srcPort uint16, dstIP string, dstPort uint16) (FlowKey, bool) {
+	if srcIP < dstIP || (srcIP == dstIP && srcPort <= dstPort) {
+		return FlowKey{Protocol: protocol, AddrA: srcIP, PortA: srcPort, AddrB: dstIP, PortB: dstPort}, true
+	}
+	return FlowKey{Protocol: protocol, AddrA: dstIP, PortA: dstPort, AddrB: srcIP, PortB: srcPort}, false
+}
+
+func (k FlowKey) String() string {
+	s := fmt.Sprintf("%s:%d-%s:%d-%s", k.AddrA, k.PortA, k.AddrB, k.PortB, k.Protocol)
+	if k.VLAN.outer != 0 {
+		s += fmt.Sprintf("@vlan%d", k.VLAN.outer)
+		if k.VLAN.inner != 0 {
+			s += fmt.Sprintf(".%d", k.VLAN.inner)
+		}
+	}
+	if k.Tunnel != 0 {
+		s += fmt.Sprintf("@vni%d", k.Tunnel)
+	}
+	return s
+}
+
+// packetInfo is what the flow table needs to know about a decoded packet
+type packetInfo struct {
+	srcIP     string
+	dstIP     string
+	srcPort   uint16
+	dstPort   uint16
+	protocol  string
+	length    int              // bytes on the wire
+	frames    int              // frames the packet arrived in, more than one if reassembled
+	weight    uint64           // packets on the link it stands for, more than one when sampling
+	timestamp time.Time        // capture time of the packet
+	srcMAC    net.HardwareAddr // Ethernet addresses of the outer frame, if any
+	dstMAC    net.HardwareAddr
+	tcp       *layers.TCP // nil unless the packet is TCP
+	payload   []byte      // TCP/UDP payload
+	icmp      *icmpInfo   // nil unless the packet is ICMP/ICMPv6
+	encap     encapsulation
+	tunnel    *models.TunnelInfo // set when the packet was decapsulated
+}
+
+// tunnelID is the VNI or GRE key of the tunnel carrying the packet
+func (i *packetInfo) tunnelID() uint32 {
+	if i.tunnel != nil {
+		return i.tunnel.VNI
+	}
+	return 0
+}
+
+// keyProtocol is the protocol part of the flow key. ICMP flows are split by
+// message type, so a ping and an unreachable between the same hosts differ.
+func (i *packetInfo) keyProtocol() string {
+	if i.icmp != nil {
+		return i.icmp.keyProtocol
+	}
+	return i.protocol
+}
+
+// flowEntry is a flow plus the bookkeeping that isn't exported
+type flowEntry struct {
+	flow *models.Flow
+	rate flowRate
+	life flowLifecycle
+	tcp  *tcpTracker // nil unless the flow is TCP
+	app  appState
+	tls  *tlsTracker // nil until the first TCP payload
+	quic *quicState  // nil unless the flow is QUIC
+
+	domainAttempts int // lookups of the server address so far
+
+	processAttempts int    // process table scans looked up so far
+	processScan     uint64 // the last of them
+}
+
+// flowTable aggregates packets into bidirectional flows
+type flowTable struct {
+	iface   string
+	rates   RateOptions
+	opts    FlowOptions
+	flows   map[FlowKey]*flowEntry
+	lru     *list.List     // most recently seen at the front
+	expired []*models.Flow // waiting to be delivered at the next flush
+
+	// QUIC flows by connection ID, and the ID lengths in use
+	quicIDs    map[string]*flowEntry
+	quicIDLens map[int]int
+	// routes shares the connection IDs with the reader dispatching to the
+	// shards, nil otherwise; links hands ICMP errors to the other shards,
+	// nil with a single one. shard is the one of this table.
+	routes *quicRoutes
+	links  *icmpLinks
+	shard  int
+}
+
+func newFlowTable(iface string, rates RateOptions, opts FlowOptions) *flowTable {
+	if opts.IdleTimeout <= 0 {
+		// Never expire everything on every tick because of unset options
+		opts.IdleTimeout = DefaultFlowOptions().IdleTimeout
+	}
+	return &flowTable{
+		iface: iface,
+		rates: rates,
+		opts:  opts,
+		flows: make(map[FlowKey]*flowEntry),
+		lru:   list.New(),
+
+		quicIDs:    make(map[string]*flowEntry),
+		quicIDLens: make(map[int]int),
+	}
+}
+
+// update accounts a packet to its flow, creating the flow if needed
+func (t *flowTable) update(info *packetInfo) *flowEntry {
+	key, _ := NewFlowKey(info.keyProtocol(), info.srcIP, info.srcPort, info.dstIP, info.dstPort)
+	key.VLAN = info.encap.vlan
+	key.Tunnel = info.tunnelID()
+
+	entry, exists := t.flows[key]
+	migrated := false
+	if !exists && info.protocol == "UDP" {
+		// A QUIC connection that moved to a new address
+		if entry = t.quicFlow(info.payload); entry != nil {
+			exists, migrated = true, true
+		}
+	}
+	if exists && entry.flow.State == FlowClosed && isHandshake(info.tcp) && !info.tcp.ACK {
+		// The port pair is being reused for a new session
+		t.expire(entry, entry.flow.EndReason)
+		exists = false
+	}
+
+	if !exists {
+		t.makeRoom()
+		entry = t.newEntry(key, info)
+		t.flows[key] = entry
+	} else if entry.flow.InitiatorMethod != InitiatorSYN && isHandshake(info.tcp) {
+		// A late SYN is better evidence than the guess we made
+		entry.orient(info)
+	}
+
+	flow := entry.flow
+	fromClient := info.srcIP == flow.SrcIP && info.srcPort == flow.SrcPort
+	if migrated {
+		// Only the client moves
+		fromClient = info.srcIP != flow.DstIP || info.srcPort != flow.DstPort
+	}
+	bytes, packets := uint64(info.length)*info.weight, uint64(info.frames)*info.weight
+	if fromClient {
+		flow.ClientBytes += bytes
+		flow.ClientPackets += packets
+	} else {
+		flow.ServerBytes += bytes
+		flow.ServerPackets += packets
+	}
+
+	if flow.SrcMAC == "" && len(info.srcMAC) > 0 {
+		clientMAC, serverMAC := info.srcMAC, info.dstMAC
+		if !fromClient {
+			clientMAC, serverMAC = serverMAC, clientMAC
+		}
+		flow.SrcMAC, flow.DstMAC = clientMAC.String(), serverMAC.String()
+	}
+
+	flow.Bytes += bytes
+	flow.Packets += packets
+	sampled := info.weight > 1
+	if sampled {
+		flow.SamplingRate = info.weight
+		flow.EstimatedError = samplingError(flow.Packets / info.weight)
+	}
+	flow.LastSeen = info.timestamp
+	if !equalLabels(flow.MPLSLabels, info.encap.mpls) {
+		flow.MPLSLabels = info.encap.mpls
+	}
+
+	// The gaps sampling leaves in a connection would pass for losses and
+	// stall the reassembly of handshakes
+	entry.trackTCP(info, fromClient)
+	if !sampled {
+		entry.trackHealth(info, fromClient)
+	}
+	t.trackICMP(entry, info)
+	entry.classify(info, fromClient)
+	if !sampled {
+		entry.inspectTLS(info, fromClient)
+	}
+	t.inspectQUIC(entry, info, fromClient)
+	t.touch(entry, info.timestamp)
+
+	return entry
+}
+
+// newEntry creates a flow oriented client → server
+func (t *flowTable) newEntry(key FlowKey, info *packetInfo) *flowEntry {
+	flow := &models.Flow{
+		Connection: models.Connection{
+			Interface: t.iface,
+			Protocol:  info.protocol,
+			VLAN:      key.VLAN.outer,
+			InnerVLAN: key.VLAN.inner,
+			Tunnel:    info.tunnel,
+			StartTime: info.timestamp,
+		},
+		Key:   key.String(),
+		State: FlowActive,
+	}
+	entry := &flowEntry{flow: flow, life: flowLifecycle{key: key}}
+	entry.orient(info)
+	return entry
+}
+
+// orient works out which side of the packet is the client and points the
+// flow that way, swapping the per-direction counters if it flips
+func (e *flowEntry) orient(info *packetInfo) {
+	srcIsClient, method := guessClient(info)
+
+	clientIP, clientPort := info.srcIP, info.srcPort
+	serverIP, serverPort := info.dstIP, info.dstPort
+	if !srcIsClient {
+		clientIP, clientPort, serverIP, serverPort = serverIP, serverPort, clientIP, clientPort
+	}
+
+	flow := e.flow
+	if flow.SrcIP != "" && (flow.SrcIP != clientIP || flow.SrcPort != clientPort) {
+		flow.ClientBytes, flow.ServerBytes = flow.ServerBytes, flow.ClientBytes
+		flow.ClientPackets, flow.ServerPackets = flow.ServerPackets, flow.ClientPackets
+		flow.SrcMAC, flow.DstMAC = flow.DstMAC, flow.SrcMAC
+		if e.tcp != nil {
+			e.tcp.dirs[0], e.tcp.dirs[1] = e.tcp.dirs[1], e.tcp.dirs[0]
+		}
+	}
+
+	flow.SrcIP, flow.SrcPort = clientIP, clientPort
+	flow.DstIP, flow.DstPort = serverIP, serverPort
+	flow.Initiator = fmt.Sprintf("%s:%d", clientIP, clientPort)
+	flow.InitiatorMethod = method
+}
+
+// guessClient reports whether the packet's sender is the client
+func guessClient(info *packetInfo) (bool, string) {
+	if isHandshake(info.tcp) {
+		// SYN comes from the client, SYN/ACK from the server
+		return !info.tcp.ACK, InitiatorSYN
+	}
+
+	if info.icmp != nil {
+		// Requests come from the client, unsolicited messages from whoever sent them
+		return !info.icmp.reply, InitiatorICMP
+	}
+
+	// The side on a well-known port is usually the server
+	srcWellKnown, dstWellKnown := info.srcPort < 1024, info.dstPort < 1024
+	if srcWellKnown != dstWellKnown {
+		return dstWellKnown, InitiatorPort
+	}
+
+	return true, InitiatorFirstPacket
+}
+
+func isHandshake(tcp *layers.TCP) bool {
+	return tcp != nil && tcp.SYN
+}
+
+func equalLabels(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,448 @@
+package capture
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// maxHTTPHeader bounds the header block of a message; larger ones, or
+	// streams that aren't HTTP after all, are no longer parsed
+	maxHTTPHeader = 16 * 1024
+	// maxHTTPPending bounds the requests of a connection awaiting responses
+	maxHTTPPending = 64
+	// httpGapTimeout is how long the reassembly waits for a missing segment
+	// before skipping it
+	httpGapTimeout = 2 * time.Second
+	// Reassembly buffers out-of-order segments in pages of about 2KB
+	httpMaxPages        = 4096
+	httpMaxPagesPerConn = 64
+)
+
+// Parser states of an HTTP half stream
+const (
+	httpHeaders    = iota // reading a start line and headers
+	httpBody              // reading a body of known length
+	httpChunkSize         // reading a chunk size line
+	httpChunkData         // reading chunk data and its CRLF
+	httpTrailers          // reading the trailers after the last chunk
+	httpUntilClose        // the body ends with the connection
+	httpResync            // lost track; waiting for a segment starting a message
+	httpStopped           // not HTTP, or upgraded to another protocol
+)
+
+// httpTracker reassembles the TCP streams of HTTP flows and logs their
+// requests. Each shard owns one and only touches it from its worker.
+type httpTracker struct {
+	iface     string
+	assembler *tcpassembly.Assembler
+	// conversations pairs the two directions of a connection
+	conversations map[string]*httpConversation
+	done          []*models.HTTPRequest // finished since the last flush
+}
+
+func newHTTPTracker(iface string) *httpTracker {
+	t := &httpTracker{
+		iface:         iface,
+		conversations: make(map[string]*httpConversation),
+	}
+	t.assembler = tcpassembly.NewAssembler(tcpassembly.NewStreamPool(t))
+	t.assembler.MaxBufferedPagesTotal = httpMaxPages
+	t.assembler.MaxBufferedPagesPerConnection = httpMaxPagesPerConn
+	return t
+}
+
+// observe feeds the reassembly with the segments of flows that are HTTP or
+// not classified yet. Streams must be followed from the handshake: without
+// it the first segment only gets through when the gap times out.
+func (t *httpTracker) observe(entry *flowEntry, info *packetInfo, network gopacket.NetworkLayer) {
+	if info.tcp == nil || (entry.app.done && entry.flow.AppProtocol != "HTTP") {
+		return
+	}
+	t.assembler.AssembleWithTimestamp(network.NetworkFlow(), info.tcp, info.timestamp)
+}
+
+// flush skips segments that have been missing for too long and closes the
+// streams of connections idle since before idleSince
+func (t *httpTracker) flush(now, idleSince time.Time) {
+	t.assembler.FlushWithOptions(tcpassembly.FlushOptions{T: now.Add(-httpGapTimeout)})
+	t.assembler.FlushWithOptions(tcpassembly.FlushOptions{T: idleSince, CloseAll: true})
+}
+
+// take returns the requests finished since the last call
+func (t *httpTracker) take() []*models.HTTPRequest {
+	done := t.done
+	t.done = nil
+	return done
+}
+
+// New is called by the reassembly for each direction of a new connection
+func (t *httpTracker) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	src := netFlow.Src().String() + "|" + tcpFlow.Src().String()
+	dst := netFlow.Dst().String() + "|" + tcpFlow.Dst().String()
+	key := src + "-" + dst
+	if src > dst {
+		key = dst + "-" + src
+	}
+
+	conv, ok := t.conversations[key]
+	if !ok {
+		conv = &httpConversation{tracker: t, key: key}
+		t.conversations[key] = conv
+	}
+	conv.streams++
+
+	srcPort, _ := strconv.ParseUint(tcpFlow.Src().String(), 10, 16)
+	dstPort, _ := strconv.ParseUint(tcpFlow.Dst().String(), 10, 16)
+	return &httpStream{
+		conv:    conv,
+		srcIP:   netFlow.Src().String(),
+		srcPort: uint16(srcPort),
+		dstIP:   netFlow.Dst().String(),
+		dstPort: uint16(dstPort),
+		state:   httpHeaders,
+	}
+}
+
+// httpConversation is a connection; requests are answered in order, also
+// when pipelined
+type httpConversation struct {
+	tracker *httpTracker
+	key     string
+	pending []*models.HTTPRequest
+	streams int // directions not yet complete
+}
+
+// httpStream parses the messages of one direction. Which direction is the
+// client's is told by the first message: requests or responses.
+type httpStream struct {
+	conv    *httpConversation
+	srcIP   string
+	srcPort uint16
+	dstIP   string
+	dstPort uint16
+
+	state     int
+	buf       []byte // partial header block, chunk size line or trailers
+	remaining int64  // body or chunk bytes still to come
+	size      int64  // body bytes of the current message
+	// current is the request being received, or being answered
+	current *models.HTTPRequest
+	isReply bool
+}
+
+// Reassembled receives the next bytes of the stream in order
+func (s *httpStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, r := range reassemblies {
+		if s.state == httpStopped {
+			return
+		}
+		if r.Skip != 0 && !s.skip(r.Skip) {
+			s.state = httpResync
+		}
+		if s.state == httpResync {
+			if !startsMessage(r.Bytes) {
+				continue
+			}
+			s.state, s.buf = httpHeaders, nil
+		}
+		s.consume(r.Bytes, r.Seen)
+	}
+}
+
+// skip accounts for missing bytes, reporting whether the parser can carry on
+func (s *httpStream) skip(n int) bool {
+	switch s.state {
+	case httpBody:
+		if n > 0 && int64(n) < s.remaining {
+			s.remaining -= int64(n)
+			s.size += int64(n)
+			return true
+		}
+	case httpUntilClose:
+		if n > 0 {
+			s.size += int64(n)
+			return true
+		}
+	}
+	return false
+}
+
+// consume runs data through the parser
+func (s *httpStream) consume(data []byte, seen time.Time) {
+	for len(data) > 0 {
+		switch s.state {
+		case httpHeaders:
+			if len(s.buf) == 0 && !mayStartMessage(data) {
+				// Not HTTP, fed while the flow was being classified
+				s.stop()
+				return
+			}
+			s.buf = append(s.buf, data...)
+			end := bytes.Index(s.buf, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(s.buf) > maxHTTPHeader {
+					s.stop()
+				}
+				return
+			}
+			data = s.buf[end+4:]
+			header := s.buf[:end]
+			s.buf = nil
+			s.size = 0
+			if !s.parseHeader(string(header), seen) {
+				s.stop()
+				return
+			}
+			if s.state == httpHeaders {
+				// No body
+				s.endMessage()
+			}
+		case httpBody:
+			n := min(int64(len(data)), s.remaining)
+			s.size += n
+			s.remaining -= n
+			data = data[n:]
+			if s.remaining == 0 {
+				s.state = httpHeaders
+				s.endMessage()
+			}
+		case httpChunkData:
+			n := min(int64(len(data)), s.remaining)
+			s.remaining -= n
+			data = data[n:]
+			if s.remaining == 0 {
+				s.state = httpChunkSize
+			}
+		case httpChunkSize, httpTrailers:
+			s.buf = append(s.buf, data...)
+			data = nil
+			for s.state == httpChunkSize || s.state == httpTrailers {
+				line, rest, ok := bytes.Cut(s.buf, []byte("\r\n"))
+				if !ok {
+					if len(s.buf) > maxHTTPHeader {
+						s.stop()
+					}
+					return
+				}
+				s.buf = rest
+				if s.state == httpTrailers {
+					if len(line) == 0 {
+						s.state = httpHeaders
+						data, s.buf = s.buf, nil
+						s.endMessage()
+					}
+					continue
+				}
+				sizeStr, _, _ := strings.Cut(string(line), ";")
+				chunk, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+				if err != nil || chunk < 0 {
+					s.stop()
+					return
+				}
+				if chunk == 0 {
+					s.state = httpTrailers
+					continue
+				}
+				s.size += chunk
+				s.remaining = chunk + 2 // data and CRLF
+				s.state = httpChunkData
+				data, s.buf = s.buf, nil
+			}
+		case httpUntilClose:
+			s.size += int64(len(data))
+			return
+		default:
+			return
+		}
+	}
+}
+
+// stop gives up on the stream
+func (s *httpStream) stop() {
+	s.state, s.buf = httpStopped, nil
+}
+
+// parseHeader handles the start line and headers of a message and sets the
+// state for its body. It returns false if the message isn't HTTP.
+func (s *httpStream) parseHeader(header string, seen time.Time) bool {
+	lines := strings.Split(header, "\r\n")
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) < 2 {
+		return false
+	}
+
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			headers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	length := int64(-1)
+	if v, ok := headers["content-length"]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			length = n
+		}
+	}
+	chunked := strings.Contains(strings.ToLower(headers["transfer-encoding"]), "chunked")
+
+	if strings.HasPrefix(start[0], "HTTP/1.") {
+		status, err := strconv.Atoi(start[1])
+		if err != nil {
+			return false
+		}
+		return s.parseResponse(status, length, chunked, seen)
+	}
+	if len(start) != 3 || !strings.HasPrefix(start[2], "HTTP/1.") {
+		return false
+	}
+	s.parseRequest(start[0], start[1], headers["host"], length, chunked, seen)
+	return true
+}
+
+func (s *httpStream) parseRequest(method, target, host string, length int64, chunked bool, seen time.Time) {
+	s.isReply = false
+	// Proxies get absolute URLs
+	if rest, ok := strings.CutPrefix(target, "http://"); ok {
+		authority, path, _ := strings.Cut(rest, "/")
+		if host == "" {
+			host = authority
+		}
+		target = "/" + path
+	}
+
+	req := &models.HTTPRequest{
+		Timestamp:  seen,
+		Interface:  s.conv.tracker.iface,
+		ClientIP:   s.srcIP,
+		ClientPort: s.srcPort,
+		Method:     method,
+		Host:       strings.ToLower(host),
+		Path:       target,
+	}
+	conv := s.conv
+	if len(conv.pending) >= maxHTTPPending {
+		// The server isn't answering, or we aren't seeing its side
+		conv.tracker.done = append(conv.tracker.done, conv.pending[0])
+		conv.pending = conv.pending[1:]
+	}
+	conv.pending = append(conv.pending, req)
+	s.current = req
+
+	switch {
+	case chunked:
+		s.state = httpChunkSize
+	case length > 0:
+		s.state, s.remaining = httpBody, length
+	}
+}
+
+func (s *httpStream) parseResponse(status int, length int64, chunked bool, seen time.Time) bool {
+	s.isReply = true
+	// Interim responses precede the real one
+	if status >= 100 && status < 200 && status != 101 {
+		s.current = nil
+		return true
+	}
+
+	conv := s.conv
+	var req *models.HTTPRequest
+	if len(conv.pending) > 0 {
+		req = conv.pending[0]
+		conv.pending = conv.pending[1:]
+		req.LatencyMs = durationMs(seen.Sub(req.Timestamp))
+	} else {
+		// The request was before the capture started
+		req = &models.HTTPRequest{
+			Timestamp:  seen,
+			Interface:  conv.tracker.iface,
+			ClientIP:   s.dstIP,
+			ClientPort: s.dstPort,
+		}
+	}
+	req.ServerIP, req.ServerPort = s.srcIP, s.srcPort
+	req.StatusCode = status
+	s.current = req
+
+	switch {
+	case status == 101:
+		// Switching protocols, e.g. to WebSocket
+		s.endMessage()
+		s.stop()
+	case req.Method == "HEAD" || status == 204 || status == 304:
+	case chunked:
+		s.state = httpChunkSize
+	case length == 0:
+	case length > 0:
+		s.state, s.remaining = httpBody, length
+	default:
+		s.state = httpUntilClose
+	}
+	return true
+}
+
+// endMessage completes the current message
+func (s *httpStream) endMessage() {
+	req := s.current
+	s.current = nil
+	if req == nil {
+		return
+	}
+	if !s.isReply {
+		req.RequestSize = s.size
+		return
+	}
+	req.ResponseSize = s.size
+	req.Complete = true
+	s.conv.tracker.done = append(s.conv.tracker.done, req)
+}
+
+// ReassemblyComplete is called once the direction has ended
+func (s *httpStream) ReassemblyComplete() {
+	if s.state == httpUntilClose && s.current != nil {
+		s.endMessage()
+	}
+
+	conv := s.conv
+	conv.streams--
+	if conv.streams > 0 {
+		return
+	}
+	// Requests that never got an answer
+	conv.tracker.done = append(conv.tracker.done, conv.pending...)
+	delete(conv.tracker.conversations, conv.key)
+}
+
+// mayStartMessage reports whether data begins with a request or status line,
+// or with the start of one cut short by the end of a segment
+func mayStartMessage(data []byte) bool {
+	if startsMessage(data) || bytes.HasPrefix([]byte("HTTP/1."), data) {
+		return true
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(method, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// startsMessage reports whether data begins with a request or status line
+func startsMessage(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("HTTP/1.")) {
+		return true
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, method) {
+			return true
+		}
+	}
+	return false
+}
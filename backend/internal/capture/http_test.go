@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testShard is a shard of a capture with the default options
+func testShard() *shard {
+	pc := &PacketCapture{
+		opts: Options{
+			Rates:     DefaultRateOptions(),
+			Flows:     DefaultFlowOptions(),
+			Fragments: DefaultFragmentOptions(),
+		},
+		local: NewLocalAddrs("", nil),
+	}
+	return newShard(pc, layers.LinkTypeEthernet)
+}
+
+// tcpConn is a TCP connection to build test frames of
+type tcpConn struct {
+	client, server         net.IP
+	clientPort, serverPort uint16
+}
+
+// frame builds an Ethernet frame of a segment from client to server, or back
+// when reply is set
+func (c tcpConn) frame(t testing.TB, reply bool, seq, ack uint32, syn, fin bool, payload string) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: c.client, DstIP: c.server}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(c.clientPort), DstPort: layers.TCPPort(c.serverPort),
+		Seq: seq, Ack: ack, SYN: syn, FIN: fin, ACK: ack != 0, Window: 65535,
+	}
+	if reply {
+		eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHTTPOnOtherPorts(t *testing.T) {
+	const (
+		request  = "GET /status HTTP/1.1\r\nHost: Example.com:9000\r\n\r\n"
+		response = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		port     uint16
+		request  string
+		response string
+		requests int
+	}{
+		{name: "default port", port: 80, request: request, response: response, requests: 1},
+		{name: "other port", port: 9000, request: request, response: response, requests: 1},
+		{name: "not http", port: 9000, request: "\x00\x01hello\r\n\r\n", response: "\x00\x02hi\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testShard()
+			conn := tcpConn{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 20), 51000, tt.port}
+			frames := [][]byte{
+				conn.frame(t, false, 100, 0, true, false, ""),
+				conn.frame(t, true, 500, 101, true, false, ""),
+				conn.frame(t, false, 101, 501, false, false, ""),
+				conn.frame(t, false, 101, 501, false, false, tt.request),
+				conn.frame(t, true, 501, 101+uint32(len(tt.request)), false, false, tt.response),
+			}
+			for i, frame := range frames {
+				at := start.Add(time.Duration(i) * time.Millisecond)
+				s.processFrame(frame, gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(frame), Length: len(frame)})
+			}
+
+			// Well within the gap timeout: nothing may be waiting on it
+			now := start.Add(10 * time.Millisecond)
+			s.http.flush(now, now.Add(-time.Minute))
+			requests := s.http.take()
+			if len(requests) != tt.requests {
+				t.Fatalf("%d requests logged, want %d", len(requests), tt.requests)
+			}
+			if tt.requests == 0 {
+				return
+			}
+			req := requests[0]
+			if req.Method != "GET" || req.Path != "/status" || req.Host != "example.com:9000" || req.StatusCode != 200 {
+				t.Errorf("logged %+v", req)
+			}
+			if latency := 1.0; req.LatencyMs != latency {
+				t.Errorf("latency %vms, want %vms", req.LatencyMs, latency)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// icmpInfo is the part of an ICMP/ICMPv6 message the flow table cares about
+type icmpInfo struct {
+	typ         uint8
+	code        uint8
+	description string
+	keyProtocol string // protocol used in the flow key, e.g. "ICMP/8"
+	reply       bool   // a reply to a request type
+	echo        bool
+	id          uint16 // echo identifier, shared by request and reply
+	mtu         uint32 // next-hop MTU of packet-too-big / fragmentation-needed
+	// quoted is the 5-tuple of the packet an error message refers to
+	quoted *packetInfo
+}
+
+// setKey folds replies onto their requests so both directions of an
+// exchange share a flow, while different message types stay apart
+func (i *icmpInfo) setKey(protocol string) {
+	typ := i.typ
+	if request, ok := icmpReplyOf[protocol][typ]; ok {
+		typ = request
+		i.reply = true
+	}
+	i.keyProtocol = fmt.Sprintf("%s/%d", protocol, typ)
+}
+
+// keyPort is used as both ports of the flow key: the identifier for echo
+// and the code for everything else
+func (i *icmpInfo) keyPort() uint16 {
+	if i.echo {
+		return i.id
+	}
+	return uint16(i.code)
+}
+
+// icmpReplyOf maps reply types to the request type they answer
+var icmpReplyOf = map[string]map[uint8]uint8{
+	"ICMP": {
+		layers.ICMPv4TypeEchoReply:        layers.ICMPv4TypeEchoRequest,
+		layers.ICMPv4TypeTimestampReply:   layers.ICMPv4TypeTimestampRequest,
+		layers.ICMPv4TypeInfoReply:        layers.ICMPv4TypeInfoRequest,
+		layers.ICMPv4TypeAddressMaskReply: layers.ICMPv4TypeAddressMaskRequest,
+	},
+	"ICMPv6": {
+		layers.ICMPv6TypeEchoReply:             layers.ICMPv6TypeEchoRequest,
+		layers.ICMPv6TypeNeighborAdvertisement: layers.ICMPv6TypeNeighborSolicitation,
+		layers.ICMPv6TypeRouterAdvertisement:   layers.ICMPv6TypeRouterSolicitation,
+	},
+}
+
+// decodeICMP extracts the ICMP or ICMPv6 message at the start of ls, the
+// layers following the IP header
+func decodeICMP(ls []gopacket.Layer) (string, *icmpInfo) {
+	if icmp, ok := ls[0].(*layers.ICMPv4); ok {
+		info := &icmpInfo{
+			typ:         icmp.TypeCode.Type(),
+			code:        icmp.TypeCode.Code(),
+			description: icmp.TypeCode.String(),
+		}
+		switch info.typ {
+		case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
+			info.echo = true
+			info.id = icmp.Id
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+			layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+			if info.typ == layers.ICMPv4TypeDestinationUnreachable && info.code == layers.ICMPv4CodeFragmentationNeeded {
+				// Next-hop MTU lives in the low half of the "Seq" field
+				info.mtu = uint32(icmp.Seq)
+			}
+			info.quoted = parseQuoted(icmp.Payload)
+		}
+		info.setKey("ICMP")
+		return "ICMP", info
+	}
+
+	if icmp, ok := ls[0].(*layers.ICMPv6); ok {
+		info := &icmpInfo{
+			typ:         icmp.TypeCode.Type(),
+			code:        icmp.TypeCode.Code(),
+			description: icmp.TypeCode.String(),
+		}
+		switch info.typ {
+		case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+			info.echo = true
+			if len(ls) > 1 {
+				if echo, ok := ls[1].(*layers.ICMPv6Echo); ok {
+					info.id = echo.Identifier
+				}
+			}
+		case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+			layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+			// 4 bytes (unused, MTU or pointer) precede the quoted packet
+			if len(icmp.Payload) >= 4 {
+				if info.typ == layers.ICMPv6TypePacketTooBig {
+					info.mtu = binary.BigEndian.Uint32(icmp.Payload[:4])
+				}
+				info.quoted = parseQuoted(icmp.Payload[4:])
+			}
+		}
+		info.setKey("ICMPv6")
+		return "ICMPv6", info
+	}
+
+	return "", nil
+}
+
+// parseQuoted reads the addresses and ports of the original packet embedded
+// in an ICMP error. Only the IP header and the first 8 bytes of the transport
+// header are guaranteed to be present, which is too short for gopacket's TCP
+// decoder, so the headers are parsed by hand.
+func parseQuoted(data []byte) *packetInfo {
+	if len(data) < 1 {
+		return nil
+	}
+
+	var srcIP, dstIP net.IP
+	var proto layers.IPProtocol
+	var transport []byte
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return nil
+		}
+		srcIP, dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		proto = layers.IPProtocol(data[9])
+		transport = data[ihl:]
+	case 6:
+		if len(data) < 40 {
+			return nil
+		}
+		srcIP, dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		proto, transport = skipIPv6Extensions(layers.IPProtocol(data[6]), data[40:])
+	default:
+		return nil
+	}
+
+	info := &packetInfo{
+		srcIP: srcIP.String(),
+		dstIP: dstIP.String(),
+	}
+	switch proto {
+	case layers.IPProtocolTCP:
+		info.protocol = "TCP"
+	case layers.IPProtocolUDP:
+		info.protocol = "UDP"
+	default:
+		return nil
+	}
+	if len(transport) < 4 {
+		return nil
+	}
+	info.srcPort = binary.BigEndian.Uint16(transport[0:2])
+	info.dstPort = binary.BigEndian.Uint16(transport[2:4])
+	return info
+}
+
+// skipIPv6Extensions walks the extension header chain to the upper-layer
+// header. A non-first fragment has no upper-layer header, so it returns
+// IPv6NoNextHeader for those, as it does for a truncated chain.
+func skipIPv6Extensions(next layers.IPProtocol, data []byte) (layers.IPProtocol, []byte) {
+	for {
+		var size int
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(data) < 2 {
+				return layers.IPProtocolNoNextHeader, nil
+			}
+			size = (int(data[1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < 8 || binary.BigEndian.Uint16(data[2:4])>>3 != 0 {
+				return layers.IPProtocolNoNextHeader, nil
+			}
+			size = 8
+		case layers.IPProtocolAH:
+			if len(data) < 2 {
+				return layers.IPProtocolNoNextHeader, nil
+			}
+			size = (int(data[1]) + 2) * 4
+		default:
+			return next, data
+		}
+		if len(data) < size {
+			return layers.IPProtocolNoNextHeader, nil
+		}
+		next, data = layers.IPProtocol(data[0]), data[size:]
+	}
+}
+
+// trackICMP records ICMP details on the flow and links errors to the flow of
+// the packet that triggered them
+func (t *flowTable) trackICMP(entry *flowEntry, info *packetInfo) {
+	icmp := info.icmp
+	if icmp == nil {
+		return
+	}
+
+	if entry.flow.ICMP == nil {
+		entry.flow.ICMP = &models.ICMPInfo{
+			Type:        icmp.typ,
+			Code:        icmp.code,
+			Description: icmp.description,
+			Identifier:  icmp.id,
+		}
+	}
+	if icmp.mtu != 0 {
+		entry.flow.ICMP.MTU = icmp.mtu
+	}
+
+	quoted := icmp.quoted
+	if quoted == nil {
+		return
+	}
+	key, _ := NewFlowKey(quoted.protocol, quoted.srcIP, quoted.srcPort, quoted.dstIP, quoted.dstPort)
+	key.VLAN = info.encap.vlan
+	key.Tunnel = info.tunnelID()
+	entry.flow.ICMP.RelatedFlow = key.String()
+
+	if !t.linkICMPError(key, icmp.description) && t.links != nil {
+		// The flow may be kept by another shard
+		t.links.post(t.shard, icmpLink{key: key, description: icmp.description})
+	}
+}
+
+// linkICMPError counts an error against the flow it quotes, if in the table
+func (t *flowTable) linkICMPError(key FlowKey, description string) bool {
+	related, ok := t.flows[key]
+	if !ok {
+		return false
+	}
+	related.flow.ICMPErrors++
+	related.flow.LastICMPError = description
+	return true
+}
+
+// maxICMPLinks bounds the errors waiting for each shard between ticks
+const maxICMPLinks = 4096
+
+// icmpLink is an ICMP error about the flow of key
+type icmpLink struct {
+	key         FlowKey
+	description string
+}
+
+// icmpLinks carries ICMP errors between shards. An error stays with the flow
+// of its own addresses, while the flow it quotes may be kept by any other
+// shard, so it is posted to all of them and counted by the one keeping the
+// flow at its next tick.
+type icmpLinks struct {
+	mu      sync.Mutex
+	pending [][]icmpLink // by shard
+}
+
+func newICMPLinks(shards int) *icmpLinks {
+	return &icmpLinks{pending: make([][]icmpLink, shards)}
+}
+
+// post hands an error to the shards other than from
+func (l *icmpLinks) post(from int, link icmpLink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for shard := range l.pending {
+		if shard != from && len(l.pending[shard]) < maxICMPLinks {
+			l.pending[shard] = append(l.pending[shard], link)
+		}
+	}
+}
+
+// take returns the errors posted to a shard since the last call
+func (l *icmpLinks) take(shard int) []icmpLink {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	links := l.pending[shard]
+	l.pending[shard] = nil
+	return links
+}
@@ -0,0 +1,229 @@
+package capture
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// Why a flow left the flow table
+const (
+	EndIdle          = "idle"           // no packets for the idle timeout
+	EndActiveTimeout = "active_timeout" // long-lived flow exported periodically
+	EndFIN           = "fin"            // TCP closed by FIN from both sides
+	EndRST           = "rst"            // TCP reset
+	EndEvicted       = "evicted"        // pushed out by the flow limit
+	EndShutdown      = "shutdown"       // capture stopped
+)
+
+// Flow states
+const (
+	FlowActive  = "active"
+	FlowClosing = "closing" // FIN seen from one side
+	FlowClosed  = "closed"
+)
+
+// Eviction policies used once the flow limit is reached
+const (
+	EvictLRU        = "lru"         // least recently seen
+	EvictLeastBytes = "least-bytes" // smallest byte count
+)
+
+// closedLinger keeps terminated TCP flows around briefly so the trailing ACKs
+// are accounted to them instead of opening a new flow
+const closedLinger = 2 * time.Second
+
+// FlowExpiredFunc is called with a copy of every flow leaving the flow table.
+// It runs on the worker goroutines, possibly several at once, so it must be
+// safe for concurrent use and must not block.
+type FlowExpiredFunc func(flow *models.Flow)
+
+// FlowOptions bounds the lifetime and number of tracked flows
+type FlowOptions struct {
+	// IdleTimeout expires flows that saw no packets for this long
+	IdleTimeout time.Duration
+	// ActiveTimeout exports long-lived flows this often and restarts their
+	// counters, as NetFlow does; 0 disables it
+	ActiveTimeout time.Duration
+	// MaxFlows caps the table size; 0 means unlimited
+	MaxFlows int
+	// Eviction picks which flows make room once MaxFlows is reached
+	Eviction string
+}
+
+// DefaultFlowOptions returns the limits used when none are configured
+func DefaultFlowOptions() FlowOptions {
+	return FlowOptions{
+		IdleTimeout:   60 * time.Second,
+		ActiveTimeout: 30 * time.Minute,
+		MaxFlows:      100000,
+		Eviction:      EvictLRU,
+	}
+}
+
+// Validate checks the flow limits
+func (o FlowOptions) Validate() error {
+	if o.IdleTimeout <= 0 {
+		return fmt.Errorf("idle timeout must be positive, got %v", o.IdleTimeout)
+	}
+	if o.ActiveTimeout < 0 {
+		return fmt.Errorf("active timeout must not be negative, got %v", o.ActiveTimeout)
+	}
+	if o.MaxFlows < 0 {
+		return fmt.Errorf("flow limit must not be negative, got %d", o.MaxFlows)
+	}
+	switch o.Eviction {
+	case EvictLRU, EvictLeastBytes:
+	default:
+		return fmt.Errorf("unknown eviction policy %q", o.Eviction)
+	}
+	return nil
+}
+
+// flowLifecycle is the per-flow state used to decide when a flow ends
+type flowLifecycle struct {
+	key         FlowKey
+	elem        *list.Element // position in the LRU list
+	lastSeen    time.Time     // packet time of the latest packet
+	activeStart time.Time     // start of the current active timeout period
+	finClient   bool
+	finServer   bool
+}
+
+// trackTCP updates the flow state from the TCP flags of a packet
+func (e *flowEntry) trackTCP(info *packetInfo, fromClient bool) {
+	tcp := info.tcp
+	if tcp == nil || e.flow.State == FlowClosed {
+		return
+	}
+
+	switch {
+	case tcp.RST:
+		e.close(EndRST)
+	case tcp.FIN:
+		if fromClient {
+			e.life.finClient = true
+		} else {
+			e.life.finServer = true
+		}
+		if e.life.finClient && e.life.finServer {
+			e.close(EndFIN)
+		} else {
+			e.flow.State = FlowClosing
+		}
+	}
+}
+
+func (e *flowEntry) close(reason string) {
+	e.flow.State = FlowClosed
+	e.flow.EndReason = reason
+}
+
+// touch records packet activity for timeouts and the LRU order
+func (t *flowTable) touch(entry *flowEntry, now time.Time) {
+	entry.life.lastSeen = now
+	if entry.life.activeStart.IsZero() {
+		entry.life.activeStart = now
+	}
+	if entry.life.elem == nil {
+		entry.life.elem = t.lru.PushFront(entry)
+	} else {
+		t.lru.MoveToFront(entry.life.elem)
+	}
+}
+
+// expire removes a flow from the table and queues it for the next flush
+func (t *flowTable) expire(entry *flowEntry, reason string) {
+	if entry.flow.EndReason == "" {
+		entry.flow.EndReason = reason
+	}
+	entry.flow.State = FlowClosed
+
+	t.expired = append(t.expired, entry.flow.Clone())
+
+	delete(t.flows, entry.life.key)
+	t.forgetQUIC(entry)
+	if entry.life.elem != nil {
+		t.lru.Remove(entry.life.elem)
+	}
+}
+
+// makeRoom evicts flows once the table is full. Least-bytes eviction sorts
+// the table, so it frees a batch at a time to keep the cost amortised.
+func (t *flowTable) makeRoom() {
+	limit := t.opts.MaxFlows
+	if limit == 0 || len(t.flows) < limit {
+		return
+	}
+
+	batch := limit / 100
+	if batch < 1 {
+		batch = 1
+	}
+
+	switch t.opts.Eviction {
+	case EvictLeastBytes:
+		entries := make([]*flowEntry, 0, len(t.flows))
+		for _, entry := range t.flows {
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].flow.Bytes < entries[j].flow.Bytes
+		})
+		for i := 0; i < batch && i < len(entries); i++ {
+			t.expire(entries[i], EndEvicted)
+		}
+	default:
+		for i := 0; i < batch && t.lru.Len() > 0; i++ {
+			t.expire(t.lru.Back().Value.(*flowEntry), EndEvicted)
+		}
+	}
+}
+
+// expireStale ends idle and closed flows and exports flows that reached the
+// active timeout
+func (t *flowTable) expireStale(now time.Time) {
+	for _, entry := range t.flows {
+		idle := now.Sub(entry.life.lastSeen)
+		switch {
+		case entry.flow.State == FlowClosed && idle >= closedLinger:
+			t.expire(entry, entry.flow.EndReason)
+		case idle >= t.opts.IdleTimeout:
+			t.expire(entry, EndIdle)
+		case t.opts.ActiveTimeout > 0 && now.Sub(entry.life.activeStart) >= t.opts.ActiveTimeout:
+			t.exportActive(entry, now)
+		}
+	}
+}
+
+// exportActive emits a record for a long-lived flow and restarts its counters
+func (t *flowTable) exportActive(entry *flowEntry, now time.Time) {
+	flowCopy := entry.flow.Clone()
+	flowCopy.EndReason = EndActiveTimeout
+	t.expired = append(t.expired, flowCopy)
+
+	flow := entry.flow
+	flow.Bytes, flow.Packets = 0, 0
+	flow.ClientBytes, flow.ServerBytes = 0, 0
+	flow.ClientPackets, flow.ServerPackets = 0, 0
+	flow.StartTime = now
+	entry.rate.lastBytes, entry.rate.lastPackets = 0, 0
+	entry.life.activeStart = now
+}
+
+// expireAll ends every flow, e.g. when the capture stops
+func (t *flowTable) expireAll(reason string) {
+	for _, entry := range t.flows {
+		t.expire(entry, reason)
+	}
+}
+
+// takeExpired returns the flows expired since the last call
+func (t *flowTable) takeExpired() []*models.Flow {
+	expired := t.expired
+	t.expired = nil
+	return expired
+}
@@ -0,0 +1,204 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// localRefreshInterval is how often interface addresses are re-read so that
+// DHCP renewals and SLAAC changes are picked up
+const localRefreshInterval = 30 * time.Second
+
+// LocalAddrs knows which addresses belong to the capturing host and uses them
+// to work out whether a packet is incoming or outgoing. It is asked about
+// every packet, so the sets are keyed by values that need no allocation.
+type LocalAddrs struct {
+	mu        sync.RWMutex
+	iface     string
+	ips       map[netip.Addr]struct{}
+	macs      map[[6]byte]struct{}
+	homeNets  []*net.IPNet
+	refreshed time.Time
+}
+
+// NewLocalAddrs creates the address set for iface. An empty iface (e.g. when
+// replaying a file) leaves only the home networks to go by.
+func NewLocalAddrs(iface string, homeNets []*net.IPNet) *LocalAddrs {
+	l := &LocalAddrs{
+		iface:    iface,
+		ips:      make(map[netip.Addr]struct{}),
+		macs:     make(map[[6]byte]struct{}),
+		homeNets: homeNets,
+	}
+	if err := l.Refresh(); err != nil {
+		fmt.Printf("[Capture] Failed to read addresses of interface '%s': %v\n", iface, err)
+	}
+	return l
+}
+
+// Refresh re-reads the IPv4/IPv6 and hardware addresses of the interface
+func (l *LocalAddrs) Refresh() error {
+	ips := make(map[netip.Addr]struct{})
+	macs := make(map[[6]byte]struct{})
+
+	var firstErr error
+	if l.iface != "" {
+		// net.Interfaces knows the MAC and the OS view of the addresses
+		if ifi, err := net.InterfaceByName(l.iface); err == nil {
+			if mac, ok := macKey(ifi.HardwareAddr); ok {
+				macs[mac] = struct{}{}
+			}
+			addrs, err := ifi.Addrs()
+			if err != nil {
+				firstErr = err
+			}
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					if ip, ok := addrKey(ipNet.IP); ok {
+						ips[ip] = struct{}{}
+					}
+				}
+			}
+		} else {
+			firstErr = err
+		}
+
+		// pcap device names differ from the OS ones on some platforms, so
+		// merge in whatever libpcap reports as well
+		if devices, err := pcap.FindAllDevs(); err == nil {
+			for _, dev := range devices {
+				if dev.Name != l.iface {
+					continue
+				}
+				for _, addr := range dev.Addresses {
+					if ip, ok := addrKey(addr.IP); ok {
+						ips[ip] = struct{}{}
+					}
+				}
+			}
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	l.mu.Lock()
+	l.ips = ips
+	l.macs = macs
+	l.refreshed = time.Now()
+	l.mu.Unlock()
+
+	return firstErr
+}
+
+// RefreshIfStale refreshes the addresses if they haven't been read recently
+func (l *LocalAddrs) RefreshIfStale() {
+	l.mu.RLock()
+	stale := time.Since(l.refreshed) > localRefreshInterval
+	l.mu.RUnlock()
+
+	if stale && l.iface != "" {
+		l.Refresh()
+	}
+}
+
+// IsLocalIP reports whether ip is configured on the capturing interface
+func (l *LocalAddrs) IsLocalIP(ip net.IP) bool {
+	key, ok := addrKey(ip)
+	if !ok {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok = l.ips[key]
+	return ok
+}
+
+// IsLocalMAC reports whether mac belongs to the capturing interface
+func (l *LocalAddrs) IsLocalMAC(mac net.HardwareAddr) bool {
+	key, ok := macKey(mac)
+	if !ok {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok = l.macs[key]
+	return ok
+}
+
+// addrKey is ip as a map key; IPv4-mapped IPv6 addresses are taken as the
+// IPv4 ones, as net.IP.String prints them
+func addrKey(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+// macKey is an Ethernet address as a map key
+func macKey(mac net.HardwareAddr) ([6]byte, bool) {
+	var key [6]byte
+	if len(mac) != len(key) {
+		return key, false
+	}
+	copy(key[:], mac)
+	return key, true
+}
+
+// inHomeNetwork reports whether ip falls inside a user-declared home network
+func (l *LocalAddrs) inHomeNetwork(ip net.IP) bool {
+	for _, n := range l.homeNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIncoming works out the direction of a packet. Interface addresses win,
+// then link-layer addresses, then home networks. Without any of those (e.g.
+// replaying a file with no home networks) a private destination talking to a
+// public source is treated as incoming.
+func (l *LocalAddrs) IsIncoming(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP) bool {
+	switch {
+	case l.IsLocalIP(dstIP):
+		return true
+	case l.IsLocalIP(srcIP):
+		return false
+	case l.IsLocalMAC(dstMAC):
+		return true
+	case l.IsLocalMAC(srcMAC):
+		return false
+	}
+
+	srcHome, dstHome := l.inHomeNetwork(srcIP), l.inHomeNetwork(dstIP)
+	if srcHome != dstHome {
+		return dstHome
+	}
+
+	return isPrivateIP(dstIP) && !isPrivateIP(srcIP)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// ParseHomeNetworks parses a comma separated list of CIDRs
+func ParseHomeNetworks(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid home network %q: %w", part, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
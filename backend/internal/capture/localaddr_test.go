@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIsIncoming(t *testing.T) {
+	_, home, _ := net.ParseCIDR("10.20.0.0/16")
+	l := NewLocalAddrs("", []*net.IPNet{home})
+	l.ips[netip.MustParseAddr("192.168.1.10")] = struct{}{}
+	l.ips[netip.MustParseAddr("2001:db8::10")] = struct{}{}
+	l.macs[[6]byte{2, 0, 0, 0, 0, 1}] = struct{}{}
+
+	local := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	other := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+
+	tests := []struct {
+		name           string
+		srcMAC, dstMAC net.HardwareAddr
+		src, dst       string
+		incoming       bool
+	}{
+		{name: "to a local address", srcMAC: other, dstMAC: other, src: "203.0.113.5", dst: "192.168.1.10", incoming: true},
+		{name: "from a local address", srcMAC: other, dstMAC: other, src: "192.168.1.10", dst: "203.0.113.5"},
+		{name: "ipv4-mapped local address", srcMAC: other, dstMAC: other, src: "203.0.113.5", dst: "::ffff:192.168.1.10", incoming: true},
+		{name: "ipv6", srcMAC: other, dstMAC: other, src: "2001:db8::10", dst: "2001:db8::99"},
+		{name: "to the local mac", srcMAC: other, dstMAC: local, src: "203.0.113.5", dst: "198.51.100.7", incoming: true},
+		{name: "from the local mac", srcMAC: local, dstMAC: other, src: "198.51.100.7", dst: "203.0.113.5"},
+		{name: "no macs", src: "203.0.113.5", dst: "10.20.1.1", incoming: true},
+		{name: "into a home network", srcMAC: other, dstMAC: other, src: "203.0.113.5", dst: "10.20.1.1", incoming: true},
+		{name: "out of a home network", srcMAC: other, dstMAC: other, src: "10.20.1.1", dst: "172.16.0.1"},
+		{name: "private destination", srcMAC: other, dstMAC: other, src: "203.0.113.5", dst: "172.16.0.1", incoming: true},
+		{name: "public destination", srcMAC: other, dstMAC: other, src: "172.16.0.1", dst: "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		src, dst := net.ParseIP(tt.src), net.ParseIP(tt.dst)
+		if got := l.IsIncoming(tt.srcMAC, tt.dstMAC, src, dst); got != tt.incoming {
+			t.Errorf("%s: incoming = %v, want %v", tt.name, got, tt.incoming)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			l.IsIncoming(tt.srcMAC, tt.dstMAC, src, dst)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations", tt.name, allocs)
+		}
+	}
+}
+
+func TestAddrString(t *testing.T) {
+	d := newFrameDecoder()
+	for _, s := range []string{"192.168.1.10", "::ffff:192.168.1.10", "2001:db8::1", "fe80::1:2:3:4", "::"} {
+		ip := net.ParseIP(s)
+		if got := d.addrString(ip); got != ip.String() {
+			t.Errorf("addrString(%s) = %q, want %q", s, got, ip.String())
+		}
+		// Once cached, either form of the address is free
+		for _, form := range []net.IP{ip, ip.To4()} {
+			if form == nil {
+				continue
+			}
+			if allocs := testing.AllocsPerRun(100, func() { d.addrString(form) }); allocs != 0 {
+				t.Errorf("addrString(%s): %v allocations", form, allocs)
+			}
+		}
+	}
+	if got := d.addrString(net.IP{1, 2, 3}); got != "?010203" {
+		t.Errorf("malformed address printed as %q", got)
+	}
+}
@@ -0,0 +1,179 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// maxMACs bounds the per-address counters of a capture; the least recently
+// seen addresses are dropped beyond it
+const maxMACs = 65536
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// macKind classifies an Ethernet address
+func macKind(mac net.HardwareAddr) string {
+	switch {
+	case bytes.Equal(mac, broadcastMAC):
+		return models.MACBroadcast
+	case len(mac) > 0 && mac[0]&0x01 != 0:
+		return models.MACMulticast
+	}
+	return models.MACUnicast
+}
+
+// macCounters keeps interface-style counters per Ethernet address
+type macCounters struct {
+	iface      string
+	stats      map[string]*models.MACStats // by the raw address
+	etherTypes map[layers.EthernetType]string
+}
+
+func newMACCounters(iface string) *macCounters {
+	return &macCounters{
+		iface:      iface,
+		stats:      make(map[string]*models.MACStats),
+		etherTypes: make(map[layers.EthernetType]string),
+	}
+}
+
+// add accounts a frame carrying etherType to its source and destination
+// addresses
+func (c *macCounters) add(srcMAC, dstMAC net.HardwareAddr, etherType layers.EthernetType, length int, weight uint64, now time.Time) {
+	src := c.entry(srcMAC, now)
+	addTraffic(&src.InterfaceStats, length, weight, false)
+	switch macKind(dstMAC) {
+	case models.MACBroadcast:
+		src.BroadcastBytes += uint64(length) * weight
+		src.BroadcastPackets += weight
+	case models.MACMulticast:
+		src.MulticastBytes += uint64(length) * weight
+		src.MulticastPackets += weight
+	}
+	if src.EtherTypes == nil {
+		src.EtherTypes = make(map[string]uint64)
+	}
+	src.EtherTypes[c.etherTypeName(etherType)] += weight
+
+	dst := c.entry(dstMAC, now)
+	addTraffic(&dst.InterfaceStats, length, weight, true)
+}
+
+// entry returns the counters of mac, creating them if needed
+func (c *macCounters) entry(mac net.HardwareAddr, now time.Time) *models.MACStats {
+	stats, ok := c.stats[string(mac)]
+	if !ok {
+		if len(c.stats) >= maxMACs {
+			c.evict()
+		}
+		stats = &models.MACStats{
+			InterfaceStats: models.InterfaceStats{Interface: c.iface},
+			MAC:            mac.String(),
+			Kind:           macKind(mac),
+			FirstSeen:      now,
+		}
+		if stats.Kind == models.MACUnicast && len(mac) > 0 {
+			stats.Vendor = macVendor(mac)
+			stats.LocallyAdministered = mac[0]&0x02 != 0
+		}
+		c.stats[string(mac)] = stats
+	}
+	if now.After(stats.LastSeen) {
+		stats.LastSeen = now
+	}
+	return stats
+}
+
+// frameType is the EtherType of the payload, behind any VLAN tags
+func frameType(packet gopacket.Packet, eth *layers.Ethernet) layers.EthernetType {
+	etherType := eth.EthernetType
+	if etherType != layers.EthernetTypeDot1Q && etherType != layers.EthernetTypeQinQ {
+		return etherType
+	}
+	for _, layer := range packet.Layers() {
+		if tag, ok := layer.(*layers.Dot1Q); ok {
+			etherType = tag.Type
+		}
+	}
+	return etherType
+}
+
+// etherTypeName names an EtherType, in hex if gopacket doesn't know it
+func (c *macCounters) etherTypeName(etherType layers.EthernetType) string {
+	name, ok := c.etherTypes[etherType]
+	if !ok {
+		name = etherType.String()
+		if strings.HasPrefix(name, "Unknown") {
+			name = fmt.Sprintf("0x%04x", uint16(etherType))
+		}
+		c.etherTypes[etherType] = name
+	}
+	return name
+}
+
+// evict drops the least recently seen tenth of the addresses
+func (c *macCounters) evict() {
+	keys := make([]string, 0, len(c.stats))
+	for key := range c.stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.stats[keys[i]].LastSeen.Before(c.stats[keys[j]].LastSeen)
+	})
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(c.stats, key)
+	}
+}
+
+// mergeMACStats sums the counters the shards keep for the same address.
+// The samples are merged in place.
+func mergeMACStats(shards [][]*models.MACStats) []*models.MACStats {
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	merged := make(map[string]*models.MACStats)
+	result := make([]*models.MACStats, 0)
+	for _, stats := range shards {
+		for _, s := range stats {
+			m, ok := merged[s.MAC]
+			if !ok {
+				merged[s.MAC] = s
+				result = append(result, s)
+				continue
+			}
+			mergeTraffic(&m.InterfaceStats, &s.InterfaceStats)
+			m.BroadcastBytes += s.BroadcastBytes
+			m.BroadcastPackets += s.BroadcastPackets
+			m.MulticastBytes += s.MulticastBytes
+			m.MulticastPackets += s.MulticastPackets
+			if len(s.EtherTypes) > 0 && m.EtherTypes == nil {
+				m.EtherTypes = make(map[string]uint64)
+			}
+			for name, count := range s.EtherTypes {
+				m.EtherTypes[name] += count
+			}
+			if s.FirstSeen.Before(m.FirstSeen) {
+				m.FirstSeen = s.FirstSeen
+			}
+			if s.LastSeen.After(m.LastSeen) {
+				m.LastSeen = s.LastSeen
+			}
+		}
+	}
+	return result
+}
+
+// resetRates clears the per-second counters after a flush
+func (c *macCounters) resetRates() {
+	for _, stats := range c.stats {
+		resetRates(&stats.InterfaceStats)
+	}
+}
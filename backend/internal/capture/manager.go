@@ -3,121 +3,322 @@ package capture
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
-	
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
 	"github.com/raojinlin/traffic-sniff/internal/storage"
 )
 
-// Manager handles dynamic interface switching
+// stopTimeout bounds how long we wait for a capture goroutine to exit
+const stopTimeout = time.Second
+
+// session is a single capture running in the background
+type session struct {
+	capture *PacketCapture
+	cancel  context.CancelFunc
+	done    chan struct{}
+	added   time.Time
+}
+
+// running reports whether the capture goroutine is still alive
+func (s *session) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Manager runs captures on any number of interfaces concurrently and
+// handles adding, removing and switching them
 type Manager struct {
-	mu              sync.RWMutex
-	currentCapture  *PacketCapture
-	currentIface    string
-	storage         Storage
-	ctx             context.Context
-	cancel          context.CancelFunc
-	captureRunning  bool
+	mu       sync.RWMutex
+	sessions map[string]*session
+	storage  Storage
+	opts     Options
+
+	// hostnames is shared so that a lookup seen on one interface names the
+	// connections on the others
+	hostnames *hostnameCache
+
+	hooksMu sync.RWMutex
+	hooks   []FlowExpiredFunc
 }
 
 // NewManager creates a new capture manager
-func NewManager(storage Storage) *Manager {
+func NewManager(storage Storage, opts Options) *Manager {
 	return &Manager{
-		storage: storage,
+		sessions:  make(map[string]*session),
+		storage:   storage,
+		opts:      opts,
+		hostnames: newHostnameCache(),
 	}
 }
 
-// Start begins capturing on the specified interface
+// Start replaces all running captures with one on the specified interface
 func (m *Manager) Start(iface string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Stop current capture if running
-	if m.captureRunning {
-		if err := m.stopCapture(); err != nil {
-			return fmt.Errorf("failed to stop current capture: %w", err)
-		}
+	m.stopAll()
+
+	return m.addInterface(iface)
+}
+
+// StartReplay replaces all running captures with a replay of a pcap/pcapng file
+func (m *Manager) StartReplay(path string, replay ReplayOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopAll()
+
+	fmt.Printf("[Capture] Opening capture file '%s' (speed %v)\n", path, replay.Speed)
+	capturer, err := NewPacketCaptureFromFile(path, replay, m.opts)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
 	}
 
-	// Clear old connection data when switching interfaces
-	if ms, ok := m.storage.(*storage.MemoryStorage); ok {
-		fmt.Printf("[Capture] Clearing connection data for interface switch\n")
-		ms.ClearConnections()
+	m.run(capturer, path)
+	return nil
+}
+
+// AddInterface starts capturing on iface alongside the existing captures
+func (m *Manager) AddInterface(iface string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addInterface(iface)
+}
+
+// addInterface must be called with lock held
+func (m *Manager) addInterface(iface string) error {
+	if s, ok := m.sessions[iface]; ok && s.running() {
+		return fmt.Errorf("interface '%s' is already being captured", iface)
 	}
 
 	// Create new capture
 	fmt.Printf("[Capture] Creating packet capture for interface '%s'\n", iface)
-	capturer, err := NewPacketCapture(iface)
+	capturer, err := NewPacketCapture(iface, m.opts)
 	if err != nil {
 		return fmt.Errorf("failed to create packet capture: %w", err)
 	}
 
+	// An empty name resolves to the first active device
+	if s, ok := m.sessions[capturer.iface]; ok && s.running() {
+		capturer.Close()
+		return fmt.Errorf("interface '%s' is already being captured", capturer.iface)
+	}
+
+	m.run(capturer, capturer.iface)
+	return nil
+}
+
+// RemoveInterface stops capturing on iface and drops its data
+func (m *Manager) RemoveInterface(iface string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[iface]
+	if !ok {
+		return fmt.Errorf("interface '%s' is not being captured", iface)
+	}
+
+	m.stopSession(iface, s)
+	return nil
+}
+
+// run starts capturer in the background (must be called with lock held)
+func (m *Manager) run(capturer *PacketCapture, iface string) {
 	// Create new context for this capture session
 	ctx, cancel := context.WithCancel(context.Background())
 
-	m.currentCapture = capturer
-	m.currentIface = iface
-	m.ctx = ctx
-	m.cancel = cancel
-	m.captureRunning = true
+	capturer.onExpire = m.flowExpired
+	capturer.hostnames = m.hostnames
+
+	s := &session{
+		capture: capturer,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		added:   time.Now(),
+	}
+	m.sessions[iface] = s
 
 	// Start capture in background
 	go func() {
+		defer close(s.done)
+
 		fmt.Printf("[Capture] Starting packet capture on interface '%s'\n", iface)
 		if err := capturer.Start(ctx, m.storage); err != nil {
 			// Log error but don't crash
 			fmt.Printf("[Capture] Capture error on interface '%s': %v\n", iface, err)
 		}
-		
-		m.mu.Lock()
-		m.captureRunning = false
 		fmt.Printf("[Capture] Packet capture stopped on interface '%s'\n", iface)
-		m.mu.Unlock()
 	}()
+}
+
+// OnFlowExpired subscribes fn to the flows expiring on any interface, e.g.
+// to export them. fn runs on the worker goroutines of every capture, possibly
+// several at once, so it must be safe for concurrent use and must not block.
+func (m *Manager) OnFlowExpired(fn FlowExpiredFunc) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+	m.hooks = append(m.hooks, fn)
+}
+
+// flowExpired fans an expired flow out to the subscribers
+func (m *Manager) flowExpired(flow *models.Flow) {
+	m.hooksMu.RLock()
+	defer m.hooksMu.RUnlock()
+	for _, fn := range m.hooks {
+		fn(flow)
+	}
+}
+
+// SwitchInterface replaces all running captures with one on newIface. A
+// non-nil filter is validated against and applied to the new capture, and
+// only remembered once it is running. The running captures are left alone
+// if the new one can't be opened.
+func (m *Manager) SwitchInterface(newIface string, filter *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	opts := m.opts
+	if filter != nil {
+		opts.BPFFilter = *filter
+	}
+
+	fmt.Printf("[Capture] Creating packet capture for interface '%s'\n", newIface)
+	capturer, err := NewPacketCapture(newIface, opts)
+	if err != nil {
+		return fmt.Errorf("failed to create packet capture: %w", err)
+	}
 
+	m.stopAll()
+	if filter != nil {
+		fmt.Printf("[Capture] BPF filter set to '%s'\n", *filter)
+	}
+	m.opts = opts
+	m.run(capturer, capturer.iface)
 	return nil
 }
 
-// SwitchInterface switches to a new interface
-func (m *Manager) SwitchInterface(newIface string) error {
-	return m.Start(newIface)
+// SetFilter validates and applies a BPF filter to every running capture.
+// The filter is remembered and used for captures started afterwards.
+func (m *Manager) SetFilter(expr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Validate everywhere first so a bad filter isn't applied half way
+	validated := false
+	for _, s := range m.sessions {
+		if !s.running() {
+			continue
+		}
+		if err := ValidateFilter(s.capture.linkType(), expr); err != nil {
+			return err
+		}
+		validated = true
+	}
+	if !validated {
+		if err := ValidateFilter(layers.LinkTypeEthernet, expr); err != nil {
+			return err
+		}
+	}
+
+	for iface, s := range m.sessions {
+		if !s.running() {
+			continue
+		}
+		if err := s.capture.SetFilter(expr); err != nil {
+			return fmt.Errorf("failed to apply filter on interface '%s': %w", iface, err)
+		}
+	}
+
+	fmt.Printf("[Capture] BPF filter set to '%s'\n", expr)
+	m.opts.BPFFilter = expr
+	return nil
+}
+
+// GetFilter returns the active BPF filter
+func (m *Manager) GetFilter() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.opts.BPFFilter
 }
 
-// GetCurrentInterface returns the currently monitored interface
+// GetCurrentInterface returns the first interface that was added, kept for
+// clients that only deal with a single interface
 func (m *Manager) GetCurrentInterface() string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.currentIface
+
+	current := ""
+	var added time.Time
+	for iface, s := range m.sessions {
+		if current == "" || s.added.Before(added) {
+			current, added = iface, s.added
+		}
+	}
+	return current
+}
+
+// GetInterfaces returns the names of all monitored interfaces
+func (m *Manager) GetInterfaces() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ifaces := make([]string, 0, len(m.sessions))
+	for iface := range m.sessions {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	return ifaces
 }
 
 // Stop stops all capture
 func (m *Manager) Stop() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	
-	return m.stopCapture()
+
+	m.stopAll()
+	return nil
 }
 
-// stopCapture stops the current capture (must be called with lock held)
-func (m *Manager) stopCapture() error {
-	if !m.captureRunning {
-		return nil
+// stopAll stops every capture and clears all data (must be called with lock held)
+func (m *Manager) stopAll() {
+	for iface, s := range m.sessions {
+		m.stopSession(iface, s)
 	}
 
-	// Cancel context to stop capture goroutine
-	if m.cancel != nil {
-		m.cancel()
+	// Clear old connection data when switching interfaces
+	if ms, ok := m.storage.(*storage.MemoryStorage); ok {
+		fmt.Printf("[Capture] Clearing connection data for interface switch\n")
+		ms.ClearConnections()
 	}
+}
+
+// stopSession stops one capture and drops its data (must be called with lock held)
+func (m *Manager) stopSession(iface string, s *session) {
+	// Cancel context to stop capture goroutine
+	s.cancel()
 
 	// Close the capture handle
-	if m.currentCapture != nil {
-		m.currentCapture.Close()
-		m.currentCapture = nil
-	}
+	s.capture.Close()
 
 	// Give the goroutine time to exit cleanly
-	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-s.done:
+	case <-time.After(stopTimeout):
+		fmt.Printf("[Capture] Timed out waiting for capture on interface '%s' to stop\n", iface)
+	}
 
-	m.captureRunning = false
-	return nil
-}
\ No newline at end of file
+	delete(m.sessions, iface)
+
+	if ms, ok := m.storage.(*storage.MemoryStorage); ok {
+		ms.ClearInterface(iface)
+	}
+}
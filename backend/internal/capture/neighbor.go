@@ -0,0 +1,330 @@
+package capture
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// neighborTimeout drops bindings that haven't been refreshed for this long
+	neighborTimeout = 4 * time.Hour
+	// maxNeighbors bounds the neighbor table per capture
+	maxNeighbors = 65536
+	// conflictWindow is how recently the previous MAC must have used an
+	// address for a new claim to be a duplicate rather than a move
+	conflictWindow = 30 * time.Second
+	// flapWindow is how soon an address must return to its previous MAC to
+	// count as flapping
+	flapWindow = 5 * time.Minute
+	// eventHoldoff limits the anomalies reported per binding and type
+	eventHoldoff = time.Minute
+)
+
+//go:embed oui.txt
+var ouiTable string
+
+var (
+	ouiOnce    sync.Once
+	ouiVendors map[[3]byte]string
+)
+
+// macVendor returns the vendor owning the OUI of mac, if known
+func macVendor(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	ouiOnce.Do(loadOUI)
+	return ouiVendors[[3]byte(mac[:3])]
+}
+
+func loadOUI() {
+	ouiVendors = make(map[[3]byte]string)
+	for _, line := range strings.Split(ouiTable, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		prefix, vendor, _ := strings.Cut(line, " ")
+		oui, err := hex.DecodeString(prefix)
+		if err != nil || len(oui) != 3 {
+			continue
+		}
+		ouiVendors[[3]byte(oui)] = strings.TrimSpace(vendor)
+	}
+}
+
+// neighborKey identifies a binding; VLANs are separate links
+type neighborKey struct {
+	vlan uint16
+	ip   string
+}
+
+type neighborEntry struct {
+	neighbor  models.Neighbor
+	changedAt time.Time            // when the MAC last changed
+	reported  map[string]time.Time // anomaly type → last report
+}
+
+// setMAC binds the entry to mac
+func (e *neighborEntry) setMAC(mac net.HardwareAddr) {
+	e.neighbor.MAC = mac.String()
+	e.neighbor.Vendor = macVendor(mac)
+	e.neighbor.LocallyAdministered = mac[0]&0x02 != 0
+}
+
+// sighting is a binding announced by one ARP or NDP message
+type sighting struct {
+	vlan       uint16
+	ip         net.IP
+	mac        net.HardwareAddr
+	protocol   string
+	router     bool
+	gratuitous bool
+	timestamp  time.Time
+}
+
+// neighborTable learns the IP to MAC bindings of the link from ARP and NDP
+// and flags anomalies in them. It is shared by the shards of a capture;
+// neighbor discovery is rare enough for a lock.
+type neighborTable struct {
+	mu      sync.Mutex
+	iface   string
+	entries map[neighborKey]*neighborEntry
+	events  []*models.NeighborEvent // reported since the last flush
+	dirty   bool                    // entries changed since the last snapshot
+}
+
+func newNeighborTable(iface string) *neighborTable {
+	return &neighborTable{
+		iface:   iface,
+		entries: make(map[neighborKey]*neighborEntry),
+	}
+}
+
+// observeARP learns the sender of an ARP packet. It reports whether packet
+// was ARP at all.
+func (t *neighborTable) observeARP(packet gopacket.Packet) bool {
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		return false
+	}
+	if arp.Protocol != layers.EthernetTypeIPv4 || len(arp.SourceHwAddress) != 6 || len(arp.SourceProtAddress) != 4 {
+		return true
+	}
+	sender := net.IP(arp.SourceProtAddress)
+	// Probes come from hosts that don't have an address yet
+	if sender.IsUnspecified() {
+		return true
+	}
+	t.learn(sighting{
+		vlan:       decodeEncapsulation(packet).vlan.outer,
+		ip:         sender,
+		mac:        net.HardwareAddr(arp.SourceHwAddress),
+		protocol:   "ARP",
+		gratuitous: bytes.Equal(arp.SourceProtAddress, arp.DstProtAddress),
+		timestamp:  packetTime(packet),
+	})
+	return true
+}
+
+// observeNDP learns the bindings announced by IPv6 neighbor discovery
+func (t *neighborTable) observeNDP(packet gopacket.Packet, ip *layers.IPv6) {
+	if ip.NextHeader != layers.IPProtocolICMPv6 {
+		return
+	}
+	s := sighting{ip: ip.SrcIP, protocol: "NDP"}
+	switch msg := ndpMessage(packet).(type) {
+	case *layers.ICMPv6NeighborAdvertisement:
+		s.ip = msg.TargetAddress
+		s.mac = linkLayerOption(msg.Options, layers.ICMPv6OptTargetAddress)
+		s.router = msg.Router()
+		s.gratuitous = !msg.Solicited()
+	case *layers.ICMPv6NeighborSolicitation:
+		s.mac = linkLayerOption(msg.Options, layers.ICMPv6OptSourceAddress)
+	case *layers.ICMPv6RouterSolicitation:
+		s.mac = linkLayerOption(msg.Options, layers.ICMPv6OptSourceAddress)
+	case *layers.ICMPv6RouterAdvertisement:
+		s.mac = linkLayerOption(msg.Options, layers.ICMPv6OptSourceAddress)
+		s.router = true
+	default:
+		return
+	}
+	// Duplicate address detection is done before the address is assigned
+	if s.ip == nil || s.ip.IsUnspecified() {
+		return
+	}
+	// Without the option the frame's source is the MAC of the address, as
+	// long as the address is the packet's source
+	if s.mac == nil && s.ip.Equal(ip.SrcIP) {
+		if eth, ok := packet.LinkLayer().(*layers.Ethernet); ok {
+			s.mac = eth.SrcMAC
+		}
+	}
+	if len(s.mac) != 6 {
+		return
+	}
+	s.vlan = decodeEncapsulation(packet).vlan.outer
+	s.timestamp = packetTime(packet)
+	t.learn(s)
+}
+
+// ndpMessage returns the neighbor discovery layer of packet, if any
+func ndpMessage(packet gopacket.Packet) gopacket.Layer {
+	for _, layer := range packet.Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeICMPv6NeighborAdvertisement, layers.LayerTypeICMPv6NeighborSolicitation,
+			layers.LayerTypeICMPv6RouterSolicitation, layers.LayerTypeICMPv6RouterAdvertisement:
+			return layer
+		}
+	}
+	return nil
+}
+
+// linkLayerOption returns the link-layer address carried in option typ
+func linkLayerOption(options layers.ICMPv6Options, typ layers.ICMPv6Opt) net.HardwareAddr {
+	for _, opt := range options {
+		if opt.Type == typ && len(opt.Data) >= 6 {
+			return net.HardwareAddr(opt.Data[:6])
+		}
+	}
+	return nil
+}
+
+// learn records a sighting, checking it against the known binding
+func (t *neighborTable) learn(s sighting) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := neighborKey{s.vlan, s.ip.String()}
+	mac := s.mac.String()
+	entry, ok := t.entries[key]
+	if !ok {
+		if len(t.entries) >= maxNeighbors {
+			t.evict()
+		}
+		entry = &neighborEntry{neighbor: models.Neighbor{
+			Interface: t.iface,
+			VLAN:      s.vlan,
+			IP:        key.ip,
+			Protocol:  s.protocol,
+			FirstSeen: s.timestamp,
+		}}
+		entry.setMAC(s.mac)
+		t.entries[key] = entry
+	} else if n := &entry.neighbor; n.MAC != mac {
+		if s.timestamp.Sub(n.LastSeen) < conflictWindow {
+			t.report(entry, models.NeighborDuplicateIP, s, n.MAC)
+		}
+		if mac == n.PreviousMAC && s.timestamp.Sub(entry.changedAt) < flapWindow {
+			t.report(entry, models.NeighborMACFlap, s, n.MAC)
+		}
+		n.PreviousMAC = n.MAC
+		n.MACChanges++
+		entry.setMAC(s.mac)
+		entry.changedAt = s.timestamp
+	}
+
+	n := &entry.neighbor
+	if s.timestamp.After(n.LastSeen) {
+		n.LastSeen = s.timestamp
+	}
+	n.Packets++
+	n.Router = n.Router || s.router
+	if s.gratuitous {
+		t.report(entry, models.NeighborGratuitousARP, s, "")
+	}
+	t.dirty = true
+}
+
+// report records an anomaly of entry, unless one of the same type was
+// reported within eventHoldoff
+func (t *neighborTable) report(entry *neighborEntry, typ string, s sighting, previousMAC string) {
+	if last, ok := entry.reported[typ]; ok && s.timestamp.Sub(last) < eventHoldoff {
+		return
+	}
+	if entry.reported == nil {
+		entry.reported = make(map[string]time.Time)
+	}
+	entry.reported[typ] = s.timestamp
+
+	event := &models.NeighborEvent{
+		Timestamp:   s.timestamp,
+		Interface:   t.iface,
+		VLAN:        s.vlan,
+		Type:        typ,
+		Protocol:    s.protocol,
+		IP:          entry.neighbor.IP,
+		MAC:         s.mac.String(),
+		PreviousMAC: previousMAC,
+	}
+	t.events = append(t.events, event)
+	if typ != models.NeighborGratuitousARP {
+		fmt.Printf("[Capture] %s on '%s': %s claimed by %s, was %s\n", typ, t.iface, event.IP, event.MAC, previousMAC)
+	}
+}
+
+// expire drops the bindings not refreshed since neighborTimeout before now
+func (t *neighborTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, entry := range t.entries {
+		if now.Sub(entry.neighbor.LastSeen) > neighborTimeout {
+			delete(t.entries, key)
+			t.dirty = true
+		}
+	}
+}
+
+// evict drops the least recently seen tenth of the bindings
+func (t *neighborTable) evict() {
+	keys := make([]neighborKey, 0, len(t.entries))
+	for key := range t.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return t.entries[keys[i]].neighbor.LastSeen.Before(t.entries[keys[j]].neighbor.LastSeen)
+	})
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(t.entries, key)
+	}
+	t.dirty = true
+}
+
+// snapshot returns copies of the bindings if they changed since the last call
+func (t *neighborTable) snapshot() ([]*models.Neighbor, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.dirty {
+		return nil, false
+	}
+	t.dirty = false
+	neighbors := make([]*models.Neighbor, 0, len(t.entries))
+	for _, entry := range t.entries {
+		n := entry.neighbor
+		neighbors = append(neighbors, &n)
+	}
+	return neighbors, true
+}
+
+// take returns the anomalies reported since the last call
+func (t *neighborTable) take() []*models.NeighborEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := t.events
+	t.events = nil
+	return events
+}
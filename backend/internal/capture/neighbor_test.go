@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNeighborEvents(t *testing.T) {
+	macs := map[string]net.HardwareAddr{
+		"a": {2, 0, 0, 0, 0, 0xa},
+		"b": {2, 0, 0, 0, 0, 0xb},
+	}
+	names := map[string]string{"": "-"}
+	for name, mac := range macs {
+		names[mac.String()] = name
+	}
+	// claim is the address announced by the MAC named mac at some time
+	type claim struct {
+		at         time.Duration
+		mac        string
+		gratuitous bool
+	}
+	s := time.Second
+
+	tests := []struct {
+		name   string
+		claims []claim
+		events []string // offset, type, MAC and previous MAC of each
+	}{
+		{
+			name:   "refreshed",
+			claims: []claim{{0, "a", false}, {10 * s, "a", false}},
+		},
+		{
+			name:   "duplicate IP",
+			claims: []claim{{0, "a", false}, {10 * s, "b", false}},
+			events: []string{"10s duplicate_ip b a"},
+		},
+		{
+			name:   "moved after the conflict window",
+			claims: []claim{{0, "a", false}, {60 * s, "b", false}},
+		},
+		{
+			name:   "MAC flap",
+			claims: []claim{{0, "a", false}, {60 * s, "b", false}, {120 * s, "a", false}},
+			events: []string{"2m0s mac_flap a b"},
+		},
+		{
+			name:   "moved back after the flap window",
+			claims: []claim{{0, "a", false}, {60 * s, "b", false}, {60*s + flapWindow, "a", false}},
+		},
+		{
+			name: "held off",
+			claims: []claim{
+				{0, "a", false}, {1 * s, "b", false}, {2 * s, "a", false},
+				// Both anomalies again, within eventHoldoff of the last ones
+				{3 * s, "b", false},
+				// Flapping once more, a minute after the last report
+				{70 * s, "a", false},
+			},
+			events: []string{"1s duplicate_ip b a", "2s mac_flap a b", "1m10s mac_flap a b"},
+		},
+		{
+			name:   "gratuitous ARP",
+			claims: []claim{{0, "a", true}, {30 * s, "a", true}, {61 * s, "a", true}},
+			events: []string{"0s gratuitous_arp a -", "1m1s gratuitous_arp a -"},
+		},
+	}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		table := newNeighborTable("test0")
+		for _, c := range tt.claims {
+			table.learn(sighting{
+				ip:         net.IPv4(192, 168, 1, 20),
+				mac:        macs[c.mac],
+				protocol:   "ARP",
+				gratuitous: c.gratuitous,
+				timestamp:  start.Add(c.at),
+			})
+		}
+		var events []string
+		for _, e := range table.take() {
+			events = append(events, fmt.Sprintf("%v %s %s %s", e.Timestamp.Sub(start), e.Type, names[e.MAC], names[e.PreviousMAC]))
+		}
+		if !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("%s: events %q, want %q", tt.name, events, tt.events)
+		}
+
+		neighbors, _ := table.snapshot()
+		last := tt.claims[len(tt.claims)-1]
+		if len(neighbors) != 1 || neighbors[0].MAC != macs[last.mac].String() || neighbors[0].Packets != uint64(len(tt.claims)) {
+			t.Errorf("%s: neighbors %+v", tt.name, neighbors)
+		}
+	}
+}
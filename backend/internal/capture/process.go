@@ -0,0 +1,221 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// DefaultProcRoot is where procfs is normally mounted
+const DefaultProcRoot = "/proc"
+
+// processAttempts is how many scans a flow gets to find its process. A
+// socket shows up in the first scan after it was opened, unless it was
+// closed by then; flows of other hosts never match.
+const processAttempts = 2
+
+// socketKey identifies a socket by protocol and endpoints. Listening and
+// unconnected sockets have an empty remote side.
+type socketKey struct {
+	protocol   string
+	localIP    string
+	localPort  uint16
+	remoteIP   string
+	remotePort uint16
+}
+
+// processTable is one scan of the sockets and the processes owning them
+type processTable struct {
+	sockets   map[socketKey]uint64           // socket → inode
+	processes map[uint64]*models.ProcessInfo // inode → owner
+	workloads map[int]*models.WorkloadInfo   // PID → container, if any
+	scan      uint64                         // number of the scan, from 1
+}
+
+// ProcessOptions configures process and workload attribution
+type ProcessOptions struct {
+	// Root is where procfs is mounted; it can point at a fake tree for
+	// testing or at the host's /proc mounted into a container
+	Root string
+	// DockerSocket, if set, is asked for container names and labels
+	DockerSocket string
+	// PodsFile, if set, is a pod list in the format of the kubelet's /pods
+	// endpoint, used to name the pods of containerd and CRI-O containers
+	PodsFile string
+}
+
+// ProcessResolver maps local sockets to the processes that own them and the
+// containers those run in. The tables are rescanned periodically by Run;
+// lookups in between are served from the last scan.
+type ProcessResolver struct {
+	opts ProcessOptions
+
+	mu    sync.RWMutex
+	table *processTable
+	scans uint64
+
+	namesErr string // last workload naming error, logged once
+}
+
+// NewProcessResolver creates a resolver
+func NewProcessResolver(opts ProcessOptions) *ProcessResolver {
+	if opts.Root == "" {
+		opts.Root = DefaultProcRoot
+	}
+	return &ProcessResolver{opts: opts}
+}
+
+// Refresh rescans the socket and process tables
+func (r *ProcessResolver) Refresh() error {
+	table, err := scanProcesses(r.opts.Root)
+	if err != nil {
+		return err
+	}
+	r.labelWorkloads(table)
+
+	r.mu.Lock()
+	r.scans++
+	table.scan = r.scans
+	r.table = table
+	r.mu.Unlock()
+	return nil
+}
+
+// scan returns the number of the last scan, 0 before the first
+func (r *ProcessResolver) scan() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.table == nil {
+		return 0
+	}
+	return r.table.scan
+}
+
+// labelWorkloads works out the container of every socket owner from its
+// cgroup and names it from the configured sources
+func (r *ProcessResolver) labelWorkloads(table *processTable) {
+	table.workloads = make(map[int]*models.WorkloadInfo)
+	for _, proc := range table.processes {
+		if _, done := table.workloads[proc.PID]; done {
+			continue
+		}
+		table.workloads[proc.PID] = parseCgroupWorkload(proc.Cgroup)
+	}
+
+	if r.opts.DockerSocket == "" && r.opts.PodsFile == "" {
+		return
+	}
+	names, err := loadWorkloadNames(r.opts.DockerSocket, r.opts.PodsFile)
+	if err != nil && err.Error() != r.namesErr {
+		fmt.Printf("[Capture] Failed to load container names: %v\n", err)
+	}
+	r.namesErr = ""
+	if err != nil {
+		r.namesErr = err.Error()
+	}
+	for _, workload := range table.workloads {
+		if workload != nil {
+			names.label(workload)
+		}
+	}
+}
+
+// Run refreshes the tables every interval until ctx is done
+func (r *ProcessResolver) Run(ctx context.Context, interval time.Duration) {
+	if err := r.Refresh(); err != nil {
+		fmt.Printf("[Capture] Process attribution disabled: %v\n", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Refresh(); err != nil {
+				fmt.Printf("[Capture] Failed to refresh process table: %v\n", err)
+			}
+		}
+	}
+}
+
+// Lookup returns the process owning the socket with the given local and
+// remote endpoints, and its container if it runs in one. When listener is
+// set, a listening or unconnected socket bound to the local port also
+// matches, which covers servers and UDP.
+func (r *ProcessResolver) Lookup(protocol, localIP string, localPort uint16, remoteIP string, remotePort uint16, listener bool) (*models.ProcessInfo, *models.WorkloadInfo) {
+	r.mu.RLock()
+	table := r.table
+	r.mu.RUnlock()
+	if table == nil {
+		return nil, nil
+	}
+
+	keys := []socketKey{{protocol, localIP, localPort, remoteIP, remotePort}}
+	if listener {
+		keys = append(keys,
+			socketKey{protocol: protocol, localIP: localIP, localPort: localPort},
+			socketKey{protocol: protocol, localIP: "0.0.0.0", localPort: localPort},
+			socketKey{protocol: protocol, localIP: "::", localPort: localPort},
+		)
+	}
+	for _, key := range keys {
+		if inode, ok := table.sockets[key]; ok {
+			if proc, ok := table.processes[inode]; ok {
+				return proc, table.workloads[proc.PID]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// attributeProcesses labels local flows with their process and container.
+// Sockets opened since the last scan aren't known yet, so unattributed flows
+// are retried against the next processAttempts scans.
+func (s *shard) attributeProcesses() {
+	resolver := s.pc.opts.Processes
+	if resolver == nil || s.pc.replay != nil {
+		return
+	}
+	scan := resolver.scan()
+	if scan == 0 {
+		return
+	}
+
+	for _, entry := range s.flows.flows {
+		flow := entry.flow
+		if flow.Process != nil || (flow.Protocol != "TCP" && flow.Protocol != "UDP") {
+			continue
+		}
+		if entry.processScan == scan || entry.processAttempts >= processAttempts {
+			continue
+		}
+		entry.processScan = scan
+		entry.processAttempts++
+
+		srcLocal := s.pc.local.IsLocalIP(net.ParseIP(flow.SrcIP))
+		dstLocal := s.pc.local.IsLocalIP(net.ParseIP(flow.DstIP))
+
+		// An exact match is conclusive; fall back to listeners only for an
+		// endpoint that is ours, or a remote server's port would match a
+		// local listener on the same port
+		proc, workload := resolver.Lookup(flow.Protocol, flow.SrcIP, flow.SrcPort, flow.DstIP, flow.DstPort, srcLocal)
+		if proc == nil {
+			proc, workload = resolver.Lookup(flow.Protocol, flow.DstIP, flow.DstPort, flow.SrcIP, flow.SrcPort, dstLocal)
+		}
+		if proc != nil {
+			procCopy := *proc
+			flow.Process = &procCopy
+		}
+		if workload != nil {
+			workloadCopy := *workload
+			flow.Workload = &workloadCopy
+		}
+	}
+}
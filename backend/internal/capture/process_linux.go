@@ -0,0 +1,240 @@
+//go:build linux
+
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// socketTables are the procfs socket tables and the protocol they list
+var socketTables = []struct {
+	file     string
+	protocol string
+}{
+	{"tcp", "TCP"},
+	{"tcp6", "TCP"},
+	{"udp", "UDP"},
+	{"udp6", "UDP"},
+}
+
+// scanProcesses reads the socket tables in root/net and finds the owner of
+// each socket by looking for "socket:[inode]" links in root/<pid>/fd.
+// Containers have network namespaces of their own, so the tables of every
+// other namespace are read through one of its processes as well.
+func scanProcesses(root string) (*processTable, error) {
+	table := &processTable{
+		sockets:   make(map[socketKey]uint64),
+		processes: make(map[uint64]*models.ProcessInfo),
+	}
+
+	found := false
+	for _, t := range socketTables {
+		err := readSocketTable(filepath.Join(root, "net", t.file), t.protocol, false, table.sockets)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no socket tables under %s/net", root)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make(map[string]bool)
+	if ns, err := os.Readlink(filepath.Join(root, "self", "ns", "net")); err == nil {
+		namespaces[ns] = true
+	}
+	users := make(map[string]string)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Processes come and go during the scan, so errors are expected
+		scanProcessSockets(root, pid, table.processes, users)
+
+		ns, err := os.Readlink(filepath.Join(root, entry.Name(), "ns", "net"))
+		if err != nil || namespaces[ns] {
+			continue
+		}
+		namespaces[ns] = true
+		// Only connected sockets: a listener on 0.0.0.0:80 inside a
+		// container says nothing about port 80 on the host addresses
+		for _, t := range socketTables {
+			readSocketTable(filepath.Join(root, entry.Name(), "net", t.file), t.protocol, true, table.sockets)
+		}
+	}
+	return table, nil
+}
+
+// scanProcessSockets records pid as the owner of the sockets it has open.
+// A socket shared after fork goes to the lowest PID, usually the parent.
+func scanProcessSockets(root string, pid int, processes map[uint64]*models.ProcessInfo, users map[string]string) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return
+	}
+
+	var proc *models.ProcessInfo
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if owner, ok := processes[inode]; ok && owner.PID < pid {
+			continue
+		}
+		if proc == nil {
+			proc = readProcess(dir, pid, users)
+		}
+		processes[inode] = proc
+	}
+}
+
+// readProcess reads the name, owner and cgroup of a process
+func readProcess(dir string, pid int, users map[string]string) *models.ProcessInfo {
+	proc := &models.ProcessInfo{PID: pid}
+
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		proc.Name = strings.TrimSpace(string(comm))
+	}
+
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			// Uid: real effective saved filesystem
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+				if uid, err := strconv.ParseUint(fields[1], 10, 32); err == nil {
+					proc.UID = uint32(uid)
+					proc.User = lookupUser(fields[1], users)
+				}
+				break
+			}
+		}
+	}
+
+	if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		proc.Cgroup = parseCgroup(string(cgroup))
+	}
+
+	return proc
+}
+
+// parseCgroup picks the cgroup v2 path, or the first v1 hierarchy's
+func parseCgroup(content string) string {
+	first := ""
+	for _, line := range strings.Split(content, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	return first
+}
+
+func lookupUser(uid string, users map[string]string) string {
+	if name, ok := users[uid]; ok {
+		return name
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	users[uid] = name
+	return name
+}
+
+// readSocketTable parses a /proc/net/{tcp,udp}[6] file:
+//
+//	sl  local_address rem_address   st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+//	0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000 108 0 27421
+func readSocketTable(path, protocol string, connectedOnly bool, sockets map[socketKey]uint64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			// TIME_WAIT sockets belong to no one
+			continue
+		}
+		localIP, localPort, err := parseSocketAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseSocketAddr(fields[2])
+		if err != nil {
+			continue
+		}
+
+		key := socketKey{protocol: protocol, localIP: localIP, localPort: localPort}
+		if remotePort != 0 {
+			key.remoteIP, key.remotePort = remoteIP, remotePort
+		} else if connectedOnly {
+			continue
+		}
+		if _, seen := sockets[key]; !seen {
+			sockets[key] = inode
+		}
+	}
+	return scanner.Err()
+}
+
+// parseSocketAddr decodes "0100007F:0CEA". The address is a sequence of
+// 32-bit words in host (little-endian) order, the port is big-endian.
+func parseSocketAddr(s string) (string, uint16, error) {
+	addr, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed socket address %q", s)
+	}
+	raw, err := hex.DecodeString(addr)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", 0, fmt.Errorf("malformed socket address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed socket port %q", s)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	// IPv4-mapped addresses of dual-stack sockets print as plain IPv4,
+	// matching what the decoder reports for the packets
+	return ip.String(), uint16(port), nil
+}
@@ -0,0 +1,334 @@
+//go:build linux
+
+package capture
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// socketTableHeader is the first line of the /proc/net socket tables
+const socketTableHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// fakeProc is a procfs tree in a temporary directory
+type fakeProc struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeProc(t *testing.T) *fakeProc {
+	t.Helper()
+	p := &fakeProc{t: t, root: t.TempDir()}
+	p.symlink("net:[4026531840]", "self", "ns", "net")
+	return p
+}
+
+func (p *fakeProc) write(content string, path ...string) {
+	p.t.Helper()
+	file := filepath.Join(append([]string{p.root}, path...)...)
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *fakeProc) symlink(target string, path ...string) {
+	p.t.Helper()
+	link := filepath.Join(append([]string{p.root}, path...)...)
+	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		p.t.Fatal(err)
+	}
+	os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// socketTable writes net/<file> under dir ("" for the root) from rows of
+// local address, remote address and inode
+func (p *fakeProc) socketTable(dir, file string, rows [][3]string) {
+	p.t.Helper()
+	content := socketTableHeader
+	for i, row := range rows {
+		content += "   " + strconv.Itoa(i) + ": " + row[0] + " " + row[1] +
+			" 01 00000000:00000000 00:00000000 00000000  1000        0 " + row[2] + " 1 0000000000000000 20 4 30 10 -1\n"
+	}
+	p.write(content, dir, "net", file)
+}
+
+// process adds a process in network namespace ns owning the given sockets
+func (p *fakeProc) process(pid int, name string, uid int, cgroup, ns string, inodes ...uint64) {
+	p.t.Helper()
+	dir := strconv.Itoa(pid)
+	p.write(name+"\n", dir, "comm")
+	p.write("Name:\t"+name+"\nUid:\t"+strconv.Itoa(uid)+"\t"+strconv.Itoa(uid)+"\t"+strconv.Itoa(uid)+"\t"+strconv.Itoa(uid)+"\n", dir, "status")
+	p.write(cgroup, dir, "cgroup")
+	p.symlink(ns, dir, "ns", "net")
+	p.symlink("/dev/null", dir, "fd", "0")
+	p.symlink("pipe:[1234]", dir, "fd", "1")
+	for i, inode := range inodes {
+		p.symlink("socket:["+strconv.FormatUint(inode, 10)+"]", dir, "fd", strconv.Itoa(3+i))
+	}
+}
+
+func TestParseSocketAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		ip   string
+		port uint16
+		err  bool
+	}{
+		{in: "0100007F:0CEA", ip: "127.0.0.1", port: 3306},
+		{in: "0A01A8C0:C738", ip: "192.168.1.10", port: 51000},
+		{in: "00000000:0035", ip: "0.0.0.0", port: 53},
+		{in: "B80D0120000000000000000001000000:01BB", ip: "2001:db8::1", port: 443},
+		{in: "00000000000000000000000000000000:0016", ip: "::", port: 22},
+		// Dual-stack sockets list IPv4 peers as IPv4-mapped addresses
+		{in: "0000000000000000FFFF00000100000A:1F90", ip: "10.0.0.1", port: 8080},
+		{in: "0100007F", err: true},
+		{in: "0100007G:0CEA", err: true},
+		{in: "01007F:0CEA", err: true},
+		{in: "0100007F:10000", err: true},
+		{in: "0100007F:XYZ", err: true},
+	}
+
+	for _, tt := range tests {
+		ip, port, err := parseSocketAddr(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseSocketAddr(%q) = %s:%d, want an error", tt.in, ip, port)
+			}
+			continue
+		}
+		if err != nil || ip != tt.ip || port != tt.port {
+			t.Errorf("parseSocketAddr(%q) = %s:%d, %v, want %s:%d", tt.in, ip, port, err, tt.ip, tt.port)
+		}
+	}
+}
+
+func TestReadSocketTable(t *testing.T) {
+	p := newFakeProc(t)
+	p.socketTable("", "tcp", [][3]string{
+		{"0100007F:0CEA", "00000000:0000", "27421"}, // listener
+		{"0A01A8C0:C738", "057100CB:1F90", "1001"},  // connected
+		{"0A01A8C0:C739", "057100CB:1F90", "0"},     // TIME_WAIT
+		{"0A01A8C0:C73A", "bogus", "1002"},          // malformed
+		{"0A01A8C0:C738", "057100CB:1F90", "1003"},  // duplicate
+	})
+	p.write(socketTableHeader+"   0: 0100007F:0CEA\n", "net", "udp") // truncated
+
+	for _, connectedOnly := range []bool{false, true} {
+		sockets := make(map[socketKey]uint64)
+		if err := readSocketTable(filepath.Join(p.root, "net", "tcp"), "TCP", connectedOnly, sockets); err != nil {
+			t.Fatal(err)
+		}
+		want := map[socketKey]uint64{
+			{"TCP", "192.168.1.10", 51000, "203.0.113.5", 8080}: 1001,
+		}
+		if !connectedOnly {
+			want[socketKey{protocol: "TCP", localIP: "127.0.0.1", localPort: 3306}] = 27421
+		}
+		if len(sockets) != len(want) {
+			t.Errorf("connectedOnly=%v: read %v, want %v", connectedOnly, sockets, want)
+		}
+		for key, inode := range want {
+			if sockets[key] != inode {
+				t.Errorf("connectedOnly=%v: socket %+v has inode %d, want %d", connectedOnly, key, sockets[key], inode)
+			}
+		}
+	}
+
+	sockets := make(map[socketKey]uint64)
+	if err := readSocketTable(filepath.Join(p.root, "net", "udp"), "UDP", false, sockets); err != nil || len(sockets) != 0 {
+		t.Errorf("truncated table read as %v, %v", sockets, err)
+	}
+	if err := readSocketTable(filepath.Join(p.root, "net", "udp6"), "UDP", false, sockets); !os.IsNotExist(err) {
+		t.Errorf("missing table: %v", err)
+	}
+}
+
+func TestScanProcesses(t *testing.T) {
+	const container = "4f2a9c1e7b3d5a6f8e0c2b4d6a8f1e3c5b7d9a0e2c4f6b8d1a3e5c7f9b0d2a4e"
+
+	p := newFakeProc(t)
+	p.socketTable("", "tcp", [][3]string{
+		{"0A01A8C0:C738", "057100CB:1F90", "1001"},
+		{"00000000:0016", "00000000:0000", "1002"},
+	})
+	p.socketTable("", "tcp6", [][3]string{
+		{"B80D0120000000000000000001000000:01BB", "B80D0120000000000000000002000000:D431", "1003"},
+	})
+	p.socketTable("", "udp", [][3]string{
+		{"00000000:0035", "00000000:0000", "1004"},
+	})
+	p.process(100, "sshd", 4242421, "0::/system.slice/sshd.service\n", "net:[4026531840]", 1001, 1002)
+	// A child sharing a socket of its parent after fork
+	p.process(200, "sshd", 4242422, "0::/system.slice/sshd.service\n", "net:[4026531840]", 1001, 1003, 1004)
+	// A container in a namespace of its own: its listener is ignored and its
+	// connected socket found through its own tables
+	p.process(300, "nginx", 4242423,
+		"12:memory:/docker/"+container+"\n11:cpu:/docker/"+container+"\n",
+		"net:[4026532999]", 3001, 3002)
+	p.socketTable("300", "tcp", [][3]string{
+		{"020011AC:0050", "0A01A8C0:D000", "3001"},
+		{"00000000:0050", "00000000:0000", "3002"},
+	})
+	// Neither a process nor a socket table
+	p.write("", "stat")
+
+	table, err := scanProcesses(p.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSockets := map[socketKey]uint64{
+		{"TCP", "192.168.1.10", 51000, "203.0.113.5", 8080}:  1001,
+		{protocol: "TCP", localIP: "0.0.0.0", localPort: 22}: 1002,
+		{"TCP", "2001:db8::1", 443, "2001:db8::2", 54321}:    1003,
+		{protocol: "UDP", localIP: "0.0.0.0", localPort: 53}: 1004,
+		{"TCP", "172.17.0.2", 80, "192.168.1.10", 53248}:     3001,
+	}
+	if len(table.sockets) != len(wantSockets) {
+		t.Errorf("sockets %v, want %v", table.sockets, wantSockets)
+	}
+	for key, inode := range wantSockets {
+		if table.sockets[key] != inode {
+			t.Errorf("socket %+v has inode %d, want %d", key, table.sockets[key], inode)
+		}
+	}
+
+	wantOwners := map[uint64]int{1001: 100, 1002: 100, 1003: 200, 1004: 200, 3001: 300, 3002: 300}
+	if len(table.processes) != len(wantOwners) {
+		t.Errorf("%d sockets with owners, want %d", len(table.processes), len(wantOwners))
+	}
+	for inode, pid := range wantOwners {
+		if proc := table.processes[inode]; proc == nil || proc.PID != pid {
+			t.Errorf("socket %d owned by %+v, want PID %d", inode, proc, pid)
+		}
+	}
+	sshd := table.processes[1002]
+	if sshd.Name != "sshd" || sshd.UID != 4242421 || sshd.User != "4242421" || sshd.Cgroup != "/system.slice/sshd.service" {
+		t.Errorf("process 100 read as %+v", sshd)
+	}
+	if nginx := table.processes[3001]; nginx.Cgroup != "/docker/"+container {
+		t.Errorf("process 300 in cgroup %q", nginx.Cgroup)
+	}
+
+	if _, err := scanProcesses(t.TempDir()); err == nil {
+		t.Errorf("scan of a tree without socket tables succeeded")
+	}
+}
+
+func TestProcessResolverLookup(t *testing.T) {
+	const container = "4f2a9c1e7b3d5a6f8e0c2b4d6a8f1e3c5b7d9a0e2c4f6b8d1a3e5c7f9b0d2a4e"
+
+	p := newFakeProc(t)
+	p.socketTable("", "tcp", [][3]string{
+		{"0A01A8C0:C738", "057100CB:1F90", "1001"},
+		{"00000000:0016", "00000000:0000", "1002"},
+	})
+	p.socketTable("", "udp6", [][3]string{
+		{"00000000000000000000000000000000:0035", "00000000000000000000000000000000:0000", "1003"},
+	})
+	p.process(100, "curl", 4242421, "0::/user.slice\n", "net:[4026531840]", 1001)
+	p.process(200, "sshd", 4242422, "0::/system.slice/sshd.service\n", "net:[4026531840]", 1002)
+	p.process(300, "dnsmasq", 4242423, "0::/system.slice/docker-"+container+".scope\n", "net:[4026531840]", 1003)
+
+	resolver := NewProcessResolver(ProcessOptions{Root: p.root})
+	if proc, _ := resolver.Lookup("TCP", "192.168.1.10", 51000, "203.0.113.5", 8080, false); proc != nil {
+		t.Errorf("lookup before the first scan found %+v", proc)
+	}
+	if err := resolver.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		protocol   string
+		local      string
+		localPort  uint16
+		remote     string
+		remotePort uint16
+		listener   bool
+		pid        int
+		container  string
+	}{
+		{name: "connected socket", protocol: "TCP", local: "192.168.1.10", localPort: 51000, remote: "203.0.113.5", remotePort: 8080, pid: 100},
+		{name: "listener on any address", protocol: "TCP", local: "192.168.1.10", localPort: 22, remote: "198.51.100.9", remotePort: 40000, listener: true, pid: 200},
+		{name: "listener not asked for", protocol: "TCP", local: "192.168.1.10", localPort: 22, remote: "198.51.100.9", remotePort: 40000},
+		{name: "dual-stack udp socket", protocol: "UDP", local: "10.0.0.1", localPort: 53, remote: "10.0.0.9", remotePort: 3333, listener: true, pid: 300, container: container},
+		{name: "other protocol", protocol: "UDP", local: "192.168.1.10", localPort: 22, remote: "198.51.100.9", remotePort: 40000, listener: true},
+	}
+	for _, tt := range tests {
+		proc, workload := resolver.Lookup(tt.protocol, tt.local, tt.localPort, tt.remote, tt.remotePort, tt.listener)
+		pid := 0
+		if proc != nil {
+			pid = proc.PID
+		}
+		if pid != tt.pid {
+			t.Errorf("%s: found PID %d, want %d", tt.name, pid, tt.pid)
+		}
+		id := ""
+		if workload != nil {
+			id = workload.ContainerID
+		}
+		if id != tt.container {
+			t.Errorf("%s: found container %q, want %q", tt.name, id, tt.container)
+		}
+	}
+}
+
+func TestAttributeProcessesRetries(t *testing.T) {
+	p := newFakeProc(t)
+	p.socketTable("", "tcp", nil)
+
+	resolver := NewProcessResolver(ProcessOptions{Root: p.root})
+	pc := &PacketCapture{opts: Options{Processes: resolver}, local: NewLocalAddrs("", nil)}
+	s := &shard{pc: pc, flows: newFlowTable("test", DefaultRateOptions(), DefaultFlowOptions())}
+
+	// A socket opened just after a scan, and a flow between two other hosts
+	late := &flowEntry{flow: &models.Flow{Connection: models.Connection{
+		Protocol: "TCP", SrcIP: "192.168.1.10", SrcPort: 51000, DstIP: "203.0.113.5", DstPort: 8080,
+	}}}
+	foreign := &flowEntry{flow: &models.Flow{Connection: models.Connection{
+		Protocol: "TCP", SrcIP: "192.168.1.20", SrcPort: 40000, DstIP: "203.0.113.5", DstPort: 443,
+	}}}
+	s.flows.flows[FlowKey{Protocol: "TCP", AddrA: "late"}] = late
+	s.flows.flows[FlowKey{Protocol: "TCP", AddrA: "foreign"}] = foreign
+
+	s.attributeProcesses()
+	if late.processAttempts != 0 {
+		t.Fatalf("attribution attempted before the first scan")
+	}
+
+	if err := resolver.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.attributeProcesses()
+	}
+	if late.flow.Process != nil || late.processAttempts != 1 || foreign.processAttempts != 1 {
+		t.Fatalf("after one scan: process %+v, attempts %d and %d", late.flow.Process, late.processAttempts, foreign.processAttempts)
+	}
+
+	p.socketTable("", "tcp", [][3]string{{"0A01A8C0:C738", "057100CB:1F90", "1001"}})
+	p.process(100, "curl", 4242421, "0::/user.slice\n", "net:[4026531840]", 1001)
+	for i := 0; i < 3; i++ {
+		if err := resolver.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		s.attributeProcesses()
+	}
+	if late.flow.Process == nil || late.flow.Process.PID != 100 {
+		t.Errorf("socket in the next scan attributed to %+v", late.flow.Process)
+	}
+	if foreign.flow.Process != nil || foreign.processAttempts != processAttempts {
+		t.Errorf("foreign flow looked up in %d scans, want %d", foreign.processAttempts, processAttempts)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package capture
+
+import "fmt"
+
+// scanProcesses needs procfs, which only Linux has
+func scanProcesses(root string) (*processTable, error) {
+	return nil, fmt.Errorf("process attribution is only supported on Linux")
+}
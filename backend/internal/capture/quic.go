@@ -0,0 +1,520 @@
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// maxQUICCrypto bounds the CRYPTO stream buffered to find a ClientHello
+	maxQUICCrypto = 16 * 1024
+	// quicInitialPackets is how many client Initial packets we decrypt
+	// before giving up on the ClientHello
+	quicInitialPackets = 8
+)
+
+// Long header packet types, as numbered by QUIC v1
+const (
+	quicInitial = iota
+	quic0RTT
+	quicHandshake
+	quicRetry
+)
+
+// quicVersion describes a QUIC version whose Initial packets we can decrypt:
+// the keys derive from the client's first destination connection ID
+type quicVersion struct {
+	name string
+	salt []byte
+	// labels of the key, IV and header protection key
+	keyLabel, ivLabel, hpLabel string
+}
+
+var quicVersions = map[uint32]*quicVersion{
+	0x00000001: {
+		name:     "v1",
+		salt:     mustHex("38762cf7f55934b34d179ae6a4c80cadccbb7f0a"),
+		keyLabel: "quic key", ivLabel: "quic iv", hpLabel: "quic hp",
+	},
+	0x6b3343cf: {
+		name:     "v2",
+		salt:     mustHex("0dede3def700a6db819381be6e269dcbf9bd2ed9"),
+		keyLabel: "quicv2 key", ivLabel: "quicv2 iv", hpLabel: "quicv2 hp",
+	},
+	0xff00001d: {
+		name:     "draft-29",
+		salt:     mustHex("afbfec289993d24c9e9786f19c6111e04390a899"),
+		keyLabel: "quic key", ivLabel: "quic iv", hpLabel: "quic hp",
+	},
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func quicVersionName(version uint32) string {
+	if v, ok := quicVersions[version]; ok {
+		return v.name
+	}
+	return fmt.Sprintf("0x%08x", version)
+}
+
+// quicHeader is the clear text part of a long header packet
+type quicHeader struct {
+	version    uint32
+	typ        int
+	dcid, scid []byte
+	pnOffset   int // where the protected packet number starts
+	length     int // packet number and payload, from pnOffset
+}
+
+// parseQUICLong parses the long header packet at the start of b and returns
+// its total length, so that coalesced packets can be walked
+func parseQUICLong(b []byte) (*quicHeader, int, bool) {
+	if len(b) < 7 || b[0]&0x80 == 0 {
+		return nil, 0, false
+	}
+	hdr := &quicHeader{version: binary.BigEndian.Uint32(b[1:5])}
+	if hdr.version == 0 {
+		// Version negotiation
+		return nil, 0, false
+	}
+	hdr.typ = int(b[0]>>4) & 0x03
+	if hdr.version == 0x6b3343cf {
+		// QUIC v2 shuffled the type numbers
+		hdr.typ = (hdr.typ + 3) % 4
+	}
+
+	pos := 5
+	for _, cid := range []*[]byte{&hdr.dcid, &hdr.scid} {
+		if pos >= len(b) {
+			return nil, 0, false
+		}
+		n := int(b[pos])
+		pos++
+		if n > 20 || pos+n > len(b) {
+			return nil, 0, false
+		}
+		*cid = b[pos : pos+n]
+		pos += n
+	}
+	if hdr.typ == quicRetry {
+		return hdr, len(b), true
+	}
+
+	if hdr.typ == quicInitial {
+		token, n := quicVarint(b[pos:])
+		if n == 0 || pos+n+int(token) > len(b) {
+			return nil, 0, false
+		}
+		pos += n + int(token)
+	}
+	length, n := quicVarint(b[pos:])
+	if n == 0 || pos+n+int(length) > len(b) {
+		return nil, 0, false
+	}
+	hdr.pnOffset = pos + n
+	hdr.length = int(length)
+	return hdr, hdr.pnOffset + hdr.length, true
+}
+
+// quicVarint decodes a variable-length integer, returning its size or 0
+func quicVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// quicKeys protect the client's Initial packets
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICKeys derives the client Initial keys (RFC 9001 section 5.2)
+func newQUICKeys(v *quicVersion, dcid []byte) (*quicKeys, error) {
+	initial := hkdfExtract(v.salt, dcid)
+	secret := hkdfExpandLabel(initial, "client in", sha256.Size)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, v.keyLabel, 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(secret, v.hpLabel, 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(secret, v.ivLabel, 12), hp: hp}, nil
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = append(info, byte(length>>8), byte(length), byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// decrypt removes the header protection of an Initial packet and opens its
+// payload
+func (k *quicKeys) decrypt(packet []byte, hdr *quicHeader) ([]byte, bool) {
+	end := hdr.pnOffset + hdr.length
+	if hdr.length < 20 || end > len(packet) {
+		return nil, false
+	}
+	sample := packet[hdr.pnOffset+4 : hdr.pnOffset+20]
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+
+	header := append([]byte(nil), packet[:hdr.pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	header = header[:hdr.pnOffset+pnLen]
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[hdr.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[hdr.pnOffset+i])
+	}
+
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	plain, err := k.aead.Open(nil, nonce, packet[hdr.pnOffset+pnLen:end], header)
+	return plain, err == nil
+}
+
+// quicFragment is a piece of the CRYPTO stream
+type quicFragment struct {
+	offset uint64
+	data   []byte
+}
+
+// parseQUICFrames collects the CRYPTO frames of a decrypted Initial packet.
+// Initial packets only carry PADDING, PING, ACK, CRYPTO and CONNECTION_CLOSE.
+func parseQUICFrames(b []byte) []quicFragment {
+	var fragments []quicFragment
+	varint := func() uint64 {
+		v, n := quicVarint(b)
+		if n == 0 {
+			b = nil
+		}
+		b = b[n:]
+		return v
+	}
+	for len(b) > 0 {
+		typ := varint()
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			varint() // largest acknowledged
+			varint() // delay
+			ranges := varint()
+			varint() // first range
+			for i := uint64(0); i < ranges && len(b) > 0; i++ {
+				varint() // gap
+				varint() // range length
+			}
+			if typ == 0x03 {
+				varint() // ECN counts
+				varint()
+				varint()
+			}
+		case 0x06: // CRYPTO
+			offset := varint()
+			length := varint()
+			if length > uint64(len(b)) {
+				return fragments
+			}
+			fragments = append(fragments, quicFragment{offset, b[:length]})
+			b = b[length:]
+		default:
+			return fragments
+		}
+	}
+	return fragments
+}
+
+// quicState follows the handshake of a QUIC flow
+type quicState struct {
+	keys      *quicKeys // derived from the first client Initial
+	fragments []quicFragment
+	buffered  int
+	initials  int  // client Initial packets decrypted
+	done      bool // found the ClientHello, or gave up
+	cids      []string
+	client    string // address the client last sent from
+}
+
+// inspectQUIC records the version and connection IDs of a QUIC flow, and
+// decrypts the client's Initial packets to read the ClientHello
+func (t *flowTable) inspectQUIC(entry *flowEntry, info *packetInfo, fromClient bool) {
+	flow := entry.flow
+	if flow.AppProtocol != "QUIC" || info.tcp != nil || len(info.payload) == 0 {
+		return
+	}
+	if entry.quic == nil {
+		entry.quic = &quicState{client: endpoint(flow.SrcIP, flow.SrcPort)}
+		flow.QUIC = &models.QUICInfo{}
+	}
+	state := entry.quic
+
+	if fromClient {
+		if client := endpoint(info.srcIP, info.srcPort); client != state.client {
+			// Connection migration or NAT rebinding
+			state.client = client
+			flow.QUIC.Migrations++
+		}
+	}
+
+	// Datagrams can carry several long header packets
+	payload := info.payload
+	for len(payload) > 0 {
+		hdr, size, ok := parseQUICLong(payload)
+		if !ok {
+			return
+		}
+		if flow.QUIC.Version == "" {
+			flow.QUIC.Version = quicVersionName(hdr.version)
+		}
+		if len(hdr.scid) > 0 {
+			id := hex.EncodeToString(hdr.scid)
+			if fromClient && flow.QUIC.ClientCID == "" {
+				flow.QUIC.ClientCID = id
+				t.registerQUIC(entry, hdr.scid)
+			} else if !fromClient && flow.QUIC.ServerCID == "" {
+				flow.QUIC.ServerCID = id
+				t.registerQUIC(entry, hdr.scid)
+			}
+		}
+		if fromClient && hdr.typ == quicInitial && !state.done {
+			entry.readInitial(payload[:size], hdr)
+		}
+		payload = payload[size:]
+	}
+}
+
+// readInitial decrypts a client Initial packet and parses the ClientHello
+// once the CRYPTO stream holds all of it
+func (e *flowEntry) readInitial(packet []byte, hdr *quicHeader) {
+	state := e.quic
+	if state.keys == nil {
+		version, ok := quicVersions[hdr.version]
+		if !ok {
+			state.done = true
+			return
+		}
+		keys, err := newQUICKeys(version, hdr.dcid)
+		if err != nil {
+			state.done = true
+			return
+		}
+		state.keys = keys
+	}
+
+	plain, ok := state.keys.decrypt(packet, hdr)
+	state.initials++
+	if !ok {
+		state.done = state.initials >= quicInitialPackets
+		return
+	}
+	for _, f := range parseQUICFrames(plain) {
+		if state.buffered+len(f.data) > maxQUICCrypto {
+			break
+		}
+		state.fragments = append(state.fragments, quicFragment{f.offset, append([]byte(nil), f.data...)})
+		state.buffered += len(f.data)
+	}
+
+	// Clients split the ClientHello and may send the pieces out of order
+	sort.Slice(state.fragments, func(i, j int) bool {
+		return state.fragments[i].offset < state.fragments[j].offset
+	})
+	var stream []byte
+	for _, f := range state.fragments {
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+
+	if len(stream) >= 4 && stream[0] == tlsClientHello {
+		length := int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])
+		if len(stream) >= 4+length {
+			if hello, ok := parseClientHello(stream[4 : 4+length]); ok {
+				if e.flow.TLS == nil {
+					e.flow.TLS = &models.TLSInfo{}
+				}
+				hello.describe(e.flow.TLS, "q")
+			}
+			state.done = true
+		}
+	}
+	if state.done || state.initials >= quicInitialPackets || state.buffered >= maxQUICCrypto {
+		state.done = true
+		state.fragments = nil
+	}
+}
+
+// registerQUIC indexes a flow by one of its connection IDs
+func (t *flowTable) registerQUIC(entry *flowEntry, cid []byte) {
+	id := string(cid)
+	if _, taken := t.quicIDs[id]; taken {
+		return
+	}
+	t.quicIDs[id] = entry
+	t.quicIDLens[len(cid)]++
+	entry.quic.cids = append(entry.quic.cids, id)
+	if t.routes != nil {
+		t.routes.add(id, t.shard)
+	}
+}
+
+// forgetQUIC drops the connection IDs of a flow leaving the table
+func (t *flowTable) forgetQUIC(entry *flowEntry) {
+	if entry.quic == nil {
+		return
+	}
+	for _, id := range entry.quic.cids {
+		delete(t.quicIDs, id)
+		if t.quicIDLens[len(id)]--; t.quicIDLens[len(id)] == 0 {
+			delete(t.quicIDLens, len(id))
+		}
+		if t.routes != nil {
+			t.routes.remove(id, t.shard)
+		}
+	}
+	entry.quic.cids = nil
+}
+
+// quicFlow finds the flow a UDP payload belongs to by its destination
+// connection ID, so that a connection moving to a new address keeps its
+// flow.
+func (t *flowTable) quicFlow(payload []byte) *flowEntry {
+	entry, _ := lookupQUICID(payload, t.quicIDs, t.quicIDLens)
+	return entry
+}
+
+// lookupQUICID finds the destination connection ID of a UDP payload among
+// ids, lens counting the IDs of each length. Short headers don't carry the ID
+// length, so every length in use is tried.
+func lookupQUICID[T any](payload []byte, ids map[string]T, lens map[int]int) (T, bool) {
+	var none T
+	if len(ids) == 0 || len(payload) < 2 {
+		return none, false
+	}
+	if payload[0]&0x80 != 0 {
+		if hdr, _, ok := parseQUICLong(payload); ok && len(hdr.dcid) > 0 {
+			v, ok := ids[string(hdr.dcid)]
+			return v, ok
+		}
+		return none, false
+	}
+	if payload[0]&0x40 == 0 {
+		// Not QUIC: the fixed bit is always set
+		return none, false
+	}
+	for n := range lens {
+		if len(payload) > 1+n {
+			if v, ok := ids[string(payload[1:1+n])]; ok {
+				return v, true
+			}
+		}
+	}
+	return none, false
+}
+
+// quicRoutes maps the QUIC connection IDs of the flows to the shards keeping
+// them. The reader hashes frames by address, so it looks up the packets of a
+// connection that moved to a new address here to hand them to the shard of
+// their flow.
+type quicRoutes struct {
+	mu     sync.RWMutex
+	shards map[string]int
+	lens   map[int]int
+}
+
+func newQUICRoutes() *quicRoutes {
+	return &quicRoutes{shards: make(map[string]int), lens: make(map[int]int)}
+}
+
+func (r *quicRoutes) add(id string, shard int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, taken := r.shards[id]; taken {
+		return
+	}
+	r.shards[id] = shard
+	r.lens[len(id)]++
+}
+
+// remove drops an ID unless another shard took it over
+func (r *quicRoutes) remove(id string, shard int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if owner, ok := r.shards[id]; !ok || owner != shard {
+		return
+	}
+	delete(r.shards, id)
+	if r.lens[len(id)]--; r.lens[len(id)] == 0 {
+		delete(r.lens, len(id))
+	}
+}
+
+// lookup returns the shard of the connection a UDP payload belongs to
+func (r *quicRoutes) lookup(payload []byte) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return lookupQUICID(payload, r.shards, r.lens)
+}
+
+func endpoint(ip string, port uint16) string {
+	return fmt.Sprintf("%s:%d", ip, port)
+}
@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// The sample packets of RFC 9001 Appendix A
+var (
+	rfc9001DCID = mustHex("8394c8f03e515708")
+
+	// A.2: the CRYPTO frame of the client Initial, padded to 1162 bytes
+	rfc9001ClientCrypto = mustHex("060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e86804fe3a47f06a" +
+		"2b69484c00000413011302010000c000000010000e00000b6578616d706c652e636f6dff01000100000a00080006001d" +
+		"0017001800100007000504616c706e000500050100000000003300260024001d00209370b2c9caa47fbabaf4559fedba" +
+		"753de171fa71f50f1ce15d43e994ec74d748002b0003020304000d0010000e0403050306030203080408050806002d00" +
+		"020101001c00024001003900320408ffffffffffffffff05048000ffff07048000ffff0801100104800075300901100f" +
+		"088394c8f03e51570806048000ffff")
+	rfc9001ClientHeader          = mustHex("c300000001088394c8f03e5157080000449e00000002")
+	rfc9001ClientProtectedHeader = mustHex("c000000001088394c8f03e5157080000449e7b9aec34")
+
+	// A.3: the server Initial, in full
+	rfc9001ServerPacket = mustHex("cf000000010008f067a5502a4262b5004075c0d95a482cd0991cd25b0aac406a5816b6394100f3" +
+		"7a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3b" +
+		"ded74b562bfb19fb84022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc42158407dd074ee")
+	rfc9001ServerPayload = mustHex("02000000000600405a020000560303eefce7f7b37ba1d1632e96677825ddf73988cfc79825df56" +
+		"6dc5430b9a045a1200130100002e00330024001d00209d3c940d89690b84d08a60993c144eca684d1081287c834d5311" +
+		"bcf32bb9da1a002b00020304")
+)
+
+// rfc9001ClientPacket protects the client Initial of A.2 with the keys
+// given there, checking the sample and tag against the RFC
+func rfc9001ClientPacket(t *testing.T) (packet, payload []byte) {
+	t.Helper()
+	payload = make([]byte, 1162)
+	copy(payload, rfc9001ClientCrypto)
+
+	block, err := aes.NewCipher(mustHex("1f369613dd76d5467730efcbe3b1a22d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := mustHex("fa044b2f42a3fd3b46fb255c")
+	nonce[len(nonce)-1] ^= 2 // packet number
+	sealed := aead.Seal(nil, nonce, payload, rfc9001ClientHeader)
+	if sample := hex.EncodeToString(sealed[:16]); sample != "d1b1c98dd7689fb8ec11d242b123dc9b" {
+		t.Fatalf("sample %s", sample)
+	}
+	if tag := hex.EncodeToString(sealed[len(sealed)-16:]); tag != "e221af44860018ab0856972e194cd934" {
+		t.Fatalf("tag %s", tag)
+	}
+	return append(append([]byte(nil), rfc9001ClientProtectedHeader...), sealed...), payload
+}
+
+func TestQUICInitialSecrets(t *testing.T) {
+	v1 := quicVersions[0x00000001]
+	initial := hkdfExtract(v1.salt, rfc9001DCID)
+
+	tests := []struct {
+		secret      string
+		want        string
+		key, iv, hp string
+	}{
+		{
+			secret: "client in",
+			want:   "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+			key:    "1f369613dd76d5467730efcbe3b1a22d",
+			iv:     "fa044b2f42a3fd3b46fb255c",
+			hp:     "9f50449e04a0e810283a1e9933adedd2",
+		},
+		{
+			secret: "server in",
+			want:   "3c199828fd139efd216c155ad844cc81fb82fa8d7446fa7d78be803acdda951b",
+			key:    "cf3a5331653c364c88f0f379b6067e37",
+			iv:     "0ac1493ca1905853b0bba03e",
+			hp:     "c206b8d9b9f0f37644430b490eeaa314",
+		},
+	}
+	for _, tt := range tests {
+		secret := hkdfExpandLabel(initial, tt.secret, 32)
+		if got := hex.EncodeToString(secret); got != tt.want {
+			t.Errorf("%s secret %s, want %s", tt.secret, got, tt.want)
+		}
+		for _, derived := range []struct{ label, want string }{
+			{v1.keyLabel, tt.key}, {v1.ivLabel, tt.iv}, {v1.hpLabel, tt.hp},
+		} {
+			if got := hex.EncodeToString(hkdfExpandLabel(secret, derived.label, len(derived.want)/2)); got != derived.want {
+				t.Errorf("%s %s %s, want %s", tt.secret, derived.label, got, derived.want)
+			}
+		}
+	}
+
+	// The keys newQUICKeys derives are the client's
+	keys, err := newQUICKeys(v1, rfc9001DCID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv := hex.EncodeToString(keys.iv); iv != tests[0].iv {
+		t.Errorf("client iv %s", iv)
+	}
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, mustHex("d1b1c98dd7689fb8ec11d242b123dc9b"))
+	if got := hex.EncodeToString(mask[:5]); got != "437b9aec36" {
+		t.Errorf("header protection mask %s, want 437b9aec36", got)
+	}
+}
+
+func TestQUICDecryptInitial(t *testing.T) {
+	clientPacket, clientPayload := rfc9001ClientPacket(t)
+	clientKeys, err := newQUICKeys(quicVersions[0x00000001], rfc9001DCID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decrypt only knows the client keys, the server's come from the RFC
+	serverBlock, _ := aes.NewCipher(mustHex("cf3a5331653c364c88f0f379b6067e37"))
+	serverAEAD, _ := cipher.NewGCM(serverBlock)
+	serverHP, _ := aes.NewCipher(mustHex("c206b8d9b9f0f37644430b490eeaa314"))
+	serverKeys := &quicKeys{aead: serverAEAD, iv: mustHex("0ac1493ca1905853b0bba03e"), hp: serverHP}
+
+	corrupted := append([]byte(nil), clientPacket...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		keys    *quicKeys
+		packet  []byte
+		payload []byte // nil if it mustn't decrypt
+	}{
+		{name: "client initial", keys: clientKeys, packet: clientPacket, payload: clientPayload},
+		{name: "server initial", keys: serverKeys, packet: rfc9001ServerPacket, payload: rfc9001ServerPayload},
+		{name: "corrupted", keys: clientKeys, packet: corrupted},
+		{name: "wrong keys", keys: clientKeys, packet: rfc9001ServerPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, size, ok := parseQUICLong(tt.packet)
+			if !ok || size != len(tt.packet) || hdr.typ != quicInitial {
+				t.Fatalf("header %+v of %d bytes", hdr, size)
+			}
+			original := append([]byte(nil), tt.packet...)
+			plain, ok := tt.keys.decrypt(tt.packet, hdr)
+			if ok != (tt.payload != nil) || !bytes.Equal(plain, tt.payload) {
+				t.Errorf("decrypted %v: %x", ok, plain)
+			}
+			// The packet is still needed protected for the next attempt
+			if !bytes.Equal(tt.packet, original) {
+				t.Errorf("packet modified")
+			}
+		})
+	}
+}
+
+func TestQUICReadInitial(t *testing.T) {
+	packet, _ := rfc9001ClientPacket(t)
+	hdr, _, ok := parseQUICLong(packet)
+	if !ok {
+		t.Fatal("header didn't parse")
+	}
+	if hex.EncodeToString(hdr.dcid) != "8394c8f03e515708" || len(hdr.scid) != 0 {
+		t.Errorf("connection IDs %x and %x", hdr.dcid, hdr.scid)
+	}
+
+	entry := &flowEntry{flow: &models.Flow{}, quic: &quicState{}}
+	entry.readInitial(packet, hdr)
+	info := entry.flow.TLS
+	if !entry.quic.done || info == nil {
+		t.Fatalf("ClientHello not found")
+	}
+	if info.SNI != "example.com" || len(info.ALPN) != 1 || info.ALPN[0] != "alpn" || info.Version != "TLS 1.3" {
+		t.Errorf("read %+v", info)
+	}
+	if !strings.HasPrefix(info.JA4, "q13d0211an_") {
+		t.Errorf("JA4 %s", info.JA4)
+	}
+}
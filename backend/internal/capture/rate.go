@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rate smoothing methods
+const (
+	SmoothingNone   = "none"   // rate over the last tick only
+	SmoothingEWMA   = "ewma"   // exponentially weighted moving average
+	SmoothingWindow = "window" // plain average over the last N ticks
+)
+
+// RateOptions configures how per-flow rates are computed at each tick
+type RateOptions struct {
+	Smoothing string
+	// Alpha is the weight of the newest sample for EWMA, in (0, 1]
+	Alpha float64
+	// Window is the number of ticks averaged by the sliding window
+	Window int
+}
+
+// DefaultRateOptions returns the smoothing used when none is configured
+func DefaultRateOptions() RateOptions {
+	return RateOptions{
+		Smoothing: SmoothingEWMA,
+		Alpha:     0.5,
+		Window:    5,
+	}
+}
+
+// Validate checks that the options describe a usable estimator
+func (o RateOptions) Validate() error {
+	switch o.Smoothing {
+	case "", SmoothingNone:
+	case SmoothingEWMA:
+		if o.Alpha <= 0 || o.Alpha > 1 {
+			return fmt.Errorf("EWMA alpha must be in (0, 1], got %v", o.Alpha)
+		}
+	case SmoothingWindow:
+		if o.Window < 1 {
+			return fmt.Errorf("rate window must be at least 1 tick, got %d", o.Window)
+		}
+	default:
+		return fmt.Errorf("unknown rate smoothing %q", o.Smoothing)
+	}
+	return nil
+}
+
+// newEstimator creates an estimator for the configured smoothing
+func (o RateOptions) newEstimator() rateEstimator {
+	switch o.Smoothing {
+	case SmoothingEWMA:
+		return &ewmaEstimator{alpha: o.Alpha}
+	case SmoothingWindow:
+		return &windowEstimator{samples: make([]float64, o.Window)}
+	default:
+		return &instantEstimator{}
+	}
+}
+
+// rateEstimator turns per-tick rate samples into the reported rate
+type rateEstimator interface {
+	add(sample float64) float64
+}
+
+type instantEstimator struct{}
+
+func (e *instantEstimator) add(sample float64) float64 {
+	return sample
+}
+
+type ewmaEstimator struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+func (e *ewmaEstimator) add(sample float64) float64 {
+	if !e.primed {
+		// Start from the first sample rather than decaying up from zero
+		e.value = sample
+		e.primed = true
+	} else {
+		e.value = e.alpha*sample + (1-e.alpha)*e.value
+	}
+	return e.value
+}
+
+type windowEstimator struct {
+	samples []float64
+	next    int
+	count   int
+	sum     float64
+}
+
+func (e *windowEstimator) add(sample float64) float64 {
+	e.sum += sample - e.samples[e.next]
+	e.samples[e.next] = sample
+	e.next = (e.next + 1) % len(e.samples)
+	if e.count < len(e.samples) {
+		e.count++
+	}
+	return e.sum / float64(e.count)
+}
+
+// flowRate tracks the counters of a flow between ticks
+type flowRate struct {
+	lastBytes   uint64
+	lastPackets uint64
+	bytes       rateEstimator
+	packets     rateEstimator
+}
+
+// tick computes the rates of every flow over the interval since the last tick
+func (t *flowTable) tick(interval time.Duration) {
+	seconds := interval.Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	for _, entry := range t.flows {
+		flow := entry.flow
+		if entry.rate.bytes == nil {
+			entry.rate.bytes = t.rates.newEstimator()
+			entry.rate.packets = t.rates.newEstimator()
+		}
+
+		bytesPerSec := entry.rate.bytes.add(float64(flow.Bytes-entry.rate.lastBytes) / seconds)
+		packetsPerSec := entry.rate.packets.add(float64(flow.Packets-entry.rate.lastPackets) / seconds)
+		entry.rate.lastBytes = flow.Bytes
+		entry.rate.lastPackets = flow.Packets
+
+		flow.BytesPerSec = uint64(bytesPerSec + 0.5)
+		flow.PacketsPerSec = uint64(packetsPerSec + 0.5)
+		if flow.BytesPerSec > flow.PeakBytesPerSec {
+			flow.PeakBytesPerSec = flow.BytesPerSec
+		}
+		if flow.PacketsPerSec > flow.PeakPacketsPerSec {
+			flow.PeakPacketsPerSec = flow.PacketsPerSec
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package capture
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+func TestFlowRates(t *testing.T) {
+	// Bytes sent before each 2s tick; 2 packets every time
+	deltas := []uint64{1000, 3000, 0, 2000}
+
+	tests := []struct {
+		name  string
+		opts  RateOptions
+		rates []uint64 // bytes/s after each tick
+		peak  uint64
+	}{
+		{name: "none", opts: RateOptions{Smoothing: SmoothingNone}, rates: []uint64{500, 1500, 0, 1000}, peak: 1500},
+		{name: "ewma", opts: RateOptions{Smoothing: SmoothingEWMA, Alpha: 0.5}, rates: []uint64{500, 1000, 500, 750}, peak: 1000},
+		{name: "ewma newest only", opts: RateOptions{Smoothing: SmoothingEWMA, Alpha: 1}, rates: []uint64{500, 1500, 0, 1000}, peak: 1500},
+		// Averaging fewer ticks until the window fills, then rounding
+		{name: "window", opts: RateOptions{Smoothing: SmoothingWindow, Window: 3}, rates: []uint64{500, 1000, 667, 833}, peak: 1000},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		table := newFlowTable("test0", tt.opts, DefaultFlowOptions())
+		flow := &models.Flow{}
+		table.flows[FlowKey{Protocol: "UDP"}] = &flowEntry{flow: flow}
+
+		var rates []uint64
+		for _, delta := range deltas {
+			flow.Bytes += delta
+			flow.Packets += 2
+			table.tick(2 * time.Second)
+			rates = append(rates, flow.BytesPerSec)
+			if flow.PacketsPerSec != 1 {
+				t.Errorf("%s: %d packets/s, want 1", tt.name, flow.PacketsPerSec)
+			}
+		}
+		if !reflect.DeepEqual(rates, tt.rates) {
+			t.Errorf("%s: rates %v, want %v", tt.name, rates, tt.rates)
+		}
+		if flow.PeakBytesPerSec != tt.peak || flow.PeakPacketsPerSec != 1 {
+			t.Errorf("%s: peaks %d bytes/s and %d packets/s, want %d and 1", tt.name, flow.PeakBytesPerSec, flow.PeakPacketsPerSec, tt.peak)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+	"github.com/raojinlin/traffic-sniff/internal/storage"
+)
+
+// testdataStart is the time of the first packet of the files in testdata
+var testdataStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// replayResult is what a replay left behind
+type replayResult struct {
+	storage *storage.MemoryStorage
+	expired map[string]*models.Flow // by key, the last record of each flow
+	iface   string
+}
+
+// replay runs a capture file from testdata through the pipeline as fast as
+// possible
+func replay(t testing.TB, file string, opts Options) replayResult {
+	t.Helper()
+	if opts.Rates.Smoothing == "" {
+		opts.Rates = DefaultRateOptions()
+	}
+	if opts.Flows.IdleTimeout == 0 {
+		opts.Flows = DefaultFlowOptions()
+	}
+	if opts.Fragments.Timeout == 0 {
+		opts.Fragments = DefaultFragmentOptions()
+	}
+
+	pc, err := NewPacketCaptureFromFile("testdata/"+file, ReplayOptions{Speed: 0}, opts)
+	if err != nil {
+		t.Fatalf("open %s: %v", file, err)
+	}
+	defer pc.Close()
+
+	result := replayResult{
+		storage: storage.NewMemoryStorage(),
+		expired: make(map[string]*models.Flow),
+		iface:   pc.iface,
+	}
+	var mu sync.Mutex
+	pc.onExpire = func(flow *models.Flow) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.expired[flow.Key] = flow
+	}
+	if err := pc.Start(context.Background(), result.storage); err != nil {
+		t.Fatalf("replay %s: %v", file, err)
+	}
+	return result
+}
+
+// connections returns the flows left in storage by key
+func (r replayResult) connections() map[string]*models.Flow {
+	flows := make(map[string]*models.Flow)
+	for _, flow := range r.storage.GetFilteredConnections(&models.Filter{Interface: r.iface}) {
+		flows[flow.Key] = flow
+	}
+	return flows
+}
+
+func TestReplayFlows(t *testing.T) {
+	type wantFlow struct {
+		key           string
+		src           string
+		srcPort       uint16
+		dst           string
+		dstPort       uint16
+		method        string
+		clientBytes   uint64
+		clientPackets uint64
+		serverBytes   uint64
+		serverPackets uint64
+		// first and last are the packet times of the flow, from the start of
+		// the file
+		first, last time.Duration
+		// endReason is why the flow expired; flows expired before the end of
+		// the file are gone from storage, the others end with the shutdown
+		endReason string
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		flows []wantFlow
+		// interface totals, both directions
+		bytes   uint64
+		packets uint64
+	}{
+		{
+			name: "tcp session closed by FIN",
+			file: "tcp_session.pcap",
+			flows: []wantFlow{
+				{
+					key: "192.168.1.10:51000-203.0.113.5:8080-TCP",
+					src: "192.168.1.10", srcPort: 51000, dst: "203.0.113.5", dstPort: 8080,
+					method:      InitiatorSYN,
+					clientBytes: 5*60 + 154, clientPackets: 6,
+					serverBytes: 2*60 + 1054, serverPackets: 3,
+					first: 0, last: 80 * time.Millisecond,
+					endReason: EndFIN,
+				},
+				{
+					key: "192.168.1.10:52000-198.51.100.7:7000-UDP",
+					src: "192.168.1.10", srcPort: 52000, dst: "198.51.100.7", dstPort: 7000,
+					method:      InitiatorFirstPacket,
+					clientBytes: 62, clientPackets: 1,
+					first: 5 * time.Second, last: 5 * time.Second,
+					endReason: EndShutdown,
+				},
+			},
+			bytes:   5*60 + 154 + 2*60 + 1054 + 62,
+			packets: 10,
+		},
+		{
+			name: "tcp picked up mid-stream",
+			file: "midstream.pcap",
+			flows: []wantFlow{
+				{
+					key: "192.168.1.10:50123-203.0.113.5:443-TCP",
+					src: "192.168.1.10", srcPort: 50123, dst: "203.0.113.5", dstPort: 443,
+					method:      InitiatorPort,
+					clientBytes: 60, clientPackets: 1,
+					serverBytes: 554 + 754, serverPackets: 2,
+					first: 0, last: 10 * time.Millisecond,
+					endReason: EndShutdown,
+				},
+			},
+			bytes:   60 + 554 + 754,
+			packets: 3,
+		},
+		{
+			name: "udp flow expiring idle",
+			file: "udp_idle.pcap",
+			flows: []wantFlow{
+				{
+					key: "10.0.0.1:5000-10.0.0.2:6000-UDP",
+					src: "10.0.0.1", srcPort: 5000, dst: "10.0.0.2", dstPort: 6000,
+					method:      InitiatorFirstPacket,
+					clientBytes: 2 * 92, clientPackets: 2,
+					serverBytes: 122, serverPackets: 1,
+					first: 0, last: 200 * time.Millisecond,
+					endReason: EndIdle,
+				},
+				{
+					key: "10.0.0.2:6000-10.0.0.3:5001-UDP",
+					src: "10.0.0.3", srcPort: 5001, dst: "10.0.0.2", dstPort: 6000,
+					method:      InitiatorFirstPacket,
+					clientBytes: 60, clientPackets: 1,
+					first: 70 * time.Second, last: 70 * time.Second,
+					endReason: EndShutdown,
+				},
+			},
+			bytes:   2*92 + 122 + 60,
+			packets: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/workers=%d", tt.name, workers), func(t *testing.T) {
+				result := replay(t, tt.file, Options{Workers: workers})
+				connections := result.connections()
+
+				for _, want := range tt.flows {
+					flow := result.expired[want.key]
+					if flow == nil {
+						t.Errorf("flow %s was never expired", want.key)
+						continue
+					}
+					if flow.EndReason != want.endReason {
+						t.Errorf("%s ended with %q, want %q", want.key, flow.EndReason, want.endReason)
+					}
+					if stored, ok := connections[want.key]; ok == (want.endReason != EndShutdown) {
+						t.Errorf("%s in storage = %v, want %v", want.key, ok, !ok)
+					} else if ok {
+						// What was pushed at the last tick matches the final record
+						flow = stored
+					}
+
+					if flow.SrcIP != want.src || flow.SrcPort != want.srcPort || flow.DstIP != want.dst || flow.DstPort != want.dstPort {
+						t.Errorf("%s oriented %s:%d → %s:%d, want %s:%d → %s:%d", want.key,
+							flow.SrcIP, flow.SrcPort, flow.DstIP, flow.DstPort, want.src, want.srcPort, want.dst, want.dstPort)
+					}
+					if flow.InitiatorMethod != want.method {
+						t.Errorf("%s initiator method %q, want %q", want.key, flow.InitiatorMethod, want.method)
+					}
+					if flow.ClientBytes != want.clientBytes || flow.ClientPackets != want.clientPackets ||
+						flow.ServerBytes != want.serverBytes || flow.ServerPackets != want.serverPackets {
+						t.Errorf("%s counters client %d/%d server %d/%d, want client %d/%d server %d/%d", want.key,
+							flow.ClientBytes, flow.ClientPackets, flow.ServerBytes, flow.ServerPackets,
+							want.clientBytes, want.clientPackets, want.serverBytes, want.serverPackets)
+					}
+					if start := testdataStart.Add(want.first); !flow.StartTime.Equal(start) {
+						t.Errorf("%s started at %v, want %v", want.key, flow.StartTime, start)
+					}
+					if last := testdataStart.Add(want.last); !flow.LastSeen.Equal(last) {
+						t.Errorf("%s last seen at %v, want %v", want.key, flow.LastSeen, last)
+					}
+					if flow.Bytes != want.clientBytes+want.serverBytes || flow.Packets != want.clientPackets+want.serverPackets {
+						t.Errorf("%s totals %d/%d don't add up", want.key, flow.Bytes, flow.Packets)
+					}
+				}
+				if len(result.expired) != len(tt.flows) {
+					t.Errorf("%d flows expired, want %d", len(result.expired), len(tt.flows))
+				}
+
+				snapshot := result.storage.GetSnapshot(result.iface)
+				if snapshot.Interface == nil {
+					t.Fatalf("no interface stats")
+				}
+				stats := snapshot.Interface
+				if bytes := stats.InBytes + stats.OutBytes; bytes != tt.bytes {
+					t.Errorf("interface bytes %d, want %d", bytes, tt.bytes)
+				}
+				if packets := stats.InPackets + stats.OutPackets; packets != tt.packets {
+					t.Errorf("interface packets %d, want %d", packets, tt.packets)
+				}
+
+				captureStats := result.storage.GetCaptureStats(result.iface)
+				if len(captureStats) != 1 || captureStats[0].PacketsProcessed != tt.packets {
+					t.Errorf("capture stats %+v, want %d packets processed", captureStats, tt.packets)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// Sampling methods
+const (
+	SamplingNone   = "none"   // every packet
+	SamplingCount  = "count"  // every Nth packet
+	SamplingRandom = "random" // each packet with probability 1/N
+)
+
+// SamplingOptions trades accuracy for throughput on links too fast to
+// process in full. Only the sampled packets are decoded and each of them is
+// counted as Rate packets, so the traffic counters become estimates.
+type SamplingOptions struct {
+	Mode string
+	// Rate is N, the number of packets each sampled one stands for
+	Rate uint64
+}
+
+// DefaultSamplingOptions returns no sampling
+func DefaultSamplingOptions() SamplingOptions {
+	return SamplingOptions{
+		Mode: SamplingNone,
+		Rate: 1,
+	}
+}
+
+// Validate checks the sampling method and rate
+func (o SamplingOptions) Validate() error {
+	switch o.Mode {
+	case "", SamplingNone:
+		return nil
+	case SamplingCount, SamplingRandom:
+	default:
+		return fmt.Errorf("unknown sampling method %q", o.Mode)
+	}
+	if o.Rate < 1 {
+		return fmt.Errorf("sampling rate must be at least 1, got %d", o.Rate)
+	}
+	return nil
+}
+
+// enabled tells whether packets are actually skipped
+func (o SamplingOptions) enabled() bool {
+	return (o.Mode == SamplingCount || o.Mode == SamplingRandom) && o.Rate > 1
+}
+
+// weight is the number of packets a processed one accounts for
+func (o SamplingOptions) weight() uint64 {
+	if !o.enabled() {
+		return 1
+	}
+	return o.Rate
+}
+
+// sampler picks the packets to process. It is used by a single goroutine.
+type sampler struct {
+	opts  SamplingOptions
+	seen  uint64 // packets offered, sampled or not
+	state uint64 // xorshift state for random sampling
+}
+
+func newSampler(opts SamplingOptions) *sampler {
+	return &sampler{opts: opts, state: rand.Uint64() | 1}
+}
+
+// keep tells whether the next packet is to be processed
+func (s *sampler) keep() bool {
+	s.seen++
+	if !s.opts.enabled() {
+		return true
+	}
+	if s.opts.Mode == SamplingCount {
+		return s.seen%s.opts.Rate == 0
+	}
+	s.state ^= s.state << 13
+	s.state ^= s.state >> 7
+	s.state ^= s.state << 17
+	return s.state%s.opts.Rate == 0
+}
+
+// seenUnsampled tells whether a frame is looked at even if it isn't sampled:
+// ARP and NDP, so the neighbor table stays complete, and IP fragments, which
+// are sampled once reassembled rather than one by one.
+func seenUnsampled(data []byte, linkType layers.LinkType) bool {
+	etherType, ip := networkHeader(data, linkType)
+	switch etherType {
+	case layers.EthernetTypeARP:
+		return true
+	case layers.EthernetTypeIPv4:
+		return len(ip) >= 20 && binary.BigEndian.Uint16(ip[6:])&0x3fff != 0
+	case layers.EthernetTypeIPv6:
+		if len(ip) < 40 {
+			return false
+		}
+		next, rest := layers.IPProtocol(ip[6]), ip[40:]
+		for {
+			switch next {
+			case layers.IPProtocolIPv6Fragment:
+				return true
+			case layers.IPProtocolICMPv6:
+				// Router and neighbor solicitations and advertisements
+				return len(rest) > 0 && rest[0] >= layers.ICMPv6TypeRouterSolicitation && rest[0] <= layers.ICMPv6TypeNeighborAdvertisement
+			case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+				if len(rest) < 2 || len(rest) < (int(rest[1])+1)*8 {
+					return false
+				}
+				next, rest = layers.IPProtocol(rest[0]), rest[(int(rest[1])+1)*8:]
+			default:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// markSampled records the sampling rate of counters extrapolated from one
+// packet in rate, and their error
+func markSampled(stats *models.InterfaceStats, rate uint64) {
+	stats.SamplingRate = rate
+	stats.EstimatedError = samplingError((stats.InPackets + stats.OutPackets) / rate)
+}
+
+// samplingError is the relative error, at 95% confidence, of a packet or byte
+// total extrapolated from samples sampled packets: 196·√(1/samples) percent,
+// the usual rule of thumb for sFlow. Byte totals are only as good if packet
+// sizes don't vary much within what is being counted. Nothing sampled is
+// taken as one sample rather than an infinite error, which JSON can't hold.
+func samplingError(samples uint64) float64 {
+	return 1.96 * math.Sqrt(1/float64(max(samples, 1)))
+}
@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/storage"
+)
+
+// fragments splits a UDP datagram into two IPv4 fragments
+func fragments(t *testing.T, src, dst net.IP, id uint16, payload []byte) [][]byte {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	datagram := buf.Bytes()
+	first := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst,
+		Id: id, Flags: layers.IPv4MoreFragments}
+	last := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst,
+		Id: id, FragOffset: 2}
+	return [][]byte{
+		ipFrame(t, first, gopacket.Payload(datagram[:16])),
+		ipFrame(t, last, gopacket.Payload(datagram[16:])),
+	}
+}
+
+func arpReply(t *testing.T, mac net.HardwareAddr, ip net.IP) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP}
+	arp := &layers.ARP{
+		AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+		HwAddressSize: 6, ProtAddressSize: 4, Operation: layers.ARPReply,
+		SourceHwAddress: mac, SourceProtAddress: ip.To4(),
+		DstHwAddress: layers.EthernetBroadcast, DstProtAddress: ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, arp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSamplingAfterReassembly(t *testing.T) {
+	s := testShard()
+	s.pc.neighbors = newNeighborTable(s.pc.iface)
+	s.pc.opts.Sampling = SamplingOptions{Mode: SamplingCount, Rate: 4}
+	s = newShard(s.pc, layers.LinkTypeEthernet)
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var frames [][]byte
+	for i := 0; i < 8; i++ {
+		frames = append(frames, fragments(t, net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 20), uint16(i), make([]byte, 40))...)
+	}
+	for i := 0; i < 3; i++ {
+		frames = append(frames, arpReply(t, net.HardwareAddr{2, 0, 0, 0, 1, byte(i)}, net.IPv4(192, 168, 1, byte(100+i))))
+	}
+	for i, frame := range frames {
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		s.processFrame(frame, gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(frame), Length: len(frame)})
+	}
+	s.defrag.expire(start.Add(time.Hour))
+
+	if s.defrag.reassembled != 8 || s.defrag.dropped != 0 {
+		t.Errorf("%d datagrams reassembled, %d fragments dropped", s.defrag.reassembled, s.defrag.dropped)
+	}
+	// Two of the eight datagrams sampled, each standing for four
+	if len(s.flows.flows) != 1 {
+		t.Fatalf("%d flows", len(s.flows.flows))
+	}
+	for _, entry := range s.flows.flows {
+		if entry.flow.Packets != 2*2*4 {
+			t.Errorf("%d packets accounted, want %d", entry.flow.Packets, 2*2*4)
+		}
+	}
+	// One frame in four counts towards the interface
+	if packets := s.stats.InPackets + s.stats.OutPackets; packets != uint64(len(frames)/4*4) {
+		t.Errorf("%d packets on the interface, want %d", packets, len(frames)/4*4)
+	}
+	if neighbors, _ := s.pc.neighbors.snapshot(); len(neighbors) != 3 {
+		t.Errorf("%d neighbors, want 3", len(neighbors))
+	}
+}
+
+func TestSamplingSkipsStreams(t *testing.T) {
+	s := testShard()
+	s.pc.opts.Sampling = SamplingOptions{Mode: SamplingCount, Rate: 2}
+	s = newShard(s.pc, layers.LinkTypeEthernet)
+
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	conn := tcpConn{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 20), 51000, 80}
+	frames := [][]byte{
+		conn.frame(t, false, 100, 0, true, false, ""),
+		conn.frame(t, true, 500, 101, true, false, ""),
+		conn.frame(t, false, 101, 501, false, false, ""),
+		conn.frame(t, false, 101, 501, false, false, request),
+	}
+	for i, frame := range frames {
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		s.processFrame(frame, gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(frame), Length: len(frame)})
+	}
+
+	if len(s.flows.flows) != 1 {
+		t.Fatalf("%d flows", len(s.flows.flows))
+	}
+	for _, entry := range s.flows.flows {
+		if entry.flow.TCP != nil || entry.flow.Packets != 4 || entry.flow.SamplingRate != 2 {
+			t.Errorf("flow %+v, TCP metrics %+v", entry.flow, entry.flow.TCP)
+		}
+	}
+	if len(s.http.conversations) != 0 {
+		t.Errorf("%d HTTP conversations followed", len(s.http.conversations))
+	}
+
+	// The interface counters say they are estimates
+	s.pc.shards = []*shard{s}
+	s.pc.neighbors = newNeighborTable(s.pc.iface)
+	store := storage.NewMemoryStorage()
+	s.pc.flush(store, start.Add(time.Second), time.Second)
+	stats := store.GetSnapshot("").Interface
+	if stats == nil || stats.SamplingRate != 2 || stats.EstimatedError != samplingError(2) {
+		t.Errorf("interface stats %+v", stats)
+	}
+}
@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// shard is the accounting state of one worker. Frames are spread over the
+// shards by flow and only the interface-wide counters need merging. ICMP
+// errors are handed to the other shards to be linked to the flow they quote.
+// When the reader spreads the frames, QUIC packets go to the shard of their
+// connection ID so migrations are followed; with AF_PACKET fanout the kernel
+// spreads frames by address and migrations are only followed within a shard.
+type shard struct {
+	pc *PacketCapture // configuration and the state shared by the shards
+
+	linkType layers.LinkType
+	weight   uint64 // packets each processed one accounts for
+	decoder  *frameDecoder
+	stats    *models.InterfaceStats
+	vlans    *vlanCounters
+	macs     *macCounters
+	defrag   *defragmenter
+	flows    *flowTable
+	dns      *dnsTracker
+	http     *httpTracker
+	counters captureCounters
+
+	// sampler picks the frames to process, and datagrams the reassembled
+	// datagrams, whose fragments are all looked at
+	sampler, datagrams *sampler
+}
+
+func newShard(pc *PacketCapture, linkType layers.LinkType) *shard {
+	return &shard{
+		pc:       pc,
+		linkType: linkType,
+		weight:   pc.opts.Sampling.weight(),
+		decoder:  newFrameDecoder(),
+		stats:    &models.InterfaceStats{Interface: pc.iface},
+		vlans:    newVLANCounters(pc.iface),
+		macs:     newMACCounters(pc.iface),
+		defrag:   newDefragmenter(pc.opts.Fragments),
+		flows:    newFlowTable(pc.iface, pc.opts.Rates, pc.opts.Flows),
+		dns:      newDNSTracker(pc.iface, pc.hostnames),
+		http:     newHTTPTracker(pc.iface),
+
+		sampler:   newSampler(pc.opts.Sampling),
+		datagrams: newSampler(pc.opts.Sampling),
+	}
+}
+
+// shardSample is a copy of the counters of a shard at a tick, taken before
+// the per-second ones were reset, to be merged with the other shards
+type shardSample struct {
+	stats    models.InterfaceStats
+	vlans    []*models.VLANStats
+	tagged   bool
+	macs     []*models.MACStats
+	counters captureCounters
+	seen     uint64 // frames offered to the sampler
+
+	reassembled      uint64
+	fragmentsDropped uint64
+	fragmentsPending int
+}
+
+// flush computes the rates over interval, expires stale state as of now and
+// pushes the shard's flows, DNS queries and HTTP requests to storage. It
+// returns a sample of the counters and resets the per-second ones.
+func (s *shard) flush(storage Storage, now time.Time, interval time.Duration) shardSample {
+	if s.flows.links != nil {
+		for _, link := range s.flows.links.take(s.flows.shard) {
+			s.flows.linkICMPError(link.key, link.description)
+		}
+	}
+	s.flows.tick(interval)
+	s.flows.expireStale(now)
+	s.defrag.expire(now)
+	s.dns.expire(now)
+	s.http.flush(now, now.Add(-s.flows.opts.IdleTimeout))
+	s.attributeProcesses()
+	s.annotateDomains(now)
+
+	for _, entry := range s.flows.flows {
+		storage.UpdateFlow(entry.flow)
+	}
+	expired := s.flows.takeExpired()
+	for _, flow := range expired {
+		// Active timeout exports are records of flows that carry on
+		if flow.EndReason != EndActiveTimeout {
+			storage.RemoveFlow(flow)
+		}
+	}
+	s.pc.notifyExpired(expired)
+	if queries := s.dns.take(); len(queries) > 0 {
+		storage.AddDNSQueries(queries)
+	}
+	if requests := s.http.take(); len(requests) > 0 {
+		storage.AddHTTPRequests(requests)
+	}
+
+	sample := shardSample{
+		stats:    *s.stats,
+		tagged:   s.vlans.tagged,
+		counters: s.counters,
+		seen:     s.sampler.seen,
+
+		reassembled:      s.defrag.reassembled,
+		fragmentsDropped: s.defrag.dropped,
+		fragmentsPending: s.defrag.size,
+	}
+	for _, stats := range s.vlans.stats {
+		vlanCopy := *stats
+		sample.vlans = append(sample.vlans, &vlanCopy)
+	}
+	for _, stats := range s.macs.stats {
+		macCopy := *stats
+		macCopy.EtherTypes = make(map[string]uint64, len(stats.EtherTypes))
+		for name, count := range stats.EtherTypes {
+			macCopy.EtherTypes[name] = count
+		}
+		sample.macs = append(sample.macs, &macCopy)
+	}
+
+	// Reset per-second counters
+	resetRates(s.stats)
+	s.vlans.resetRates()
+	s.macs.resetRates()
+	return sample
+}
@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Capture backends
+const (
+	BackendPcap     = "pcap"     // libpcap, on any platform
+	BackendAFPacket = "afpacket" // memory-mapped AF_PACKET TPACKET_V3 ring, Linux only
+)
+
+// sourceReadTimeout bounds how long a read waits for a packet, so the capture
+// loop gets to flush and notice cancellation on an idle link
+const sourceReadTimeout = 100 * time.Millisecond
+
+// errReadTimeout is returned by packet sources when no packet arrived within
+// sourceReadTimeout
+var errReadTimeout = errors.New("packet read timed out")
+
+// BackendOptions selects how packets are read off live interfaces. The ring
+// settings only apply to the AF_PACKET backend; replays always use libpcap.
+type BackendOptions struct {
+	// Type is BackendPcap or BackendAFPacket
+	Type string
+	// FrameSize is the ring's frame size; it must hold the largest frame
+	// including the TPACKET headers
+	FrameSize int
+	// BlockSize is the size of one ring block, a multiple of both the frame
+	// size and the page size
+	BlockSize int
+	// NumBlocks is the number of blocks in the ring
+	NumBlocks int
+	// BlockTimeout hands a partially filled block to us after this long
+	BlockTimeout time.Duration
+}
+
+// DefaultBackendOptions returns libpcap with a 64MB ring for AF_PACKET
+func DefaultBackendOptions() BackendOptions {
+	return BackendOptions{
+		Type:         BackendPcap,
+		FrameSize:    4096,
+		BlockSize:    1 << 20,
+		NumBlocks:    64,
+		BlockTimeout: 10 * time.Millisecond,
+	}
+}
+
+// Validate checks the backend type and ring geometry
+func (o BackendOptions) Validate() error {
+	switch o.Type {
+	case BackendPcap:
+		return nil
+	case BackendAFPacket:
+	default:
+		return fmt.Errorf("unknown capture backend %q", o.Type)
+	}
+	if o.FrameSize <= 0 {
+		return fmt.Errorf("ring frame size must be positive, got %d", o.FrameSize)
+	}
+	if o.BlockSize <= 0 || o.BlockSize%o.FrameSize != 0 || o.BlockSize%os.Getpagesize() != 0 {
+		return fmt.Errorf("ring block size must be a multiple of the frame size %d and the page size %d, got %d",
+			o.FrameSize, os.Getpagesize(), o.BlockSize)
+	}
+	if o.NumBlocks <= 0 {
+		return fmt.Errorf("ring block count must be positive, got %d", o.NumBlocks)
+	}
+	if o.BlockTimeout < time.Millisecond {
+		return fmt.Errorf("ring block timeout must be at least 1ms, got %v", o.BlockTimeout)
+	}
+	return nil
+}
+
+// sourceStats are the kernel's packet counters of a source
+type sourceStats struct {
+	received  uint64
+	dropped   uint64 // dropped for lack of buffer space
+	ifDropped uint64 // dropped by the interface or driver
+}
+
+// packetSource is a capture backend. Reads are zero-copy: the returned data
+// is only valid until the next read, and a source is only read by one
+// goroutine.
+type packetSource interface {
+	// readPacket returns the next frame, errReadTimeout if none arrived in
+	// time or io.EOF once the source is exhausted
+	readPacket() ([]byte, gopacket.CaptureInfo, error)
+	linkType() layers.LinkType
+	// setFilter applies a BPF expression; empty captures everything
+	setFilter(expr string) error
+	// stats returns the kernel counters; not supported by files
+	stats() (sourceStats, error)
+	close()
+}
+
+// openSources opens a live capture on iface with the configured backend.
+// For more than one worker, AF_PACKET opens a socket per worker in a fanout
+// group so that the kernel spreads the flows over them; libpcap has a single
+// source whose frames we spread ourselves.
+func openSources(iface string, opts BackendOptions, workers int) ([]packetSource, error) {
+	if opts.Type == BackendAFPacket {
+		return openAFPacket(iface, opts, max(workers, 1))
+	}
+	handle, err := pcap.OpenLive(iface, snapLen, true, sourceReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return []packetSource{&pcapSource{handle: handle}}, nil
+}
+
+// pcapSource reads from a libpcap handle, live or offline
+type pcapSource struct {
+	handle *pcap.Handle
+}
+
+func (s *pcapSource) readPacket() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.handle.ZeroCopyReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		return nil, ci, errReadTimeout
+	}
+	if err == pcap.NextErrorNoMorePackets {
+		return nil, ci, io.EOF
+	}
+	return data, ci, err
+}
+
+func (s *pcapSource) linkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *pcapSource) setFilter(expr string) error {
+	return s.handle.SetBPFFilter(expr)
+}
+
+func (s *pcapSource) stats() (sourceStats, error) {
+	pcapStats, err := s.handle.Stats()
+	if err != nil {
+		return sourceStats{}, err
+	}
+	return sourceStats{
+		received:  uint64(pcapStats.PacketsReceived),
+		dropped:   uint64(pcapStats.PacketsDropped),
+		ifDropped: uint64(pcapStats.PacketsIfDropped),
+	}, nil
+}
+
+func (s *pcapSource) close() {
+	s.handle.Close()
+}
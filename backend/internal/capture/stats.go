@@ -0,0 +1,62 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// captureCounters are the packet counts kept by the pipeline itself, as
+// opposed to the ones reported by the kernel
+type captureCounters struct {
+	received       uint64
+	decoderDropped uint64
+}
+
+// captureStats combines the kernel counters with those of the shards at the
+// tick now, which is packet time for replays. Offline handles don't support
+// pcap_stats, so only our counters are filled in for replays.
+func (pc *PacketCapture) captureStats(samples []shardSample, now time.Time) *models.CaptureStats {
+	stats := &models.CaptureStats{
+		Interface: pc.iface,
+		Timestamp: now,
+	}
+	for _, sample := range samples {
+		stats.PacketsProcessed += sample.counters.received
+		stats.DecoderDropped += sample.counters.decoderDropped
+		stats.DatagramsReassembled += sample.reassembled
+		stats.FragmentsDropped += sample.fragmentsDropped
+		stats.FragmentsPending += sample.fragmentsPending
+	}
+	if pc.pool != nil {
+		stats.Backlog = pc.pool.backlog()
+	}
+	if sampling := pc.opts.Sampling; sampling.enabled() {
+		stats.Sampling = sampling.Mode
+		stats.SamplingRate = sampling.Rate
+		stats.EstimatedError = samplingError(stats.PacketsProcessed)
+	}
+
+	if pc.replay == nil {
+		// With fanout every socket counts its own share
+		for _, source := range pc.sources {
+			if sourceStats, err := source.stats(); err == nil {
+				stats.PacketsReceived += sourceStats.received
+				stats.PacketsDropped += sourceStats.dropped
+				stats.PacketsIfDropped += sourceStats.ifDropped
+			}
+		}
+	} else {
+		// Every frame read was offered to the sampler of a shard
+		for _, sample := range samples {
+			stats.PacketsReceived += sample.seen
+		}
+	}
+
+	// Flag the sample if anything was lost since the previous tick
+	dropped := stats.PacketsDropped + stats.PacketsIfDropped + stats.DecoderDropped + stats.FragmentsDropped
+	stats.Lossy = dropped > pc.lastDropped
+	pc.lastDropped = dropped
+
+	return stats
+}
@@ -0,0 +1,164 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// defaultReorderWindow separates reordering from retransmission when the
+// handshake RTT is unknown: a segment below the highest sequence number that
+// shows up this soon after it is counted as out of order
+const defaultReorderWindow = 3 * time.Millisecond
+
+// tcpDirection is the sequence/ack state of one side of a TCP session
+type tcpDirection struct {
+	seqValid    bool
+	nextSeq     uint32    // highest sequence number sent plus one
+	lastAdvance time.Time // when nextSeq last moved forward
+
+	ackValid   bool
+	lastAck    uint32
+	lastWindow uint16
+	zeroWindow bool // currently advertising a zero window
+}
+
+// tcpTracker follows a TCP session to derive health metrics
+type tcpTracker struct {
+	synTime    time.Time
+	synAckTime time.Time
+	rtt        time.Duration
+	dirs       [2]tcpDirection // client → server, server → client
+}
+
+// seqAfter reports whether a comes after b, allowing for wraparound
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// trackHealth updates the TCP metrics of the flow from a packet
+func (e *flowEntry) trackHealth(info *packetInfo, fromClient bool) {
+	tcp := info.tcp
+	if tcp == nil {
+		return
+	}
+	if e.tcp == nil {
+		e.tcp = &tcpTracker{}
+		e.flow.TCP = &models.TCPMetrics{}
+	}
+	metrics := e.flow.TCP
+	ts := info.timestamp
+
+	e.tcp.trackHandshake(tcp, fromClient, ts, metrics)
+
+	if tcp.RST {
+		metrics.Resets++
+		return
+	}
+
+	dir := &e.tcp.dirs[1]
+	if fromClient {
+		dir = &e.tcp.dirs[0]
+	}
+
+	// Sequence space consumed by this segment; SYN and FIN count as one
+	segLen := uint32(len(tcp.Payload))
+	if tcp.SYN {
+		segLen++
+	}
+	if tcp.FIN {
+		segLen++
+	}
+
+	if segLen > 0 {
+		if len(tcp.Payload) > 0 {
+			metrics.DataSegments++
+		}
+		e.tcp.trackSequence(dir, tcp.Seq, segLen, ts, metrics)
+	} else if tcp.ACK {
+		// Same ACK and window again without data is a duplicate ACK
+		if dir.ackValid && tcp.Ack == dir.lastAck && tcp.Window == dir.lastWindow && !tcp.SYN {
+			metrics.DuplicateAcks++
+		}
+	}
+
+	if tcp.ACK {
+		dir.ackValid = true
+		dir.lastAck = tcp.Ack
+		dir.lastWindow = tcp.Window
+	}
+
+	// Count transitions into a zero window, not every probe while it lasts
+	if !tcp.SYN {
+		zero := tcp.Window == 0
+		if zero && !dir.zeroWindow {
+			metrics.ZeroWindows++
+		}
+		dir.zeroWindow = zero
+	}
+
+	if metrics.DataSegments > 0 {
+		metrics.RetransmitRate = float64(metrics.Retransmissions) / float64(metrics.DataSegments)
+	}
+}
+
+// trackHandshake times SYN → SYN/ACK → ACK
+func (t *tcpTracker) trackHandshake(tcp *layers.TCP, fromClient bool, ts time.Time, metrics *models.TCPMetrics) {
+	switch {
+	case tcp.SYN && !tcp.ACK && fromClient:
+		if t.synTime.IsZero() {
+			t.synTime = ts
+		}
+	case tcp.SYN && tcp.ACK && !fromClient:
+		if !t.synTime.IsZero() && t.synAckTime.IsZero() {
+			t.synAckTime = ts
+			metrics.ServerRTTMs = durationMs(ts.Sub(t.synTime))
+		}
+	case !tcp.SYN && tcp.ACK && fromClient:
+		if !t.synAckTime.IsZero() && t.rtt == 0 {
+			t.rtt = ts.Sub(t.synTime)
+			metrics.ClientRTTMs = durationMs(ts.Sub(t.synAckTime))
+			metrics.HandshakeRTTMs = durationMs(t.rtt)
+		}
+	}
+}
+
+// trackSequence classifies a segment as in order, retransmitted or out of
+// order, using the same timing heuristic as Wireshark
+func (t *tcpTracker) trackSequence(dir *tcpDirection, seq, segLen uint32, ts time.Time, metrics *models.TCPMetrics) {
+	end := seq + segLen
+	if !dir.seqValid {
+		dir.seqValid = true
+		dir.nextSeq = end
+		dir.lastAdvance = ts
+		return
+	}
+
+	if !seqAfter(dir.nextSeq, seq) {
+		// At or beyond the expected sequence number: new data, possibly
+		// after a gap we didn't see
+		dir.nextSeq = end
+		dir.lastAdvance = ts
+		return
+	}
+
+	// Below the highest sequence number: either reordering or a resend
+	window := t.rtt
+	if window == 0 {
+		window = defaultReorderWindow
+	}
+	if ts.Sub(dir.lastAdvance) < window {
+		metrics.OutOfOrder++
+	} else {
+		metrics.Retransmissions++
+	}
+	if seqAfter(end, dir.nextSeq) {
+		dir.nextSeq = end
+		dir.lastAdvance = ts
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// segment is a TCP segment seen at some offset into the session
+type segment struct {
+	at       time.Duration
+	client   bool // sent by the client
+	syn, ack bool
+	rst      bool
+	seq      uint32
+	ackNum   uint32
+	data     int    // payload length
+	window   uint16 // 65535 unless set or zero
+	zero     bool   // advertises a zero window
+}
+
+// handshake is SYN → SYN/ACK → ACK with the client at 100 and the server at
+// 500, taking 10ms on the server side and 5ms on the client side
+var handshake = []segment{
+	{at: 0, client: true, syn: true, seq: 100},
+	{at: 10 * time.Millisecond, syn: true, ack: true, seq: 500, ackNum: 101},
+	{at: 15 * time.Millisecond, client: true, ack: true, seq: 101, ackNum: 501},
+}
+
+func TestTCPHealth(t *testing.T) {
+	ms := time.Millisecond
+	after := func(segments ...segment) []segment {
+		return append(append([]segment(nil), handshake...), segments...)
+	}
+	rtt := models.TCPMetrics{HandshakeRTTMs: 15, ServerRTTMs: 10, ClientRTTMs: 5}
+	with := func(m models.TCPMetrics) models.TCPMetrics {
+		m.HandshakeRTTMs, m.ServerRTTMs, m.ClientRTTMs = rtt.HandshakeRTTMs, rtt.ServerRTTMs, rtt.ClientRTTMs
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		segments []segment
+		want     models.TCPMetrics
+	}{
+		{name: "handshake", segments: handshake, want: rtt},
+		{
+			name: "retransmission after the handshake RTT",
+			segments: after(
+				segment{at: 20 * ms, client: true, ack: true, seq: 101, ackNum: 501, data: 100},
+				segment{at: 21 * ms, client: true, ack: true, seq: 201, ackNum: 501, data: 100},
+				segment{at: 100 * ms, client: true, ack: true, seq: 101, ackNum: 501, data: 100},
+			),
+			want: with(models.TCPMetrics{DataSegments: 3, Retransmissions: 1, RetransmitRate: 1.0 / 3}),
+		},
+		{
+			name: "out of order within the handshake RTT",
+			segments: after(
+				segment{at: 20 * ms, client: true, ack: true, seq: 201, ackNum: 501, data: 100},
+				segment{at: 22 * ms, client: true, ack: true, seq: 101, ackNum: 501, data: 100},
+			),
+			want: with(models.TCPMetrics{DataSegments: 2, OutOfOrder: 1}),
+		},
+		{
+			name: "reorder window without a handshake",
+			segments: []segment{
+				{at: 0, client: true, ack: true, seq: 1100, ackNum: 1, data: 100},
+				{at: 1 * ms, client: true, ack: true, seq: 1000, ackNum: 1, data: 100},
+				{at: 10 * ms, client: true, ack: true, seq: 1000, ackNum: 1, data: 100},
+			},
+			want: models.TCPMetrics{DataSegments: 3, OutOfOrder: 1, Retransmissions: 1, RetransmitRate: 1.0 / 3},
+		},
+		{
+			name: "duplicate ACKs",
+			segments: after(
+				segment{at: 20 * ms, ack: true, seq: 501, ackNum: 201},
+				segment{at: 21 * ms, ack: true, seq: 501, ackNum: 201},
+				segment{at: 22 * ms, ack: true, seq: 501, ackNum: 201},
+				// A window update isn't a duplicate, nor is data
+				segment{at: 23 * ms, ack: true, seq: 501, ackNum: 201, window: 32768},
+				segment{at: 24 * ms, ack: true, seq: 501, ackNum: 201, window: 32768, data: 10},
+			),
+			want: with(models.TCPMetrics{DuplicateAcks: 2, DataSegments: 1}),
+		},
+		{
+			name: "zero window opening and closing",
+			segments: after(
+				segment{at: 20 * ms, ack: true, seq: 501, ackNum: 201, zero: true},
+				segment{at: 30 * ms, ack: true, seq: 501, ackNum: 201, zero: true},
+				segment{at: 40 * ms, ack: true, seq: 501, ackNum: 201},
+				segment{at: 50 * ms, ack: true, seq: 501, ackNum: 301, zero: true},
+			),
+			// The second zero window repeats the first, so it's a duplicate
+			// ACK but not a new zero window
+			want: with(models.TCPMetrics{ZeroWindows: 2, DuplicateAcks: 1}),
+		},
+		{
+			name:     "reset",
+			segments: after(segment{at: 20 * ms, rst: true, seq: 501}),
+			want:     with(models.TCPMetrics{Resets: 1}),
+		},
+	}
+	for _, tt := range tests {
+		e := &flowEntry{flow: &models.Flow{}}
+		start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		for _, s := range tt.segments {
+			tcp := &layers.TCP{SYN: s.syn, ACK: s.ack, RST: s.rst, Seq: s.seq, Ack: s.ackNum, Window: s.window}
+			if tcp.Window == 0 && !s.zero {
+				tcp.Window = 65535
+			}
+			tcp.Payload = make([]byte, s.data)
+			e.trackHealth(&packetInfo{tcp: tcp, timestamp: start.Add(s.at)}, s.client)
+		}
+		if got := *e.flow.TCP; got != tt.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package capture
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// maxTLSBuffer bounds the handshake bytes buffered per direction; a
+// certificate chain rarely needs more
+const maxTLSBuffer = 32 * 1024
+
+// TLS record and handshake message types
+const (
+	tlsRecordHandshake = 0x16
+
+	tlsClientHello     = 0x01
+	tlsServerHello     = 0x02
+	tlsCertificate     = 0x0b
+	tlsServerHelloDone = 0x0e
+)
+
+// TLS extensions we read
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// tlsTracker follows the clear text part of a TLS handshake. Each direction
+// is split into records and messages as segments arrive in sequence order.
+type tlsTracker struct {
+	client, server tlsStream
+}
+
+// tlsStream is one direction of the handshake
+type tlsStream struct {
+	records   []byte // received, not yet split into records
+	handshake []byte // handshake record payloads, not yet split into messages
+	taken     int    // bytes received so far
+	nextSeq   uint32
+	started   bool
+	done      bool // parsed what we wanted, or gave up
+}
+
+// add appends a segment, reporting false when the stream can't be followed:
+// a gap in the sequence space or too much data
+func (s *tlsStream) add(seq uint32, payload []byte) bool {
+	if !s.started {
+		s.started, s.nextSeq = true, seq
+	}
+	if seq != s.nextSeq {
+		// Retransmissions are harmless, gaps would corrupt the records
+		return !seqAfter(seq, s.nextSeq)
+	}
+	if s.taken+len(payload) > maxTLSBuffer {
+		return false
+	}
+	s.records = append(s.records, payload...)
+	s.taken += len(payload)
+	s.nextSeq += uint32(len(payload))
+	return true
+}
+
+// messages splits off the handshake messages (type, 3 byte length, body)
+// completed since the last call. end reports that the clear text part is
+// over: a record of another type followed.
+func (s *tlsStream) messages() (messages [][]byte, end bool) {
+	for len(s.records) >= 5 {
+		if s.records[0] != tlsRecordHandshake {
+			end = true
+			break
+		}
+		length := int(s.records[3])<<8 | int(s.records[4])
+		if len(s.records) < 5+length {
+			break
+		}
+		s.handshake = append(s.handshake, s.records[5:5+length]...)
+		s.records = s.records[5+length:]
+	}
+
+	for len(s.handshake) >= 4 {
+		length := int(s.handshake[1])<<16 | int(s.handshake[2])<<8 | int(s.handshake[3])
+		if len(s.handshake) < 4+length {
+			break
+		}
+		messages = append(messages, s.handshake[:4+length])
+		s.handshake = s.handshake[4+length:]
+	}
+	return messages, end
+}
+
+func (s *tlsStream) finish() {
+	s.done, s.records, s.handshake = true, nil, nil
+}
+
+// inspectTLS extracts the SNI, ALPN, version, fingerprints and server
+// certificate from the handshake of a TLS connection
+func (e *flowEntry) inspectTLS(info *packetInfo, fromClient bool) {
+	if info.tcp == nil || len(info.payload) == 0 {
+		return
+	}
+	if e.tls == nil {
+		// Decide on the first payload: connections picked up mid-stream
+		// show no handshake
+		e.tls = &tlsTracker{}
+		if !fromClient || !matchTLS(info.payload, true) || info.payload[5] != tlsClientHello {
+			e.tls.client.finish()
+			e.tls.server.finish()
+		}
+	}
+
+	stream := &e.tls.server
+	if fromClient {
+		stream = &e.tls.client
+	}
+	if stream.done {
+		return
+	}
+	if !stream.add(info.tcp.Seq, info.payload) {
+		stream.finish()
+		return
+	}
+
+	messages, end := stream.messages()
+	for _, msg := range messages {
+		if e.handleHandshake(msg[0], msg[4:]) {
+			stream.finish()
+			return
+		}
+	}
+	if end {
+		stream.finish()
+	}
+}
+
+// handleHandshake applies a handshake message, reporting whether its
+// direction needs no more
+func (e *flowEntry) handleHandshake(typ byte, body []byte) bool {
+	flow := e.flow
+	if flow.TLS == nil {
+		flow.TLS = &models.TLSInfo{}
+	}
+
+	switch typ {
+	case tlsClientHello:
+		if hello, ok := parseClientHello(body); ok {
+			hello.describe(flow.TLS, "t")
+		}
+		return true
+	case tlsServerHello:
+		version, ok := parseServerHello(body, flow.TLS)
+		// The certificate of TLS 1.3 is encrypted
+		return !ok || version >= tls.VersionTLS13
+	case tlsCertificate:
+		flow.TLS.Certificate = parseCertificate(body)
+		return true
+	case tlsServerHelloDone:
+		return true
+	}
+	return false
+}
+
+// tlsReader reads the big-endian fields of a handshake message. Reads past
+// the end yield zeros and set failed.
+type tlsReader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.failed = true
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (r *tlsReader) uint24() int {
+	if b := r.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+// vector reads a length-prefixed field with a length of lenBytes bytes
+func (r *tlsReader) vector(lenBytes int) *tlsReader {
+	var n int
+	switch lenBytes {
+	case 1:
+		n = int(r.uint8())
+	case 2:
+		n = int(r.uint16())
+	default:
+		n = r.uint24()
+	}
+	data := r.bytes(n)
+	return &tlsReader{data: data, failed: r.failed}
+}
+
+func (r *tlsReader) uint16s() []uint16 {
+	var values []uint16
+	for len(r.data) >= 2 {
+		values = append(values, r.uint16())
+	}
+	return values
+}
+
+// clientHello holds the fields of a ClientHello that go into fingerprints
+type clientHello struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+	sigAlgs      []uint16
+	versions     []uint16 // supported_versions
+	sni          string
+	alpn         []string
+}
+
+// parseClientHello parses the body of a ClientHello message
+func parseClientHello(body []byte) (*clientHello, bool) {
+	r := &tlsReader{data: body}
+	hello := &clientHello{version: r.uint16()}
+	r.bytes(32) // random
+	r.vector(1) // session id
+	hello.ciphers = r.vector(2).uint16s()
+	r.vector(1) // compression methods
+	if r.failed {
+		return nil, false
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) >= 4 && !extensions.failed {
+		typ := extensions.uint16()
+		data := extensions.vector(2)
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case extServerName:
+			names := data.vector(2)
+			for len(names.data) > 0 && !names.failed {
+				nameType := names.uint8()
+				name := names.vector(2)
+				if nameType == 0 && !name.failed {
+					hello.sni = strings.ToLower(string(name.data))
+				}
+			}
+		case extALPN:
+			protocols := data.vector(2)
+			for len(protocols.data) > 0 && !protocols.failed {
+				if proto := protocols.vector(1); !proto.failed {
+					hello.alpn = append(hello.alpn, string(proto.data))
+				}
+			}
+		case extSupportedGroups:
+			hello.groups = data.vector(2).uint16s()
+		case extECPointFormats:
+			hello.pointFormats = data.vector(1).data
+		case extSignatureAlgorithms:
+			hello.sigAlgs = data.vector(2).uint16s()
+		case extSupportedVersions:
+			hello.versions = data.vector(1).uint16s()
+		}
+	}
+	return hello, true
+}
+
+// describe fills info from the hello; transport is "t" for TCP and "q" for
+// QUIC in the JA4 fingerprint
+func (h *clientHello) describe(info *models.TLSInfo, transport string) {
+	info.SNI = h.sni
+	info.ALPN = h.alpn
+	info.Version = tls.VersionName(h.maxVersion())
+	info.JA3 = h.ja3()
+	info.JA4 = h.ja4(transport)
+}
+
+// maxVersion is the best version offered, from supported_versions if sent
+func (h *clientHello) maxVersion() uint16 {
+	best := h.version
+	for _, v := range h.versions {
+		if !isGREASE(v) && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// ja3 is the MD5 of version,ciphers,extensions,groups,point formats as
+// decimal lists, GREASE values left out
+func (h *clientHello) ja3() string {
+	formats := make([]uint16, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = uint16(f)
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", h.version, joinDecimal(h.ciphers),
+		joinDecimal(h.extensions), joinDecimal(h.groups), joinDecimal(formats))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 is the JA4 fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1:
+// transport, version, SNI present, cipher and extension counts and ALPN,
+// then truncated hashes of the sorted ciphers and of the sorted extensions
+// with the signature algorithms
+func (h *clientHello) ja4(transport string) string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	sni := "i"
+	if h.sni != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first := h.alpn[0]
+		alpn = first[:1] + first[len(first)-1:]
+	}
+	prefix := fmt.Sprintf("%s%s%s%02d%02d%s", transport, ja4Version(h.maxVersion()), sni,
+		min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	var hashed []uint16
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			hashed = append(hashed, ext)
+		}
+	}
+	extPart := joinHex(sortedValues(hashed))
+	if len(h.sigAlgs) > 0 {
+		extPart += "_" + joinHex(h.sigAlgs)
+	}
+	return prefix + "_" + truncatedHash(joinHex(sortedValues(ciphers)), len(ciphers)) +
+		"_" + truncatedHash(extPart, len(hashed))
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300: // SSL 3.0
+		return "s3"
+	}
+	return "00"
+}
+
+// truncatedHash is the first 12 hex digits of the SHA-256 of s, or zeros if
+// the list it was made from is empty
+func truncatedHash(s string, count int) string {
+	if count == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGREASE reports whether v is one of the reserved 0x?a?a values clients
+// send to keep servers tolerant of unknown values
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func sortedValues(values []uint16) []uint16 {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// joinDecimal joins the non-GREASE values in decimal with dashes, as JA3 does
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range withoutGREASE(values) {
+		parts = append(parts, strconv.FormatUint(uint64(v), 10))
+	}
+	return strings.Join(parts, "-")
+}
+
+// joinHex joins the non-GREASE values as 4 digit hex with commas, as JA4 does
+func joinHex(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range withoutGREASE(values) {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseServerHello records the negotiated version, cipher suite and ALPN
+// protocol, returning the version
+func parseServerHello(body []byte, info *models.TLSInfo) (uint16, bool) {
+	r := &tlsReader{data: body}
+	version := r.uint16()
+	r.bytes(32) // random
+	r.vector(1) // session id
+	cipher := r.uint16()
+	r.uint8() // compression method
+	if r.failed {
+		return 0, false
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) >= 4 && !extensions.failed {
+		typ := extensions.uint16()
+		data := extensions.vector(2)
+		switch typ {
+		case extSupportedVersions:
+			if v := data.uint16(); !data.failed {
+				version = v
+			}
+		case extALPN:
+			if proto := data.vector(2).vector(1); !proto.failed {
+				info.NegotiatedALPN = string(proto.data)
+			}
+		}
+	}
+
+	info.Version = tls.VersionName(version)
+	info.CipherSuite = tls.CipherSuiteName(cipher)
+	return version, true
+}
+
+// parseCertificate reads the leaf of a TLS 1.2 Certificate message
+func parseCertificate(body []byte) *models.CertificateInfo {
+	r := &tlsReader{data: body}
+	leaf := r.vector(3).vector(3)
+	if leaf.failed {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(leaf.data)
+	if err != nil {
+		return nil
+	}
+	return &models.CertificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
@@ -0,0 +1,339 @@
+package capture
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// tlsVector prefixes data with its length in lenBytes bytes
+func tlsVector(lenBytes int, data ...byte) []byte {
+	n := len(data)
+	prefix := []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	return append(prefix[3-lenBytes:], data...)
+}
+
+func tlsUint16s(values ...uint16) []byte {
+	var data []byte
+	for _, v := range values {
+		data = append(data, byte(v>>8), byte(v))
+	}
+	return data
+}
+
+// tlsExtension is an extension of a hello: type and data
+type tlsExtension struct {
+	typ  uint16
+	data []byte
+}
+
+func sniExtension(name string) tlsExtension {
+	entry := append([]byte{0}, tlsVector(2, []byte(name)...)...)
+	return tlsExtension{extServerName, tlsVector(2, entry...)}
+}
+
+func alpnExtension(protocols ...string) tlsExtension {
+	var list []byte
+	for _, p := range protocols {
+		list = append(list, tlsVector(1, []byte(p)...)...)
+	}
+	return tlsExtension{extALPN, tlsVector(2, list...)}
+}
+
+// handshakeRecord wraps a handshake message in a record
+func handshakeRecord(messages ...[]byte) []byte {
+	var data []byte
+	for _, msg := range messages {
+		data = append(data, msg...)
+	}
+	return append([]byte{tlsRecordHandshake, 0x03, 0x01}, tlsVector(2, data...)...)
+}
+
+func handshakeMessage(typ byte, body []byte) []byte {
+	return append([]byte{typ}, tlsVector(3, body...)...)
+}
+
+// clientHelloMessage builds a ClientHello with a zero random and session id
+func clientHelloMessage(version uint16, ciphers []uint16, extensions ...tlsExtension) []byte {
+	body := tlsUint16s(version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, tlsVector(1, make([]byte, 32)...)...)
+	body = append(body, tlsVector(2, tlsUint16s(ciphers...)...)...)
+	body = append(body, tlsVector(1, 0)...)
+	if extensions != nil {
+		var exts []byte
+		for _, ext := range extensions {
+			exts = append(exts, tlsUint16s(ext.typ)...)
+			exts = append(exts, tlsVector(2, ext.data...)...)
+		}
+		body = append(body, tlsVector(2, exts...)...)
+	}
+	return handshakeMessage(tlsClientHello, body)
+}
+
+// chromeHello is a Chrome ClientHello, GREASE values included, whose JA4 is
+// the example of the JA4 specification
+func chromeHello() []byte {
+	return clientHelloMessage(0x0303,
+		[]uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		tlsExtension{0x1a1a, nil},
+		sniExtension("www.Example.com"),
+		tlsExtension{0x0017, nil},
+		tlsExtension{0xff01, []byte{0}},
+		tlsExtension{extSupportedGroups, tlsVector(2, tlsUint16s(0x4a4a, 0x001d, 0x0017, 0x0018)...)},
+		tlsExtension{extECPointFormats, tlsVector(1, 0)},
+		tlsExtension{0x0023, nil},
+		alpnExtension("h2", "http/1.1"),
+		tlsExtension{0x0005, []byte{1, 0, 0, 0, 0}},
+		tlsExtension{extSignatureAlgorithms, tlsVector(2, tlsUint16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)...)},
+		tlsExtension{0x0012, nil},
+		tlsExtension{0x0033, tlsVector(2, tlsUint16s(0x4a4a, 1)...)},
+		tlsExtension{0x002d, tlsVector(1, 1)},
+		tlsExtension{extSupportedVersions, tlsVector(1, tlsUint16s(0x3a3a, 0x0304, 0x0303)...)},
+		tlsExtension{0x001b, tlsVector(1, 0, 2)},
+		tlsExtension{0x4469, tlsVector(2, tlsVector(1, []byte("h2")...)...)},
+		tlsExtension{0x2a2a, []byte{0}},
+		tlsExtension{0x0015, make([]byte, 16)},
+	)
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   []byte
+		sni     string
+		alpn    []string
+		version string
+		ja3     string
+		ja4     string
+	}{
+		{
+			// The example of the JA3 README:
+			// 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+			name: "ja3 readme",
+			hello: clientHelloMessage(0x0301,
+				[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				sniExtension("example.com"),
+				tlsExtension{extSupportedGroups, tlsVector(2, tlsUint16s(23, 24, 25)...)},
+				tlsExtension{extECPointFormats, tlsVector(1, 0)},
+			),
+			sni:     "example.com",
+			version: "TLS 1.0",
+			ja3:     "ada70206e40642a3e4461f35503241d5",
+			ja4:     "t10d120300_d94e65cdb899_33a13ba74d1c",
+		},
+		{
+			name:    "chrome with grease",
+			hello:   chromeHello(),
+			sni:     "www.example.com",
+			alpn:    []string{"h2", "http/1.1"},
+			version: "TLS 1.3",
+			ja3:     "cd08e31494f9531f560d64c695473da9",
+			ja4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:    "no extensions",
+			hello:   clientHelloMessage(0x0303, []uint16{0x009c}),
+			version: "TLS 1.2",
+			ja3:     "6ee7f9475e7f8107f2bf5164f4e9e9c0",
+			ja4:     "t12i010000_dc2b145ead28_000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, ok := parseClientHello(tt.hello[4:])
+			if !ok {
+				t.Fatal("ClientHello didn't parse")
+			}
+			var info models.TLSInfo
+			hello.describe(&info, "t")
+			if info.JA3 != tt.ja3 || info.JA4 != tt.ja4 {
+				t.Errorf("fingerprints %s %s, want %s %s", info.JA3, info.JA4, tt.ja3, tt.ja4)
+			}
+			if info.SNI != tt.sni || info.Version != tt.version || len(info.ALPN) != len(tt.alpn) {
+				t.Errorf("SNI %q, version %q, ALPN %q, want %q, %q, %q", info.SNI, info.Version, info.ALPN, tt.sni, tt.version, tt.alpn)
+			}
+		})
+	}
+
+	if _, ok := parseClientHello(chromeHello()[4:40]); ok {
+		t.Errorf("truncated ClientHello parsed")
+	}
+}
+
+// serverHandshake is a TLS 1.2 ServerHello, Certificate and ServerHelloDone
+// for a certificate of name
+func serverHandshake(t *testing.T, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := tlsUint16s(0x0303)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, tlsVector(1)...)
+	body = append(body, tlsUint16s(0xc02f)...)
+	body = append(body, 0)
+	alpn := alpnExtension("h2")
+	body = append(body, tlsVector(2, append(tlsUint16s(alpn.typ), tlsVector(2, alpn.data...)...)...)...)
+
+	certs := tlsVector(3, tlsVector(3, cert...)...)
+	// ServerHello and Certificate share a record, as servers often send them
+	return append(handshakeRecord(handshakeMessage(tlsServerHello, body), handshakeMessage(tlsCertificate, certs)),
+		handshakeRecord(handshakeMessage(tlsServerHelloDone, nil))...)
+}
+
+// tlsSegment is a TCP segment of one direction of a handshake
+type tlsSegment struct {
+	fromClient bool
+	seq        uint32 // relative to the start of the direction
+	data       []byte
+}
+
+// splitSegments cuts data at the given offsets into segments
+func splitSegments(fromClient bool, data []byte, cuts ...int) []tlsSegment {
+	var segments []tlsSegment
+	start := 0
+	for _, cut := range append(cuts, len(data)) {
+		segments = append(segments, tlsSegment{fromClient, uint32(start), data[start:cut]})
+		start = cut
+	}
+	return segments
+}
+
+func TestInspectTLS(t *testing.T) {
+	clientHello := handshakeRecord(chromeHello())
+	server := serverHandshake(t, "www.example.com")
+	appData := []byte{0x17, 0x03, 0x03, 0x00, 0x02, 0xaa, 0xbb}
+
+	tests := []struct {
+		name     string
+		segments []tlsSegment
+		ja4      string
+		cert     string
+		cipher   string
+		clientOn bool // client direction still followed
+		serverOn bool
+	}{
+		{
+			name:     "client hello in one segment",
+			segments: splitSegments(true, clientHello),
+			ja4:      "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			serverOn: true,
+		},
+		{
+			name:     "client hello split across segments",
+			segments: splitSegments(true, clientHello, 6, 7, 100, 250),
+			ja4:      "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			serverOn: true,
+		},
+		{
+			name: "retransmission",
+			segments: append(splitSegments(true, clientHello[:200], 100),
+				append(splitSegments(true, clientHello[:200], 100), tlsSegment{true, 200, clientHello[200:]})...),
+			ja4:      "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			serverOn: true,
+		},
+		{
+			name:     "gap",
+			segments: []tlsSegment{{true, 0, clientHello[:100]}, {true, 200, clientHello[200:]}},
+			serverOn: true,
+		},
+		{
+			name: "server certificate split across segments",
+			segments: append(splitSegments(true, clientHello),
+				splitSegments(false, append(server, appData...), 3, 50, 90, 200, len(server)-2)...),
+			ja4:    "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			cert:   "CN=www.example.com",
+			cipher: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+		{
+			name:     "mid-stream",
+			segments: splitSegments(false, append(server[5:], appData...)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &flowEntry{flow: &models.Flow{}}
+			for _, seg := range tt.segments {
+				base := uint32(1000)
+				if !seg.fromClient {
+					base = 5000000
+				}
+				info := &packetInfo{tcp: &layers.TCP{Seq: base + seg.seq}, payload: seg.data}
+				entry.inspectTLS(info, seg.fromClient)
+			}
+
+			info := entry.flow.TLS
+			if info == nil {
+				info = &models.TLSInfo{}
+			}
+			if info.JA4 != tt.ja4 {
+				t.Errorf("JA4 %q, want %q", info.JA4, tt.ja4)
+			}
+			subject := ""
+			if info.Certificate != nil {
+				subject = info.Certificate.Subject
+			}
+			if subject != tt.cert || info.CipherSuite != tt.cipher {
+				t.Errorf("certificate %q, cipher %q, want %q, %q", subject, info.CipherSuite, tt.cert, tt.cipher)
+			}
+			if tt.cert != "" && info.NegotiatedALPN != "h2" {
+				t.Errorf("negotiated ALPN %q", info.NegotiatedALPN)
+			}
+			if entry.tls.client.done == tt.clientOn || entry.tls.server.done == tt.serverOn {
+				t.Errorf("client done %v, server done %v", entry.tls.client.done, entry.tls.server.done)
+			}
+		})
+	}
+}
+
+func TestTLSStreamMessages(t *testing.T) {
+	server := serverHandshake(t, "www.example.com")
+	data := append(server, 0x17, 0x03, 0x03, 0x00, 0x00)
+
+	// Fed a byte at a time, each message comes out once, as soon as it is
+	// complete
+	var s tlsStream
+	var types []byte
+	end := false
+	for i := range data {
+		if !s.add(uint32(i), data[i:i+1]) {
+			t.Fatalf("byte %d not taken", i)
+		}
+		var messages [][]byte
+		messages, end = s.messages()
+		for _, msg := range messages {
+			types = append(types, msg[0])
+		}
+	}
+	if string(types) != string([]byte{tlsServerHello, tlsCertificate, tlsServerHelloDone}) || !end {
+		t.Errorf("messages %v, end %v", types, end)
+	}
+	if len(s.records) != 5 || len(s.handshake) != 0 {
+		t.Errorf("%d record and %d handshake bytes left", len(s.records), len(s.handshake))
+	}
+}
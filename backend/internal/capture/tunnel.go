@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// Tunnel types
+const (
+	TunnelVXLAN  = "vxlan"
+	TunnelGeneve = "geneve"
+	TunnelGRE    = "gre"
+	TunnelIPIP   = "ipip" // IPv4 or IPv6 carried directly in IP
+)
+
+// flowLayers are the layers a packet is accounted by: the network layer, the
+// layers following it (transport first) and the tunnel it was carried in, if
+// it was decapsulated
+type flowLayers struct {
+	network   gopacket.NetworkLayer
+	transport []gopacket.Layer
+	tunnel    *models.TunnelInfo
+}
+
+// selectLayers picks the outermost IP header, or with decap the innermost one
+// inside VXLAN, GENEVE, GRE and IP-in-IP tunnels. gopacket decodes through all
+// of these, but NetworkLayer() and TransportLayer() return the first of each,
+// which mixes outer addresses with inner ports for GRE and IP-in-IP.
+func selectLayers(packet gopacket.Packet, decap bool) flowLayers {
+	ls := packet.Layers()
+
+	current := -1
+	for i, layer := range ls {
+		if isIPLayer(layer) {
+			current = i
+			break
+		}
+	}
+	if current < 0 {
+		return flowLayers{}
+	}
+
+	var tunnel *models.TunnelInfo
+	for decap {
+		next := nextIPLayer(ls, current)
+		if next < 0 {
+			break
+		}
+		info := tunnelBetween(ls[current+1 : next])
+		if info == nil {
+			break
+		}
+		outer := ls[current].(gopacket.NetworkLayer).NetworkFlow()
+		info.SrcIP = outer.Src().String()
+		info.DstIP = outer.Dst().String()
+		if tunnel == nil {
+			tunnel = info
+		}
+		current = next
+	}
+
+	// Extension headers sit between the IP header and the transport
+	transport := current + 1
+	for transport < len(ls) && isExtensionHeader(ls[transport]) {
+		transport++
+	}
+
+	return flowLayers{
+		network:   ls[current].(gopacket.NetworkLayer),
+		transport: ls[transport:],
+		tunnel:    tunnel,
+	}
+}
+
+// tunnelBetween identifies the tunnel formed by the layers between two IP
+// headers, or returns nil if they aren't a tunnel we decapsulate (e.g. the
+// second header is quoted by ICMP)
+func tunnelBetween(between []gopacket.Layer) *models.TunnelInfo {
+	if len(between) == 0 {
+		return &models.TunnelInfo{Type: TunnelIPIP}
+	}
+	for _, layer := range between {
+		switch l := layer.(type) {
+		case *layers.VXLAN:
+			return &models.TunnelInfo{Type: TunnelVXLAN, VNI: l.VNI}
+		case *layers.Geneve:
+			return &models.TunnelInfo{Type: TunnelGeneve, VNI: l.VNI}
+		case *layers.GRE:
+			return &models.TunnelInfo{Type: TunnelGRE, VNI: l.Key}
+		}
+	}
+	return nil
+}
+
+// nextIPLayer returns the index of the first IP layer after i, or -1
+func nextIPLayer(ls []gopacket.Layer, i int) int {
+	for j := i + 1; j < len(ls); j++ {
+		if isIPLayer(ls[j]) {
+			return j
+		}
+	}
+	return -1
+}
+
+func isIPLayer(layer gopacket.Layer) bool {
+	switch layer.(type) {
+	case *layers.IPv4, *layers.IPv6:
+		return true
+	}
+	return false
+}
+
+// isExtensionHeader reports whether layer is an IPv6 extension header or an
+// IPsec authentication header, which goes in front of the transport header
+// in the same way
+func isExtensionHeader(layer gopacket.Layer) bool {
+	switch layer.LayerType() {
+	case layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Routing,
+		layers.LayerTypeIPv6Fragment, layers.LayerTypeIPv6Destination, layers.LayerTypeIPSecAH:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+func TestDecapsulate(t *testing.T) {
+	outerSrc, outerDst := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	inner := tcpConn{net.IPv4(10, 1, 0, 1), net.IPv4(10, 1, 0, 2), 40000, 80}.frame(t, false, 100, 0, true, false, "")
+	innerKey, _ := NewFlowKey("TCP", "10.1.0.1", 40000, "10.1.0.2", 80)
+
+	// ipTunnel carries the inner IP packet in an IP packet of protocol,
+	// after the given header
+	ipTunnel := func(protocol layers.IPProtocol, header ...gopacket.SerializableLayer) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: outerSrc, DstIP: outerDst}
+		return ipFrame(t, append(append([]gopacket.SerializableLayer{ip}, header...), gopacket.Payload(inner[14:]))...)
+	}
+	vxlan := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(vxlan, gopacket.SerializeOptions{}, &layers.VXLAN{ValidIDFlag: true, VNI: 42}, gopacket.Payload(inner)); err != nil {
+		t.Fatal(err)
+	}
+	// No options, Transparent Ethernet Bridging, VNI 43
+	geneve := binary.BigEndian.AppendUint16([]byte{0, 0}, uint16(layers.EthernetTypeTransparentEthernetBridging))
+	geneve = append(append(geneve, 0, 0, 43, 0), inner...)
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		tunnel models.TunnelInfo
+	}{
+		{
+			name:   "vxlan",
+			frame:  udpFrame(t, outerSrc, outerDst, 51000, 4789, vxlan.Bytes()),
+			tunnel: models.TunnelInfo{Type: TunnelVXLAN, VNI: 42},
+		},
+		{
+			name:   "geneve",
+			frame:  udpFrame(t, outerSrc, outerDst, 51000, 6081, geneve),
+			tunnel: models.TunnelInfo{Type: TunnelGeneve, VNI: 43},
+		},
+		{
+			name:   "gre",
+			frame:  ipTunnel(layers.IPProtocolGRE, &layers.GRE{KeyPresent: true, Key: 44, Protocol: layers.EthernetTypeIPv4}),
+			tunnel: models.TunnelInfo{Type: TunnelGRE, VNI: 44},
+		},
+		{
+			name:   "ip-in-ip",
+			frame:  ipTunnel(layers.IPProtocolIPv4),
+			tunnel: models.TunnelInfo{Type: TunnelIPIP},
+		},
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		for _, decap := range []bool{true, false} {
+			s := testShard()
+			s.pc.opts.Decapsulate = decap
+			s.processFrame(tt.frame, gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(tt.frame), Length: len(tt.frame)})
+			if len(s.flows.flows) != 1 {
+				t.Fatalf("%s: %d flows", tt.name, len(s.flows.flows))
+			}
+			for key, entry := range s.flows.flows {
+				if !decap {
+					// Accounted by the outer headers only
+					if key.AddrA != outerSrc.String() || key.Tunnel != 0 || entry.flow.Tunnel != nil {
+						t.Errorf("%s without decapsulation: flow %s, tunnel %+v", tt.name, key, entry.flow.Tunnel)
+					}
+					continue
+				}
+				want := innerKey
+				want.Tunnel = tt.tunnel.VNI
+				if key != want {
+					t.Errorf("%s: flow %s, want %s", tt.name, key, want)
+				}
+				tunnel := tt.tunnel
+				tunnel.SrcIP, tunnel.DstIP = outerSrc.String(), outerDst.String()
+				if got := entry.flow.Tunnel; got == nil || *got != tunnel {
+					t.Errorf("%s: tunnel %+v, want %+v", tt.name, got, tunnel)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// vlanTag identifies the VLAN a frame belongs to. Inner is only set for QinQ,
+// and a zero tag means the frame was untagged.
+type vlanTag struct {
+	outer uint16
+	inner uint16
+}
+
+// encapsulation is the L2.5 framing a packet arrived with
+type encapsulation struct {
+	vlan vlanTag
+	mpls []uint32 // label stack, outermost first
+}
+
+// decodeEncapsulation collects the 802.1Q/802.1ad tags and MPLS labels in
+// front of the network layer. gopacket already decodes through them, so
+// NetworkLayer() is the inner IP header either way.
+func decodeEncapsulation(packet gopacket.Packet) encapsulation {
+	var encap encapsulation
+	tags := 0
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Dot1Q:
+			// VLAN 0 is a priority tag, not a VLAN
+			if l.VLANIdentifier == 0 {
+				continue
+			}
+			switch tags {
+			case 0:
+				encap.vlan.outer = l.VLANIdentifier
+			case 1:
+				encap.vlan.inner = l.VLANIdentifier
+			}
+			tags++
+		case *layers.MPLS:
+			encap.mpls = append(encap.mpls, l.Label)
+		case *layers.IPv4, *layers.IPv6:
+			// Tags of tunnelled frames belong to the overlay
+			return encap
+		}
+	}
+	return encap
+}
+
+// vlanCounters keeps interface-style counters per VLAN
+type vlanCounters struct {
+	iface  string
+	stats  map[vlanTag]*models.VLANStats
+	tagged bool // seen any tagged traffic
+}
+
+func newVLANCounters(iface string) *vlanCounters {
+	return &vlanCounters{
+		iface: iface,
+		stats: make(map[vlanTag]*models.VLANStats),
+	}
+}
+
+// add accounts a packet to its VLAN
+func (c *vlanCounters) add(tag vlanTag, length int, weight uint64, incoming bool) {
+	if tag.outer != 0 {
+		c.tagged = true
+	}
+	addTraffic(&c.entry(tag).InterfaceStats, length, weight, incoming)
+}
+
+// merge adds the counters of another shard
+func (c *vlanCounters) merge(stats []*models.VLANStats, tagged bool) {
+	for _, s := range stats {
+		mergeTraffic(&c.entry(vlanTag{s.VLAN, s.InnerVLAN}).InterfaceStats, &s.InterfaceStats)
+	}
+	c.tagged = c.tagged || tagged
+}
+
+// entry returns the counters of tag, creating them if needed
+func (c *vlanCounters) entry(tag vlanTag) *models.VLANStats {
+	stats, ok := c.stats[tag]
+	if !ok {
+		stats = &models.VLANStats{
+			InterfaceStats: models.InterfaceStats{Interface: c.iface},
+			VLAN:           tag.outer,
+			InnerVLAN:      tag.inner,
+		}
+		c.stats[tag] = stats
+	}
+	return stats
+}
+
+// snapshot returns the counters sorted by tag, or nil on an access port
+func (c *vlanCounters) snapshot() []*models.VLANStats {
+	if !c.tagged {
+		return nil
+	}
+	result := make([]*models.VLANStats, 0, len(c.stats))
+	for _, stats := range c.stats {
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].VLAN != result[j].VLAN {
+			return result[i].VLAN < result[j].VLAN
+		}
+		return result[i].InnerVLAN < result[j].InnerVLAN
+	})
+	return result
+}
+
+// resetRates clears the per-second counters after a flush
+func (c *vlanCounters) resetRates() {
+	for _, stats := range c.stats {
+		resetRates(&stats.InterfaceStats)
+	}
+}
+
+// addTraffic adds a packet to interface-style counters
+func addTraffic(stats *models.InterfaceStats, length int, weight uint64, incoming bool) {
+	bytes := uint64(length) * weight
+	if incoming {
+		stats.InBytes += bytes
+		stats.InBytesPerSec += bytes
+		stats.InPackets += weight
+		stats.InPacketsPerSec += weight
+	} else {
+		stats.OutBytes += bytes
+		stats.OutBytesPerSec += bytes
+		stats.OutPackets += weight
+		stats.OutPacketsPerSec += weight
+	}
+}
+
+// mergeTraffic adds the interface-style counters of src to dst
+func mergeTraffic(dst, src *models.InterfaceStats) {
+	dst.InBytes += src.InBytes
+	dst.OutBytes += src.OutBytes
+	dst.InBytesPerSec += src.InBytesPerSec
+	dst.OutBytesPerSec += src.OutBytesPerSec
+	dst.InPackets += src.InPackets
+	dst.OutPackets += src.OutPackets
+	dst.InPacketsPerSec += src.InPacketsPerSec
+	dst.OutPacketsPerSec += src.OutPacketsPerSec
+}
+
+// resetRates clears the per-second part of interface-style counters
+func resetRates(stats *models.InterfaceStats) {
+	stats.InBytesPerSec = 0
+	stats.OutBytesPerSec = 0
+	stats.InPacketsPerSec = 0
+	stats.OutPacketsPerSec = 0
+}
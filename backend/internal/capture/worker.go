@@ -0,0 +1,334 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// batchFrames is how many frames are handed to a worker at once
+	batchFrames = 64
+	// workerQueueLen is how many batches may wait for a worker before the
+	// reader blocks, and the kernel buffer fills up instead
+	workerQueueLen = 64
+)
+
+// flushRequest asks a worker for a tick of its shard
+type flushRequest struct {
+	storage  Storage
+	now      time.Time
+	interval time.Duration
+}
+
+// frameBatch carries copies of frames from the reader to a worker, or a flush
+// request ordered after the frames sent before it
+type frameBatch struct {
+	data  []byte // the frames back to back
+	ends  []int  // where each frame ends in data
+	infos []gopacket.CaptureInfo
+	flush *flushRequest
+}
+
+// worker processes the frames of one shard
+type worker struct {
+	shard   *shard
+	source  packetSource       // read by the worker itself with fanout
+	batches chan *frameBatch   // sent by the reader otherwise
+	ticks   chan *flushRequest // with fanout
+	pending *frameBatch        // being filled by the reader
+}
+
+// workerPool runs a worker per shard. With a source per worker (AF_PACKET
+// fanout) the kernel spreads the flows and each worker reads its own source;
+// with a single source the reader hashes every frame to a worker and hands
+// it over in batches.
+type workerPool struct {
+	workers  []*worker
+	fanout   bool
+	linkType layers.LinkType
+
+	samples chan shardSample
+	errs    chan error       // read errors of fanout workers
+	free    chan *frameBatch // batches for reuse
+	queued  int64            // frames handed over but not processed yet
+	routes  *quicRoutes      // shards of the QUIC connections, to dispatch
+	links   *icmpLinks       // ICMP errors about flows of other shards
+
+	ctx    context.Context // done once the workers stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(ctx context.Context, shards []*shard, sources []packetSource) *workerPool {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &workerPool{
+		workers:  make([]*worker, len(shards)),
+		fanout:   len(sources) == len(shards),
+		linkType: sources[0].linkType(),
+		samples:  make(chan shardSample, len(shards)),
+		errs:     make(chan error, len(shards)),
+		free:     make(chan *frameBatch, len(shards)*workerQueueLen),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	p.links = newICMPLinks(len(shards))
+	if !p.fanout {
+		p.routes = newQUICRoutes()
+	}
+	for i, s := range shards {
+		s.flows.routes, s.flows.links, s.flows.shard = p.routes, p.links, i
+	}
+	for i, s := range shards {
+		w := &worker{shard: s}
+		p.workers[i] = w
+		p.wg.Add(1)
+		if p.fanout {
+			w.source = sources[i]
+			w.ticks = make(chan *flushRequest, 1)
+			go p.read(ctx, w)
+		} else {
+			w.batches = make(chan *frameBatch, workerQueueLen)
+			go p.process(w)
+		}
+	}
+	return p
+}
+
+// read is the loop of a worker reading its own source
+func (p *workerPool) read(ctx context.Context, w *worker) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-w.ticks:
+			p.samples <- w.shard.flush(req.storage, req.now, req.interval)
+		default:
+		}
+
+		data, ci, err := w.source.readPacket()
+		if err == errReadTimeout {
+			continue
+		}
+		if err != nil {
+			p.errs <- err
+			// Keep answering ticks until the capture stops
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-w.ticks:
+					p.samples <- w.shard.flush(req.storage, req.now, req.interval)
+				}
+			}
+		}
+		w.shard.processFrame(data, ci)
+	}
+}
+
+// process is the loop of a worker fed by the reader
+func (p *workerPool) process(w *worker) {
+	defer p.wg.Done()
+	for batch := range w.batches {
+		if req := batch.flush; req != nil {
+			p.samples <- w.shard.flush(req.storage, req.now, req.interval)
+			continue
+		}
+		start := 0
+		for i, end := range batch.ends {
+			w.shard.processFrame(batch.data[start:end], batch.infos[i])
+			start = end
+		}
+		atomic.AddInt64(&p.queued, -int64(len(batch.ends)))
+		batch.data, batch.ends, batch.infos = batch.data[:0], batch.ends[:0], batch.infos[:0]
+		select {
+		case p.free <- batch:
+		default:
+		}
+	}
+}
+
+// dispatch copies a frame into the batch of its worker, handing the batch
+// over once full
+func (p *workerPool) dispatch(data []byte, ci gopacket.CaptureInfo) {
+	hash, udp := flowHash(data, p.linkType)
+	w := p.workers[hash%uint32(len(p.workers))]
+	if udp != nil {
+		// A QUIC connection that moved stays with its flow
+		if shard, ok := p.routes.lookup(udp); ok {
+			w = p.workers[shard]
+		}
+	}
+	if w.pending == nil {
+		select {
+		case w.pending = <-p.free:
+		default:
+			w.pending = &frameBatch{
+				ends:  make([]int, 0, batchFrames),
+				infos: make([]gopacket.CaptureInfo, 0, batchFrames),
+			}
+		}
+	}
+	batch := w.pending
+	batch.data = append(batch.data, data...)
+	batch.ends = append(batch.ends, len(batch.data))
+	batch.infos = append(batch.infos, ci)
+	if len(batch.ends) == batchFrames {
+		p.send(w)
+	}
+}
+
+func (p *workerPool) send(w *worker) {
+	atomic.AddInt64(&p.queued, int64(len(w.pending.ends)))
+	w.batches <- w.pending
+	w.pending = nil
+}
+
+// sendPending hands over the partially filled batches
+func (p *workerPool) sendPending() {
+	if p.fanout {
+		return
+	}
+	for _, w := range p.workers {
+		if w.pending != nil {
+			p.send(w)
+		}
+	}
+}
+
+// flush has every worker flush its shard once it has processed the frames
+// read so far, and returns their samples. It returns nil if the capture is
+// stopping, as reading workers may have returned already.
+func (p *workerPool) flush(storage Storage, now time.Time, interval time.Duration) []shardSample {
+	req := &flushRequest{storage: storage, now: now, interval: interval}
+	samples := make([]shardSample, len(p.workers))
+	if p.fanout {
+		if p.ctx.Err() != nil {
+			return nil
+		}
+		for _, w := range p.workers {
+			select {
+			case w.ticks <- req:
+			case <-p.ctx.Done():
+				return nil
+			}
+		}
+		for i := range samples {
+			select {
+			case samples[i] = <-p.samples:
+			case <-p.ctx.Done():
+				return nil
+			}
+		}
+		return samples
+	}
+
+	// Fed workers only return once stopped, after the last flush
+	p.sendPending()
+	for _, w := range p.workers {
+		w.batches <- &frameBatch{flush: req}
+	}
+	for i := range samples {
+		samples[i] = <-p.samples
+	}
+	return samples
+}
+
+// backlog is the number of frames waiting for the workers
+func (p *workerPool) backlog() int {
+	return int(atomic.LoadInt64(&p.queued))
+}
+
+// stop waits for the workers to finish; fed workers process what they were
+// handed first
+func (p *workerPool) stop() {
+	p.sendPending()
+	p.cancel()
+	if !p.fanout {
+		for _, w := range p.workers {
+			close(w.batches)
+		}
+	}
+	p.wg.Wait()
+}
+
+// flowHash hashes the IP addresses of a frame independently of direction, so
+// both directions of a flow, and the fragments of its datagrams, land on the
+// same shard. It also returns the payload of UDP datagrams, which may be
+// QUIC packets of a connection that moved. Frames without an IP header hash
+// to 0.
+func flowHash(data []byte, linkType layers.LinkType) (hash uint32, udp []byte) {
+	etherType, ip := networkHeader(data, linkType)
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		if len(ip) < 20 {
+			return 0, nil
+		}
+		hash = addrHash(ip[12:16]) ^ addrHash(ip[16:20])
+		ihl := int(ip[0]&0x0f) * 4
+		if ihl < 20 || len(ip) < ihl || binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+			// Fragments carry no transport header past the first one
+			return hash, nil
+		}
+		if transport := ip[ihl:]; layers.IPProtocol(ip[9]) == layers.IPProtocolUDP && len(transport) >= 8 {
+			return hash, transport[8:]
+		}
+		return hash, nil
+	case layers.EthernetTypeIPv6:
+		if len(ip) < 40 {
+			return 0, nil
+		}
+		hash = addrHash(ip[8:24]) ^ addrHash(ip[24:40])
+		// Datagrams behind extension headers aren't looked into
+		if transport := ip[40:]; layers.IPProtocol(ip[6]) == layers.IPProtocolUDP && len(transport) >= 8 {
+			return hash, transport[8:]
+		}
+		return hash, nil
+	}
+	return 0, nil
+}
+
+// networkHeader skips the Ethernet header and VLAN tags of a frame, returning
+// the EtherType and what follows. Raw IP is told apart by the IP version.
+func networkHeader(data []byte, linkType layers.LinkType) (layers.EthernetType, []byte) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return 0, nil
+		}
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(data[12:]))
+		offset := 14
+		for (etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ) && len(data) >= offset+4 {
+			etherType = layers.EthernetType(binary.BigEndian.Uint16(data[offset+2:]))
+			offset += 4
+		}
+		return etherType, data[offset:]
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) == 0 {
+			return 0, nil
+		}
+		switch data[0] >> 4 {
+		case 4:
+			return layers.EthernetTypeIPv4, data
+		case 6:
+			return layers.EthernetTypeIPv6, data
+		}
+	}
+	return 0, nil
+}
+
+// addrHash is FNV-1a
+func addrHash(addr []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range addr {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,213 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/raojinlin/traffic-sniff/internal/models"
+	"github.com/raojinlin/traffic-sniff/internal/storage"
+)
+
+// linkSource only tells its link type, for pools fed by the test
+type linkSource struct {
+	packetSource
+	link layers.LinkType
+}
+
+func (s linkSource) linkType() layers.LinkType { return s.link }
+
+// testPool is a capture whose frames are dispatched to n shards
+func testPool(t *testing.T, n int) *PacketCapture {
+	t.Helper()
+	pc := testShard().pc
+	pc.iface = "test0"
+	pc.neighbors = newNeighborTable(pc.iface)
+	pc.shards = make([]*shard, n)
+	for i := range pc.shards {
+		pc.shards[i] = newShard(pc, layers.LinkTypeEthernet)
+	}
+	pc.pool = newWorkerPool(context.Background(), pc.shards, []packetSource{linkSource{link: layers.LinkTypeEthernet}})
+	t.Cleanup(pc.pool.stop)
+	return pc
+}
+
+// hashShard is the shard a frame hashes to by its addresses
+func hashShard(frame []byte, shards int) int {
+	hash, _ := flowHash(frame, layers.LinkTypeEthernet)
+	return int(hash % uint32(shards))
+}
+
+// ipFrame serializes an Ethernet frame of an IP packet
+func ipFrame(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	if _, ok := ls[0].(*layers.IPv6); ok {
+		eth.EthernetType = layers.EthernetTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func udpFrame(t *testing.T, src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	return ipFrame(t, ip, udp, gopacket.Payload(payload))
+}
+
+// icmpError builds a time exceeded from router quoting the IP packet of frame
+func icmpError(t *testing.T, router net.IP, frame []byte) []byte {
+	quoted := frame[14:]
+	if quoted[0]>>4 == 6 {
+		dst := net.IP(quoted[8:24])
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: router, DstIP: dst}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeTimeExceeded, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		return ipFrame(t, ip, icmp, gopacket.Payload(append(make([]byte, 4), quoted[:48]...)))
+	}
+	dst := net.IP(quoted[12:16])
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: router, DstIP: dst}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}
+	return ipFrame(t, ip, icmp, gopacket.Payload(quoted[:28]))
+}
+
+// quicLong is a long header QUIC packet with the given connection IDs
+func quicLong(dcid, scid []byte) []byte {
+	b := []byte{0xc0}
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	b = append(b, 0, 0x40, 24) // no token, 24 bytes of packet number and payload
+	return append(b, make([]byte, 24)...)
+}
+
+func TestFlowHash(t *testing.T) {
+	client, server, router := net.IPv4(192, 168, 1, 10), net.IPv4(203, 0, 113, 5), net.IPv4(10, 0, 0, 1)
+	conn := tcpConn{client, server, 51000, 443}
+	request := conn.frame(t, false, 100, 0, true, false, "")
+	reply := conn.frame(t, true, 500, 101, true, false, "")
+	hash, udp := flowHash(request, layers.LinkTypeEthernet)
+	if udp != nil {
+		t.Errorf("UDP payload of a TCP segment")
+	}
+	if back, _ := flowHash(reply, layers.LinkTypeEthernet); back != hash {
+		t.Errorf("directions hash to %x and %x", hash, back)
+	}
+	// ICMP errors stay with the flow of their own addresses
+	if err, _ := flowHash(icmpError(t, router, request), layers.LinkTypeEthernet); err != addrHash(router.To4())^addrHash(client.To4()) {
+		t.Errorf("ICMP error hashes to %x", err)
+	}
+	if raw, _ := flowHash(request[14:], layers.LinkTypeRaw); raw != hash {
+		t.Errorf("raw IP hashes to %x, Ethernet to %x", raw, hash)
+	}
+
+	client6, server6, router6 := net.ParseIP("2001:db8::10"), net.ParseIP("2001:db8:1::5"), net.ParseIP("2001:db8::1")
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: client6, DstIP: server6}
+	udp6 := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp6.SetNetworkLayerForChecksum(ip6)
+	datagram := ipFrame(t, ip6, udp6, gopacket.Payload("query"))
+	if _, udp = flowHash(datagram, layers.LinkTypeEthernet); string(udp) != "query" {
+		t.Errorf("UDP payload %q", udp)
+	}
+	if err, _ := flowHash(icmpError(t, router6, datagram), layers.LinkTypeEthernet); err != addrHash(router6)^addrHash(client6) {
+		t.Errorf("ICMPv6 error hashes to %x", err)
+	}
+}
+
+func TestDispatchFollowsFlows(t *testing.T) {
+	const shards = 4
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	client, server := net.IPv4(192, 168, 1, 10), net.IPv4(203, 0, 113, 5)
+	pc := testPool(t, shards)
+
+	at := start
+	send := func(frames ...[]byte) {
+		for _, frame := range frames {
+			at = at.Add(time.Millisecond)
+			pc.pool.dispatch(frame, gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(frame), Length: len(frame)})
+		}
+	}
+	// flows ticks the capture and returns the flows in storage by
+	// protocol, checking that no two shards keep the same flow
+	flows := func() map[string][]*models.Flow {
+		store := storage.NewMemoryStorage()
+		pc.flush(store, at, time.Second)
+		kept := make(map[FlowKey]int)
+		for i, s := range pc.shards {
+			for key := range s.flows.flows {
+				if other, ok := kept[key]; ok {
+					t.Errorf("%s kept by shards %d and %d", key, other, i)
+				}
+				kept[key] = i
+			}
+		}
+		byProtocol := make(map[string][]*models.Flow)
+		for _, flow := range store.GetFilteredConnections(&models.Filter{}) {
+			byProtocol[flow.Protocol] = append(byProtocol[flow.Protocol], flow)
+		}
+		return byProtocol
+	}
+	// other finds an address whose frames go to another shard than frame
+	other := func(frame []byte, build func(net.IP) []byte) []byte {
+		for i := byte(1); i < 255; i++ {
+			moved := build(net.IPv4(198, 51, 100, i))
+			if hashShard(moved, shards) != hashShard(frame, shards) {
+				return moved
+			}
+		}
+		t.Fatal("every address hashes to the same shard")
+		return nil
+	}
+
+	// A router reports on two flows kept by different shards. Its errors
+	// make a single flow, and each is counted against the flow it quotes
+	// once the shard keeping that flow ticks.
+	router := net.IPv4(10, 0, 0, 1)
+	first := tcpConn{client, server, 51000, 443}.frame(t, false, 100, 0, true, false, "")
+	second := other(first, func(server net.IP) []byte {
+		return tcpConn{client, server, 51001, 443}.frame(t, false, 100, 0, true, false, "")
+	})
+	send(first, second, icmpError(t, router, first), icmpError(t, router, second))
+	flows()
+	byProtocol := flows()
+	if tcp := byProtocol["TCP"]; len(tcp) != 2 || tcp[0].ICMPErrors != 1 || tcp[1].ICMPErrors != 1 {
+		t.Errorf("ICMP errors not linked: %+v", tcp)
+	}
+	if icmp := byProtocol["ICMP"]; len(icmp) != 1 || icmp[0].Packets != 2 {
+		t.Errorf("ICMP errors make %d flows: %+v", len(icmp), icmp)
+	}
+
+	// A QUIC client moving to an address hashing elsewhere keeps its flow
+	clientCID, serverCID := []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9, 10, 11, 12, 13, 14, 15, 16}
+	send(
+		udpFrame(t, client, server, 52000, 443, quicLong([]byte{0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0xfa, 0xf9, 0xf8}, clientCID)),
+		udpFrame(t, server, client, 443, 52000, quicLong(clientCID, serverCID)),
+	)
+	flows()
+	short := append([]byte{0x40}, serverCID...)
+	short = append(short, make([]byte, 24)...)
+	original := udpFrame(t, client, server, 52000, 443, short)
+	send(other(original, func(moved net.IP) []byte { return udpFrame(t, moved, server, 40000, 443, short) }))
+	udp := flows()["UDP"]
+	if len(udp) != 1 {
+		t.Fatalf("%d UDP flows", len(udp))
+	}
+	if quic := udp[0]; quic.QUIC == nil || quic.QUIC.Migrations != 1 || quic.Packets != 3 {
+		t.Errorf("migration not followed: %+v", quic)
+	}
+}
@@ -0,0 +1,227 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// Kubernetes labels the kubelet puts on the containers it runs
+const (
+	labelPodName       = "io.kubernetes.pod.name"
+	labelPodNamespace  = "io.kubernetes.pod.namespace"
+	labelPodUID        = "io.kubernetes.pod.uid"
+	labelContainerName = "io.kubernetes.container.name"
+)
+
+// dockerTimeout bounds a request to the Docker socket
+const dockerTimeout = 2 * time.Second
+
+var (
+	// Container runtimes name the cgroup after the 64 hex digit container ID
+	containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+	// The kubelet names pod cgroups pod<uid>; the systemd driver replaces
+	// the dashes of the UID with underscores
+	podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+)
+
+// cgroupRuntimes maps cgroup path markers to the runtime that uses them
+var cgroupRuntimes = []struct {
+	marker  string
+	runtime string
+}{
+	{"cri-containerd-", "containerd"},
+	{"crio-", "cri-o"},
+	{"libpod-", "podman"},
+	{"docker-", "docker"},
+	{"/docker/", "docker"},
+	{"/containerd/", "containerd"},
+}
+
+// parseCgroupWorkload extracts the container and pod a cgroup path belongs
+// to, e.g. /kubepods.slice/kubepods-burstable.slice/
+// kubepods-burstable-pod1b2c..._.slice/cri-containerd-<id>.scope
+func parseCgroupWorkload(cgroup string) *models.WorkloadInfo {
+	ids := containerIDPattern.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return nil
+	}
+	workload := &models.WorkloadInfo{ContainerID: ids[len(ids)-1]}
+
+	for _, r := range cgroupRuntimes {
+		if strings.Contains(cgroup, r.marker) {
+			workload.Runtime = r.runtime
+			break
+		}
+	}
+	if m := podUIDPattern.FindStringSubmatch(cgroup); m != nil {
+		workload.PodUID = strings.ReplaceAll(m[1], "_", "-")
+	}
+	return workload
+}
+
+// workloadNames are the names known for containers and pods
+type workloadNames struct {
+	containers map[string]*models.WorkloadInfo // by container ID
+	pods       map[string]*models.WorkloadInfo // by pod UID
+}
+
+// label fills in the names of a workload found through its cgroup
+func (n *workloadNames) label(workload *models.WorkloadInfo) {
+	if known, ok := n.containers[workload.ContainerID]; ok {
+		if workload.ContainerName == "" {
+			workload.ContainerName = known.ContainerName
+		}
+		if workload.Runtime == "" {
+			workload.Runtime = known.Runtime
+		}
+		if workload.PodUID == "" {
+			workload.PodUID = known.PodUID
+		}
+		if known.PodName != "" {
+			workload.PodName, workload.PodNamespace = known.PodName, known.PodNamespace
+		}
+	}
+	if workload.PodName == "" && workload.PodUID != "" {
+		if pod, ok := n.pods[workload.PodUID]; ok {
+			workload.PodName, workload.PodNamespace = pod.PodName, pod.PodNamespace
+		}
+	}
+}
+
+// loadWorkloadNames asks the Docker socket and reads the kubelet pods file,
+// whichever are configured. Errors leave the names from the other source.
+func loadWorkloadNames(dockerSocket, podsFile string) (*workloadNames, error) {
+	names := &workloadNames{
+		containers: make(map[string]*models.WorkloadInfo),
+		pods:       make(map[string]*models.WorkloadInfo),
+	}
+
+	var firstErr error
+	if dockerSocket != "" {
+		if err := names.loadDocker(dockerSocket); err != nil {
+			firstErr = fmt.Errorf("docker socket %s: %w", dockerSocket, err)
+		}
+	}
+	if podsFile != "" {
+		if err := names.loadPods(podsFile); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("pods file %s: %w", podsFile, err)
+		}
+	}
+	return names, firstErr
+}
+
+// dockerContainer is the part of GET /containers/json we use
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// loadDocker lists the running containers through the Docker Engine API
+func (n *workloadNames) loadDocker(socket string) error {
+	client := &http.Client{
+		Timeout: dockerTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+	for _, c := range containers {
+		workload := &models.WorkloadInfo{
+			ContainerID:  c.ID,
+			Runtime:      "docker",
+			PodName:      c.Labels[labelPodName],
+			PodNamespace: c.Labels[labelPodNamespace],
+			PodUID:       c.Labels[labelPodUID],
+		}
+		// Kubernetes containers are better known by their pod spec name
+		if name := c.Labels[labelContainerName]; name != "" {
+			workload.ContainerName = name
+		} else if len(c.Names) > 0 {
+			workload.ContainerName = strings.TrimPrefix(c.Names[0], "/")
+		}
+		n.containers[c.ID] = workload
+	}
+	return nil
+}
+
+// podList is the part of the kubelet's /pods response we use
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"metadata"`
+		Status struct {
+			ContainerStatuses     []containerStatus `json:"containerStatuses"`
+			InitContainerStatuses []containerStatus `json:"initContainerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type containerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"` // <runtime>://<id>
+}
+
+// loadPods reads a pod list as served by the kubelet's /pods endpoint
+func (n *workloadNames) loadPods(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var pods podList
+	if err := json.Unmarshal(data, &pods); err != nil {
+		return err
+	}
+
+	for _, pod := range pods.Items {
+		meta := pod.Metadata
+		n.pods[meta.UID] = &models.WorkloadInfo{
+			PodName:      meta.Name,
+			PodNamespace: meta.Namespace,
+			PodUID:       meta.UID,
+		}
+		statuses := append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...)
+		for _, status := range statuses {
+			runtime, id, ok := strings.Cut(status.ContainerID, "://")
+			if !ok {
+				continue
+			}
+			n.containers[id] = &models.WorkloadInfo{
+				ContainerID:   id,
+				ContainerName: status.Name,
+				Runtime:       runtime,
+				PodName:       meta.Name,
+				PodNamespace:  meta.Namespace,
+				PodUID:        meta.UID,
+			}
+		}
+	}
+	return nil
+}
@@ -2,13 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/gopacket/pcap"
 	"github.com/gorilla/websocket"
+	"github.com/raojinlin/traffic-sniff/internal/capture"
 	"github.com/raojinlin/traffic-sniff/internal/models"
 	"github.com/raojinlin/traffic-sniff/internal/storage"
 )
@@ -21,8 +25,13 @@ type Handler struct {
 }
 
 type CaptureManager interface {
-	SwitchInterface(iface string) error
+	SwitchInterface(iface string, filter *string) error
+	AddInterface(iface string) error
+	RemoveInterface(iface string) error
 	GetCurrentInterface() string
+	GetInterfaces() []string
+	SetFilter(expr string) error
+	GetFilter() string
 }
 
 func NewHandler(storage *storage.MemoryStorage, historicalStore *storage.FileStorage, captureManager CaptureManager) *Handler {
@@ -40,18 +49,79 @@ func NewHandler(storage *storage.MemoryStorage, historicalStore *storage.FileSto
 
 // RealtimeTraffic returns current interface statistics
 func (h *Handler) RealtimeTraffic(w http.ResponseWriter, r *http.Request) {
-	snapshot := h.storage.GetSnapshot()
+	snapshot := h.storage.GetSnapshot(r.URL.Query().Get("interface"))
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(snapshot.Interface)
 }
 
+// CaptureStats returns packet capture and drop counters per interface
+func (h *Handler) CaptureStats(w http.ResponseWriter, r *http.Request) {
+	stats := h.storage.GetCaptureStats(r.URL.Query().Get("interface"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// VLANTraffic returns per-VLAN statistics of trunk interfaces
+func (h *Handler) VLANTraffic(w http.ResponseWriter, r *http.Request) {
+	stats := h.storage.GetVLANStats(r.URL.Query().Get("interface"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// MACTraffic returns per-Ethernet-address statistics, including non-IP
+// frames, with broadcast and multicast traffic split out
+func (h *Handler) MACTraffic(w http.ResponseWriter, r *http.Request) {
+	filter := &models.MACFilter{
+		Interface: r.URL.Query().Get("interface"),
+		Kind:      r.URL.Query().Get("kind"),
+		Vendor:    r.URL.Query().Get("vendor"),
+	}
+	switch filter.Kind {
+	case "", models.MACUnicast, models.MACMulticast, models.MACBroadcast:
+	default:
+		http.Error(w, "Invalid kind, expected one of unicast, multicast, broadcast", http.StatusBadRequest)
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "bytes"
+	}
+	valid := false
+	for _, s := range storage.MACSorts {
+		valid = valid || s == sortBy
+	}
+	if !valid {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s", strings.Join(storage.MACSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 100)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	stats := h.storage.GetMACStats(filter, sortBy, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 // ConnectionList returns filtered list of active connections
 func (h *Handler) ConnectionList(w http.ResponseWriter, r *http.Request) {
 	// Parse filters from query params
 	filter := &models.Filter{
-		IP:       r.URL.Query().Get("ip"),
-		Protocol: r.URL.Query().Get("protocol"),
+		Interface: r.URL.Query().Get("interface"),
+		IP:        r.URL.Query().Get("ip"),
+		Protocol:  r.URL.Query().Get("protocol"),
+		Process:   r.URL.Query().Get("process"),
+		Workload:  r.URL.Query().Get("workload"),
+		Domain:    r.URL.Query().Get("domain"),
+		SNI:       r.URL.Query().Get("sni"),
+
+		AppProtocol: r.URL.Query().Get("app_protocol"),
 	}
 	
 	if portStr := r.URL.Query().Get("port"); portStr != "" {
@@ -60,12 +130,287 @@ func (h *Handler) ConnectionList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if vlanStr := r.URL.Query().Get("vlan"); vlanStr != "" {
+		vlan, err := strconv.ParseUint(vlanStr, 10, 12)
+		if err != nil {
+			http.Error(w, "Invalid vlan", http.StatusBadRequest)
+			return
+		}
+		filter.VLAN = uint16(vlan)
+	}
+
+	// TCP health filters
+	if rateStr := r.URL.Query().Get("min_retransmit_rate"); rateStr != "" {
+		rate, err := parseRate(rateStr)
+		if err != nil {
+			http.Error(w, "Invalid min_retransmit_rate", http.StatusBadRequest)
+			return
+		}
+		filter.MinRetransmitRate = rate
+	}
+	if rttStr := r.URL.Query().Get("min_rtt_ms"); rttStr != "" {
+		rtt, err := strconv.ParseFloat(rttStr, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_rtt_ms", http.StatusBadRequest)
+			return
+		}
+		filter.MinRTTMs = rtt
+	}
+	if zeroStr := r.URL.Query().Get("zero_window"); zeroStr != "" {
+		zero, err := strconv.ParseBool(zeroStr)
+		if err != nil {
+			http.Error(w, "Invalid zero_window", http.StatusBadRequest)
+			return
+		}
+		filter.ZeroWindow = zero
+	}
+	if resetStr := r.URL.Query().Get("reset"); resetStr != "" {
+		reset, err := strconv.ParseBool(resetStr)
+		if err != nil {
+			http.Error(w, "Invalid reset", http.StatusBadRequest)
+			return
+		}
+		filter.Reset = reset
+	}
+
+	// ICMP filters
+	if typeStr := r.URL.Query().Get("icmp_type"); typeStr != "" {
+		typ, err := strconv.ParseUint(typeStr, 10, 8)
+		if err != nil {
+			http.Error(w, "Invalid icmp_type", http.StatusBadRequest)
+			return
+		}
+		icmpType := uint8(typ)
+		filter.ICMPType = &icmpType
+	}
+	if codeStr := r.URL.Query().Get("icmp_code"); codeStr != "" {
+		code, err := strconv.ParseUint(codeStr, 10, 8)
+		if err != nil {
+			http.Error(w, "Invalid icmp_code", http.StatusBadRequest)
+			return
+		}
+		icmpCode := uint8(code)
+		filter.ICMPCode = &icmpCode
+	}
+	if errorStr := r.URL.Query().Get("icmp_error"); errorStr != "" {
+		icmpError, err := strconv.ParseBool(errorStr)
+		if err != nil {
+			http.Error(w, "Invalid icmp_error", http.StatusBadRequest)
+			return
+		}
+		filter.ICMPError = icmpError
+	}
+
 	connections := h.storage.GetFilteredConnections(filter)
+
+	// Totals per process etc. instead of the individual connections
+	if by := r.URL.Query().Get("group_by"); by != "" {
+		groups, err := storage.GroupFlows(connections, by)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+		return
+	}
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(connections)
 }
 
+// TrafficBySNI totals the active TLS connections by server name, busiest
+// first; CDN addresses serve many sites, so this is where the traffic goes
+func (h *Handler) TrafficBySNI(w http.ResponseWriter, r *http.Request) {
+	filter := &models.Filter{Interface: r.URL.Query().Get("interface")}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 0)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	groups, _ := storage.GroupFlows(h.storage.GetFilteredConnections(filter), "sni")
+	result := make([]*models.FlowGroup, 0, len(groups))
+	for _, group := range groups {
+		// Not TLS, or no server name sent
+		if group.Key == "" {
+			continue
+		}
+		result = append(result, group)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DNSQueries returns the most recent DNS lookups, newest first
+func (h *Handler) DNSQueries(w http.ResponseWriter, r *http.Request) {
+	filter := &models.DNSFilter{
+		Interface: r.URL.Query().Get("interface"),
+		Domain:    r.URL.Query().Get("domain"),
+		RCode:     r.URL.Query().Get("rcode"),
+		Client:    r.URL.Query().Get("client"),
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 100)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	queries := h.storage.GetDNSQueries(filter, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queries)
+}
+
+// DNSDomains returns the top domains by queries, NXDOMAIN responses or bytes
+func (h *Handler) DNSDomains(w http.ResponseWriter, r *http.Request) {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "queries"
+	}
+	valid := false
+	for _, s := range storage.DomainSorts {
+		valid = valid || s == sortBy
+	}
+	if !valid {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s", strings.Join(storage.DomainSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 20)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	domains := h.storage.GetDomainStats(sortBy, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domains)
+}
+
+// DNSStats returns the totals of all DNS lookups, including the NXDOMAIN rate
+func (h *Handler) DNSStats(w http.ResponseWriter, r *http.Request) {
+	stats := h.storage.GetDNSStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// HTTPRequests returns the most recent HTTP requests, newest first
+func (h *Handler) HTTPRequests(w http.ResponseWriter, r *http.Request) {
+	filter := &models.HTTPFilter{
+		Interface: r.URL.Query().Get("interface"),
+		Host:      r.URL.Query().Get("host"),
+		Method:    r.URL.Query().Get("method"),
+		Path:      r.URL.Query().Get("path"),
+		Client:    r.URL.Query().Get("client"),
+	}
+	if statusStr := r.URL.Query().Get("status"); statusStr != "" {
+		minStatus, maxStatus, err := parseStatus(statusStr)
+		if err != nil {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		filter.MinStatus, filter.MaxStatus = minStatus, maxStatus
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 100)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	requests := h.storage.GetHTTPRequests(filter, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// HTTPHosts returns the top hosts by requests, errors or bytes
+func (h *Handler) HTTPHosts(w http.ResponseWriter, r *http.Request) {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "requests"
+	}
+	valid := false
+	for _, s := range storage.HTTPHostSorts {
+		valid = valid || s == sortBy
+	}
+	if !valid {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s", strings.Join(storage.HTTPHostSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 20)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	hosts := h.storage.GetHTTPHostStats(sortBy, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+// HTTPStatus returns the number of responses per status code
+func (h *Handler) HTTPStatus(w http.ResponseWriter, r *http.Request) {
+	stats := h.storage.GetHTTPStatusStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Neighbors returns the IP to MAC bindings learned from ARP and NDP
+func (h *Handler) Neighbors(w http.ResponseWriter, r *http.Request) {
+	filter := &models.NeighborFilter{
+		Interface: r.URL.Query().Get("interface"),
+		IP:        r.URL.Query().Get("ip"),
+		Vendor:    r.URL.Query().Get("vendor"),
+	}
+	if macStr := r.URL.Query().Get("mac"); macStr != "" {
+		mac, err := net.ParseMAC(macStr)
+		if err != nil {
+			http.Error(w, "Invalid mac", http.StatusBadRequest)
+			return
+		}
+		filter.MAC = mac.String()
+	}
+
+	neighbors := h.storage.GetNeighbors(filter)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(neighbors)
+}
+
+// NeighborEvents returns the most recent duplicate IP, MAC flapping and
+// gratuitous ARP events, newest first
+func (h *Handler) NeighborEvents(w http.ResponseWriter, r *http.Request) {
+	typ := r.URL.Query().Get("type")
+	if typ != "" {
+		valid := false
+		for _, t := range models.NeighborEventTypes {
+			valid = valid || t == typ
+		}
+		if !valid {
+			http.Error(w, fmt.Sprintf("Invalid type, expected one of %s", strings.Join(models.NeighborEventTypes, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), 100)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	events := h.storage.GetNeighborEvents(r.URL.Query().Get("interface"), typ, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
 // HistoricalTraffic returns historical traffic data
 func (h *Handler) HistoricalTraffic(w http.ResponseWriter, r *http.Request) {
 	// Parse time range
@@ -102,7 +447,7 @@ func (h *Handler) HistoricalTraffic(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get historical data
-	data, err := h.historicalStore.GetHistoricalData(start, end)
+	data, err := h.historicalStore.GetHistoricalData(start, end, r.URL.Query().Get("interface"))
 	if err != nil {
 		http.Error(w, "Failed to retrieve historical data", http.StatusInternalServerError)
 		return
@@ -148,11 +493,15 @@ func (h *Handler) ListInterfaces(w http.ResponseWriter, r *http.Request) {
 	type Response struct {
 		Interfaces []InterfaceInfo `json:"interfaces"`
 		Current    string          `json:"current"`
+		Active     []string        `json:"active"`
+		Filter     string          `json:"filter"`
 	}
 	
 	response := Response{
 		Interfaces: interfaces,
 		Current:    h.captureManager.GetCurrentInterface(),
+		Active:     h.captureManager.GetInterfaces(),
+		Filter:     h.captureManager.GetFilter(),
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
@@ -169,7 +518,8 @@ func (h *Handler) SwitchInterface(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	var req struct {
-		Interface string `json:"interface"`
+		Interface string  `json:"interface"`
+		Filter    *string `json:"filter"` // nil keeps the current filter
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -187,9 +537,18 @@ func (h *Handler) SwitchInterface(w http.ResponseWriter, r *http.Request) {
 	currentInterface := h.captureManager.GetCurrentInterface()
 	fmt.Printf("[Interface] Client %s requesting switch from '%s' to '%s'\n", clientIP, currentInterface, req.Interface)
 	
-	// Switch to the new interface
-	if err := h.captureManager.SwitchInterface(req.Interface); err != nil {
+	// Switch to the new interface; the filter is validated against it and
+	// only takes effect if the switch succeeds
+	if err := h.captureManager.SwitchInterface(req.Interface, req.Filter); err != nil {
 		fmt.Printf("[Interface] Failed to switch interface for client %s: %v\n", clientIP, err)
+		if errors.As(err, new(*capture.FilterError)) {
+			filter := h.captureManager.GetFilter()
+			if req.Filter != nil {
+				filter = *req.Filter
+			}
+			writeFilterError(w, filter, err)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Failed to switch interface: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -201,6 +560,112 @@ func (h *Handler) SwitchInterface(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "success",
 		"interface": req.Interface,
+		"filter": h.captureManager.GetFilter(),
+	})
+}
+
+// AddInterface starts capturing on an additional interface
+func (h *Handler) AddInterface(w http.ResponseWriter, r *http.Request) {
+	h.changeInterfaces(w, r, "add", h.captureManager.AddInterface)
+}
+
+// RemoveInterface stops capturing on one interface
+func (h *Handler) RemoveInterface(w http.ResponseWriter, r *http.Request) {
+	h.changeInterfaces(w, r, "remove", h.captureManager.RemoveInterface)
+}
+
+// changeInterfaces handles the add/remove interface requests
+func (h *Handler) changeInterfaces(w http.ResponseWriter, r *http.Request, action string, apply func(string) error) {
+	clientIP := getClientIP(r)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Interface string `json:"interface"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fmt.Printf("[Interface] Client %s sent invalid request body: %v\n", clientIP, err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Interface == "" {
+		fmt.Printf("[Interface] Client %s sent empty interface name\n", clientIP)
+		http.Error(w, "Interface name is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := apply(req.Interface); err != nil {
+		fmt.Printf("[Interface] Failed to %s interface '%s' for client %s: %v\n", action, req.Interface, clientIP, err)
+		if errors.As(err, new(*capture.FilterError)) {
+			writeFilterError(w, h.captureManager.GetFilter(), err)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to %s interface: %v", action, err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[Interface] Client %s: %s interface '%s' succeeded\n", clientIP, action, req.Interface)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "success",
+		"interface":  req.Interface,
+		"interfaces": h.captureManager.GetInterfaces(),
+	})
+}
+
+// CaptureFilter returns (GET) or replaces (POST) the active BPF filter
+func (h *Handler) CaptureFilter(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Filter string `json:"filter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Printf("[Filter] Client %s sent invalid request body: %v\n", clientIP, err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.captureManager.SetFilter(req.Filter); err != nil {
+			fmt.Printf("[Filter] Failed to set filter for client %s: %v\n", clientIP, err)
+			writeFilterError(w, req.Filter, err)
+			return
+		}
+		fmt.Printf("[Filter] Client %s set filter to '%s'\n", clientIP, req.Filter)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"filter": h.captureManager.GetFilter(),
+	})
+}
+
+// writeFilterError reports a rejected BPF filter. Compile errors are the
+// client's fault and come back as a structured 400.
+func writeFilterError(w http.ResponseWriter, filter string, err error) {
+	var filterErr *capture.FilterError
+	if !errors.As(err, &filterErr) {
+		http.Error(w, fmt.Sprintf("Failed to set filter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":  "invalid_filter",
+		"filter": filter,
+		"detail": filterErr.Err.Error(),
 	})
 }
 
@@ -221,6 +686,9 @@ func (h *Handler) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("[WebSocket] Client %s connected successfully\n", clientIP)
 
+	// Optional interface selector; empty streams every interface
+	iface := r.URL.Query().Get("interface")
+
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	
@@ -229,13 +697,13 @@ func (h *Handler) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	defer historicalTicker.Stop()
 	
 	// Save initial snapshot immediately
-	initialSnapshot := h.storage.GetSnapshot()
+	initialSnapshot := h.storage.GetSnapshot("")
 	go h.historicalStore.SaveSnapshot(initialSnapshot)
 
 	for {
 		select {
 		case <-ticker.C:
-			snapshot := h.storage.GetSnapshot()
+			snapshot := h.storage.GetSnapshot(iface)
 			
 			// Send snapshot to client
 			if err := conn.WriteJSON(snapshot); err != nil {
@@ -244,12 +712,51 @@ func (h *Handler) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		case <-historicalTicker.C:
 			// Save to historical storage periodically
-			snapshot := h.storage.GetSnapshot()
+			snapshot := h.storage.GetSnapshot("")
 			go h.historicalStore.SaveSnapshot(snapshot)
 		}
 	}
 }
 
+// parseLimit parses a result limit, returning def when it is absent; 0
+// means no limit
+func parseLimit(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	return limit, nil
+}
+
+// parseStatus parses a status code ("404") or class ("4xx") into a range
+func parseStatus(s string) (int, int, error) {
+	if class, ok := strings.CutSuffix(strings.ToLower(s), "xx"); ok && len(class) == 1 {
+		digit, err := strconv.Atoi(class)
+		if err != nil || digit < 1 || digit > 5 {
+			return 0, 0, fmt.Errorf("invalid status class %q", s)
+		}
+		return digit * 100, digit*100 + 99, nil
+	}
+	status, err := strconv.Atoi(s)
+	if err != nil || status < 100 || status > 999 {
+		return 0, 0, fmt.Errorf("invalid status %q", s)
+	}
+	return status, status, nil
+}
+
+// parseRate parses a ratio given either as a fraction ("0.01") or as a
+// percentage ("1%")
+func parseRate(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return pct / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
 // getClientIP extracts the client IP address from the request
 func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header first
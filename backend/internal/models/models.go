@@ -6,6 +6,7 @@ import (
 
 // Connection represents a network connection
 type Connection struct {
+	Interface   string    `json:"interface"`
 	SrcIP       string    `json:"src_ip"`
 	SrcPort     uint16    `json:"src_port"`
 	DstIP       string    `json:"dst_ip"`
@@ -16,6 +17,230 @@ type Connection struct {
 	Packets     uint64    `json:"packets"`
 	StartTime   time.Time `json:"start_time"`
 	LastSeen    time.Time `json:"last_seen"`
+
+	// Rates are computed from counter deltas at each tick and smoothed
+	PacketsPerSec     uint64 `json:"packets_per_sec"`
+	PeakBytesPerSec   uint64 `json:"peak_bytes_per_sec"`
+	PeakPacketsPerSec uint64 `json:"peak_packets_per_sec"`
+
+	// 802.1Q tags; InnerVLAN is the customer tag of QinQ (802.1ad) frames
+	VLAN      uint16 `json:"vlan,omitempty"`
+	InnerVLAN uint16 `json:"inner_vlan,omitempty"`
+	// MPLS label stack of the latest packet, outermost first
+	MPLSLabels []uint32 `json:"mpls_labels,omitempty"`
+	// Ethernet addresses of the client and server side of the outer frame;
+	// for peers off the link that is the address of the router
+	SrcMAC string `json:"src_mac,omitempty"`
+	DstMAC string `json:"dst_mac,omitempty"`
+
+	// Application protocol, e.g. "HTTP", from payload signatures or the
+	// well-known port; the confidence is 1 for a signature on the expected
+	// port down to 0.4 for the port alone
+	AppProtocol   string  `json:"app_protocol,omitempty"`
+	AppConfidence float64 `json:"app_confidence,omitempty"`
+
+	// Domain whose DNS answer pointed at the server address
+	Domain string `json:"domain,omitempty"`
+
+	// Clear text part of the TLS handshake, if the connection is TLS or
+	// QUIC, whose Initial packets can be decrypted. TLS over TCP isn't
+	// followed when sampling.
+	TLS *TLSInfo `json:"tls,omitempty"`
+
+	// QUIC version and connection IDs, if the connection is QUIC
+	QUIC *QUICInfo `json:"quic,omitempty"`
+
+	// Local process owning the socket, if the connection is local
+	Process *ProcessInfo `json:"process,omitempty"`
+
+	// Container and pod of the local process, if it runs in one
+	Workload *WorkloadInfo `json:"workload,omitempty"`
+
+	// Tunnel carrying the connection; only set when decapsulating
+	Tunnel *TunnelInfo `json:"tunnel,omitempty"`
+
+	TCP  *TCPMetrics `json:"tcp,omitempty"`  // nil unless the connection is TCP and not sampled
+	ICMP *ICMPInfo   `json:"icmp,omitempty"` // nil unless the connection is ICMP/ICMPv6
+}
+
+// ProcessInfo identifies the process owning a local socket
+type ProcessInfo struct {
+	PID    int    `json:"pid"`
+	Name   string `json:"name"` // command name
+	UID    uint32 `json:"uid"`
+	User   string `json:"user"`
+	Cgroup string `json:"cgroup,omitempty"`
+}
+
+// WorkloadInfo identifies the container, and the Kubernetes pod, a local
+// process runs in. Names are only known when a Docker socket or kubelet pod
+// list is configured.
+type WorkloadInfo struct {
+	ContainerID   string `json:"container_id"`
+	ContainerName string `json:"container_name,omitempty"`
+	Runtime       string `json:"runtime,omitempty"` // "docker", "containerd", "cri-o" or "podman"
+	PodName       string `json:"pod_name,omitempty"`
+	PodNamespace  string `json:"pod_namespace,omitempty"`
+	PodUID        string `json:"pod_uid,omitempty"`
+}
+
+// Name is the most specific name known: namespace/pod/container, the
+// container name or a short container ID
+func (w *WorkloadInfo) Name() string {
+	switch {
+	case w.PodName != "" && w.ContainerName != "":
+		return w.PodNamespace + "/" + w.PodName + "/" + w.ContainerName
+	case w.PodName != "":
+		return w.PodNamespace + "/" + w.PodName
+	case w.ContainerName != "":
+		return w.ContainerName
+	case len(w.ContainerID) > 12:
+		return w.ContainerID[:12]
+	}
+	return w.ContainerID
+}
+
+// TunnelInfo describes the outer headers of a decapsulated connection
+type TunnelInfo struct {
+	Type  string `json:"type"` // "vxlan", "geneve", "gre" or "ipip"
+	SrcIP string `json:"src_ip"`
+	DstIP string `json:"dst_ip"`
+	VNI   uint32 `json:"vni,omitempty"` // VXLAN/GENEVE network identifier or GRE key
+}
+
+// TLSInfo is what the clear text part of a TLS handshake reveals
+type TLSInfo struct {
+	SNI            string   `json:"sni,omitempty"`
+	ALPN           []string `json:"alpn,omitempty"` // offered by the client
+	NegotiatedALPN string   `json:"negotiated_alpn,omitempty"`
+	// Version is the negotiated version, e.g. "TLS 1.3", or the best one the
+	// client offered until the server answers
+	Version     string `json:"version,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	// Client fingerprints: JA3 is an MD5 hex digest, JA4 is in the
+	// t13d1516h2_8daaf6152771_e5627efa2ab1 format
+	JA3 string `json:"ja3,omitempty"`
+	JA4 string `json:"ja4,omitempty"`
+	// Server certificate; TLS 1.3 encrypts it
+	Certificate *CertificateInfo `json:"certificate,omitempty"`
+}
+
+// QUICInfo describes a QUIC connection. Connection IDs are hex; the flow
+// follows the connection by them when the client's address changes.
+type QUICInfo struct {
+	Version    string `json:"version"` // "v1", "v2", "draft-29" or the hex number
+	ClientCID  string `json:"client_cid,omitempty"`
+	ServerCID  string `json:"server_cid,omitempty"`
+	Migrations uint64 `json:"migrations,omitempty"` // times the client's address changed
+}
+
+// CertificateInfo describes the leaf certificate a server presented
+type CertificateInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// TCPMetrics describes the health of a TCP session
+type TCPMetrics struct {
+	// Handshake timing: SYN → SYN/ACK is the server side (network plus the
+	// server's stack), SYN/ACK → ACK the client side. Zero until the
+	// handshake has been seen.
+	HandshakeRTTMs float64 `json:"handshake_rtt_ms"`
+	ServerRTTMs    float64 `json:"server_rtt_ms"`
+	ClientRTTMs    float64 `json:"client_rtt_ms"`
+
+	DataSegments    uint64  `json:"data_segments"`
+	Retransmissions uint64  `json:"retransmissions"`
+	OutOfOrder      uint64  `json:"out_of_order"`
+	DuplicateAcks   uint64  `json:"duplicate_acks"`
+	ZeroWindows     uint64  `json:"zero_windows"` // times a receiver advertised a zero window
+	Resets          uint64  `json:"resets"`
+	RetransmitRate  float64 `json:"retransmit_rate"` // retransmissions / data segments
+}
+
+// ICMPInfo describes an ICMP or ICMPv6 flow. Requests and their replies share
+// a flow, which takes the type and code of the first message seen.
+type ICMPInfo struct {
+	Type        uint8  `json:"type"`
+	Code        uint8  `json:"code"`
+	Description string `json:"description"`
+	Identifier  uint16 `json:"identifier,omitempty"` // echo identifier
+	MTU         uint32 `json:"mtu,omitempty"`        // reported by packet-too-big / fragmentation-needed
+	// RelatedFlow is the key of the flow an error message refers to, taken
+	// from the packet quoted in the error
+	RelatedFlow string `json:"related_flow,omitempty"`
+}
+
+// Flow is a bidirectional connection. The embedded Connection is oriented
+// client → server (Src is the client) and carries the totals of both
+// directions.
+type Flow struct {
+	Connection
+	Key             string `json:"key"`
+	ClientBytes     uint64 `json:"client_bytes"` // client → server
+	ServerBytes     uint64 `json:"server_bytes"` // server → client
+	ClientPackets   uint64 `json:"client_packets"`
+	ServerPackets   uint64 `json:"server_packets"`
+	Initiator       string `json:"initiator"`            // client address as ip:port
+	InitiatorMethod string `json:"initiator_method"`     // "syn", "port", "icmp" or "first_packet"
+	State           string `json:"state"`                // "active", "closing" or "closed"
+	EndReason       string `json:"end_reason,omitempty"` // why the flow ended, once it has
+
+	// ICMP errors (unreachable, time exceeded, ...) quoting a packet of this flow
+	ICMPErrors    uint64 `json:"icmp_errors,omitempty"`
+	LastICMPError string `json:"last_icmp_error,omitempty"`
+
+	// When sampling, the byte and packet counters are extrapolated from one
+	// packet in SamplingRate; EstimatedError is their relative error at 95%
+	// confidence (0.1 for ±10%)
+	SamplingRate   uint64  `json:"sampling_rate,omitempty"`
+	EstimatedError float64 `json:"estimated_error,omitempty"`
+}
+
+// Clone returns a deep copy of the flow that is safe to hand to other goroutines
+func (f *Flow) Clone() *Flow {
+	flowCopy := *f
+	if f.TCP != nil {
+		tcpCopy := *f.TCP
+		flowCopy.TCP = &tcpCopy
+	}
+	if f.MPLSLabels != nil {
+		flowCopy.MPLSLabels = append([]uint32(nil), f.MPLSLabels...)
+	}
+	if f.Process != nil {
+		processCopy := *f.Process
+		flowCopy.Process = &processCopy
+	}
+	if f.Workload != nil {
+		workloadCopy := *f.Workload
+		flowCopy.Workload = &workloadCopy
+	}
+	if f.Tunnel != nil {
+		tunnelCopy := *f.Tunnel
+		flowCopy.Tunnel = &tunnelCopy
+	}
+	if f.ICMP != nil {
+		icmpCopy := *f.ICMP
+		flowCopy.ICMP = &icmpCopy
+	}
+	if f.QUIC != nil {
+		quicCopy := *f.QUIC
+		flowCopy.QUIC = &quicCopy
+	}
+	if f.TLS != nil {
+		tlsCopy := *f.TLS
+		tlsCopy.ALPN = append([]string(nil), f.TLS.ALPN...)
+		if f.TLS.Certificate != nil {
+			certCopy := *f.TLS.Certificate
+			certCopy.DNSNames = append([]string(nil), f.TLS.Certificate.DNSNames...)
+			tlsCopy.Certificate = &certCopy
+		}
+		flowCopy.TLS = &tlsCopy
+	}
+	return &flowCopy
 }
 
 // InterfaceStats represents network interface statistics
@@ -29,13 +254,265 @@ type InterfaceStats struct {
 	OutPackets       uint64 `json:"out_packets"`
 	InPacketsPerSec  uint64 `json:"in_packets_per_sec"`
 	OutPacketsPerSec uint64 `json:"out_packets_per_sec"`
+
+	// When sampling, the counters are extrapolated from one packet in
+	// SamplingRate; EstimatedError is their relative error at 95%
+	// confidence (0.1 for ±10%)
+	SamplingRate   uint64  `json:"sampling_rate,omitempty"`
+	EstimatedError float64 `json:"estimated_error,omitempty"`
+}
+
+// VLANStats are the interface counters of the traffic carrying one VLAN tag
+// (or QinQ tag pair). VLAN 0 holds the untagged traffic.
+type VLANStats struct {
+	InterfaceStats
+	VLAN      uint16 `json:"vlan"`
+	InnerVLAN uint16 `json:"inner_vlan,omitempty"`
+}
+
+// MACStats are the counters of one Ethernet address, for every frame
+// regardless of its EtherType. In counts the frames sent to the address and
+// Out the frames it sent; broadcast and multicast addresses only receive.
+type MACStats struct {
+	InterfaceStats
+	MAC                 string `json:"mac"`
+	Kind                string `json:"kind"`             // "unicast", "multicast" or "broadcast"
+	Vendor              string `json:"vendor,omitempty"` // from the OUI
+	LocallyAdministered bool   `json:"locally_administered,omitempty"`
+	// Frames the address sent to broadcast and multicast addresses,
+	// included in Out
+	BroadcastBytes   uint64 `json:"broadcast_bytes"`
+	BroadcastPackets uint64 `json:"broadcast_packets"`
+	MulticastBytes   uint64 `json:"multicast_bytes"`
+	MulticastPackets uint64 `json:"multicast_packets"`
+	// Frames sent per EtherType, e.g. "IPv4", "ARP" or "0x88cc"
+	EtherTypes map[string]uint64 `json:"ether_types,omitempty"`
+	FirstSeen  time.Time         `json:"first_seen"`
+	LastSeen   time.Time         `json:"last_seen"`
+}
+
+// Kinds of Ethernet address
+const (
+	MACUnicast   = "unicast"
+	MACMulticast = "multicast"
+	MACBroadcast = "broadcast"
+)
+
+// MACFilter selects entries of the per-MAC counters
+type MACFilter struct {
+	Interface string `json:"interface,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Vendor    string `json:"vendor,omitempty"` // case-insensitive substring
 }
 
-// TrafficSnapshot represents traffic data at a point in time
+// CaptureStats reports how many packets a capture saw and how many it lost.
+// Counters are cumulative since the capture started.
+type CaptureStats struct {
+	Interface        string `json:"interface"`
+	PacketsReceived  uint64 `json:"packets_received"`   // seen by libpcap
+	PacketsDropped   uint64 `json:"packets_dropped"`    // dropped by the kernel
+	PacketsIfDropped uint64 `json:"packets_if_dropped"` // dropped by the interface
+	DecoderDropped   uint64 `json:"decoder_dropped"`    // undecodable packets
+	PacketsProcessed uint64 `json:"packets_processed"`
+	Backlog          int    `json:"backlog"` // packets waiting to be processed
+
+	// When sampling, only one packet in SamplingRate is processed and the
+	// traffic counters of the interface and its connections are extrapolated.
+	// EstimatedError is the relative error of the interface totals at 95%
+	// confidence (0.1 for ±10%).
+	Sampling       string  `json:"sampling,omitempty"` // "count" or "random"
+	SamplingRate   uint64  `json:"sampling_rate,omitempty"`
+	EstimatedError float64 `json:"estimated_error,omitempty"`
+
+	// IP reassembly: fragments are dropped when their datagram times out,
+	// exceeds the memory limits or is malformed
+	DatagramsReassembled uint64 `json:"datagrams_reassembled"`
+	FragmentsDropped     uint64 `json:"fragments_dropped"`
+	FragmentsPending     int    `json:"fragments_pending"` // bytes waiting for the rest of their datagram
+
+	Lossy     bool      `json:"lossy"` // drops increased since the last tick
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TrafficSnapshot represents traffic data at a point in time. Interface holds
+// the selected interface, or the sum of all interfaces when none is selected.
 type TrafficSnapshot struct {
-	Timestamp   time.Time       `json:"timestamp"`
-	Interface   *InterfaceStats `json:"interface"`
-	Connections []*Connection   `json:"connections"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Interface    *InterfaceStats   `json:"interface"`
+	Interfaces   []*InterfaceStats `json:"interfaces"`
+	Connections  []*Flow           `json:"connections"`
+	CaptureStats []*CaptureStats   `json:"capture_stats"`
+	VLANs        []*VLANStats      `json:"vlans,omitempty"` // only for trunks carrying tagged traffic
+}
+
+// FlowGroup is the total of the connections sharing a value of the grouping
+// dimension, e.g. all connections of one process
+type FlowGroup struct {
+	Key           string `json:"key"` // empty for connections without a value
+	Connections   int    `json:"connections"`
+	Bytes         uint64 `json:"bytes"`
+	BytesPerSec   uint64 `json:"bytes_per_sec"`
+	Packets       uint64 `json:"packets"`
+	PacketsPerSec uint64 `json:"packets_per_sec"`
+}
+
+// DNSQuery is a DNS lookup seen on the wire: the query and, once it arrives,
+// its response. Responses without a query, e.g. mDNS announcements, are
+// logged on their own.
+type DNSQuery struct {
+	Timestamp  time.Time `json:"timestamp"` // when the query was sent
+	Interface  string    `json:"interface"`
+	Transport  string    `json:"transport"` // "UDP" or "TCP"
+	ClientIP   string    `json:"client_ip"`
+	ClientPort uint16    `json:"client_port"`
+	ServerIP   string    `json:"server_ip"`
+	ID         uint16    `json:"id"`
+	Name       string    `json:"name"` // lower case, without the trailing dot
+	Type       string    `json:"type"` // "A", "AAAA", ...
+	// RCode is the response code, e.g. "NOERROR" or "NXDOMAIN", or
+	// "TIMEOUT" when no response arrived
+	RCode     string   `json:"rcode"`
+	Answers   []string `json:"answers,omitempty"` // addresses and names from the answer section
+	LatencyMs float64  `json:"latency_ms,omitempty"`
+}
+
+// RCodeTimeout is the RCode of queries that never got a response
+const RCodeTimeout = "TIMEOUT"
+
+// DNSFilter selects entries of the DNS log
+type DNSFilter struct {
+	Interface string `json:"interface,omitempty"`
+	Domain    string `json:"domain,omitempty"` // domain or any of its subdomains
+	RCode     string `json:"rcode,omitempty"`  // case-insensitive
+	Client    string `json:"client,omitempty"` // client address
+}
+
+// DomainStats totals the lookups of a domain and the traffic of the
+// connections to the addresses it resolved to. Counters are cumulative.
+type DomainStats struct {
+	Domain       string    `json:"domain"`
+	Queries      uint64    `json:"queries"`
+	NXDomain     uint64    `json:"nxdomain"`
+	Timeouts     uint64    `json:"timeouts"`
+	NXDomainRate float64   `json:"nxdomain_rate"` // NXDomain / Queries
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	Bytes        uint64    `json:"bytes"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// DNSStats totals every lookup seen. Counters are cumulative.
+type DNSStats struct {
+	Queries      uint64  `json:"queries"`
+	Answered     uint64  `json:"answered"`
+	NXDomain     uint64  `json:"nxdomain"`
+	ServFail     uint64  `json:"servfail"`
+	Timeouts     uint64  `json:"timeouts"`
+	NXDomainRate float64 `json:"nxdomain_rate"` // NXDomain / Queries
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// HTTPRequest is an HTTP/1.x request and its response, reassembled from a
+// plaintext connection. Requests whose response wasn't seen have no status.
+type HTTPRequest struct {
+	Timestamp    time.Time `json:"timestamp"` // when the request started
+	Interface    string    `json:"interface"`
+	ClientIP     string    `json:"client_ip"`
+	ClientPort   uint16    `json:"client_port"`
+	ServerIP     string    `json:"server_ip,omitempty"`
+	ServerPort   uint16    `json:"server_port,omitempty"`
+	Method       string    `json:"method,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	RequestSize  int64     `json:"request_size"`         // body bytes
+	ResponseSize int64     `json:"response_size"`        // body bytes, as transferred
+	LatencyMs    float64   `json:"latency_ms,omitempty"` // request start to response start
+	Complete     bool      `json:"complete"`             // the whole response was seen
+}
+
+// HTTPFilter selects entries of the HTTP request log
+type HTTPFilter struct {
+	Interface string `json:"interface,omitempty"`
+	Host      string `json:"host,omitempty"`   // host or any of its subdomains
+	Method    string `json:"method,omitempty"` // case-insensitive
+	Path      string `json:"path,omitempty"`   // path prefix
+	Client    string `json:"client,omitempty"` // client address
+	// Status code range, inclusive; zero bounds are open
+	MinStatus int `json:"min_status,omitempty"`
+	MaxStatus int `json:"max_status,omitempty"`
+}
+
+// HTTPHostStats totals the requests to one host. Counters are cumulative.
+type HTTPHostStats struct {
+	Host         string    `json:"host"`
+	Requests     uint64    `json:"requests"`
+	ClientErrors uint64    `json:"client_errors"` // 4xx
+	ServerErrors uint64    `json:"server_errors"` // 5xx
+	NoResponse   uint64    `json:"no_response"`
+	Bytes        uint64    `json:"bytes"` // request and response bodies
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// HTTPStatusStats counts the responses with one status code
+type HTTPStatusStats struct {
+	StatusCode int    `json:"status_code"` // 0 for requests without a response
+	Requests   uint64 `json:"requests"`
+}
+
+// Neighbor is an IP to MAC binding learned from ARP or IPv6 neighbor
+// discovery on the local link
+type Neighbor struct {
+	Interface string `json:"interface"`
+	VLAN      uint16 `json:"vlan,omitempty"`
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	Vendor    string `json:"vendor,omitempty"` // from the MAC's OUI
+	// LocallyAdministered MACs are assigned by software, e.g. randomized or
+	// virtual ones, and have no vendor
+	LocallyAdministered bool      `json:"locally_administered,omitempty"`
+	Protocol            string    `json:"protocol"`         // "ARP" or "NDP"
+	Router              bool      `json:"router,omitempty"` // advertised itself as an IPv6 router
+	FirstSeen           time.Time `json:"first_seen"`
+	LastSeen            time.Time `json:"last_seen"`
+	Packets             uint64    `json:"packets"` // ARP and NDP messages from the neighbor
+	PreviousMAC         string    `json:"previous_mac,omitempty"`
+	MACChanges          uint64    `json:"mac_changes"`
+}
+
+// Neighbor anomaly types
+const (
+	// NeighborDuplicateIP is a second MAC claiming an address while the
+	// first is still using it
+	NeighborDuplicateIP = "duplicate_ip"
+	// NeighborGratuitousARP is an unrequested announcement of a binding:
+	// a gratuitous ARP or an unsolicited neighbor advertisement
+	NeighborGratuitousARP = "gratuitous_arp"
+	// NeighborMACFlap is an address moving back to the MAC it just left
+	NeighborMACFlap = "mac_flap"
+)
+
+// NeighborEventTypes are the anomaly types, in order of severity
+var NeighborEventTypes = []string{NeighborDuplicateIP, NeighborMACFlap, NeighborGratuitousARP}
+
+// NeighborEvent is an anomaly seen in the ARP or NDP traffic of a link
+type NeighborEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Interface   string    `json:"interface"`
+	VLAN        uint16    `json:"vlan,omitempty"`
+	Type        string    `json:"type"`
+	Protocol    string    `json:"protocol"` // "ARP" or "NDP"
+	IP          string    `json:"ip"`
+	MAC         string    `json:"mac"`
+	PreviousMAC string    `json:"previous_mac,omitempty"` // the MAC the address was bound to
+}
+
+// NeighborFilter selects entries of the neighbor table
+type NeighborFilter struct {
+	Interface string `json:"interface,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+	Vendor    string `json:"vendor,omitempty"` // case-insensitive substring
 }
 
 // HistoricalData represents aggregated historical traffic data
@@ -49,7 +526,27 @@ type HistoricalData struct {
 
 // Filter represents traffic filter criteria
 type Filter struct {
-	IP       string `json:"ip,omitempty"`
-	Port     uint16 `json:"port,omitempty"`
-	Protocol string `json:"protocol,omitempty"`
-}
\ No newline at end of file
+	Interface string `json:"interface,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Port      uint16 `json:"port,omitempty"`
+	Protocol  string `json:"protocol,omitempty"` // case-insensitive; "icmp" matches ICMPv6 too
+	VLAN      uint16 `json:"vlan,omitempty"`     // outer or inner tag
+	Process   string `json:"process,omitempty"`  // command name or PID
+	Workload  string `json:"workload,omitempty"` // pod, namespace/pod, container name or ID prefix
+	Domain    string `json:"domain,omitempty"`   // domain or any of its subdomains
+	SNI       string `json:"sni,omitempty"`      // TLS server name or any of its subdomains
+
+	// Application protocol, case-insensitive
+	AppProtocol string `json:"app_protocol,omitempty"`
+
+	// ICMP message type and code; nil matches any
+	ICMPType *uint8 `json:"icmp_type,omitempty"`
+	ICMPCode *uint8 `json:"icmp_code,omitempty"`
+
+	// TCP health, e.g. "connections with retransmit rate > 1%"
+	MinRetransmitRate float64 `json:"min_retransmit_rate,omitempty"`
+	MinRTTMs          float64 `json:"min_rtt_ms,omitempty"`
+	ZeroWindow        bool    `json:"zero_window,omitempty"` // only flows that hit a zero window
+	Reset             bool    `json:"reset,omitempty"`       // only flows that were reset
+	ICMPError         bool    `json:"icmp_error,omitempty"`  // only flows that drew ICMP errors
+}
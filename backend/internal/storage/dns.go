@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// maxDNSQueries is how many lookups the DNS log keeps
+	maxDNSQueries = 10000
+	// maxDomains bounds the per-domain totals; the least recently seen
+	// domains are dropped beyond it
+	maxDomains = 50000
+)
+
+// domainTotals accumulates the stats of one domain
+type domainTotals struct {
+	stats      models.DomainStats
+	answered   uint64
+	latencySum float64
+}
+
+func (t *domainTotals) add(query *models.DNSQuery) {
+	t.stats.Queries++
+	switch query.RCode {
+	case models.RCodeTimeout:
+		t.stats.Timeouts++
+		return
+	case "NXDOMAIN":
+		t.stats.NXDomain++
+	}
+	t.answered++
+	t.latencySum += query.LatencyMs
+}
+
+// dnsTotals accumulates the stats of every lookup
+type dnsTotals struct {
+	stats      models.DNSStats
+	latencySum float64
+}
+
+func (t *dnsTotals) add(query *models.DNSQuery) {
+	t.stats.Queries++
+	switch query.RCode {
+	case models.RCodeTimeout:
+		t.stats.Timeouts++
+		return
+	case "NXDOMAIN":
+		t.stats.NXDomain++
+	case "SERVFAIL":
+		t.stats.ServFail++
+	}
+	t.stats.Answered++
+	t.latencySum += query.LatencyMs
+}
+
+// AddDNSQueries appends finished lookups to the DNS log and the totals
+func (m *MemoryStorage) AddDNSQueries(queries []*models.DNSQuery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, query := range queries {
+		queryCopy := *query
+		queryCopy.Answers = append([]string(nil), query.Answers...)
+		m.dnsQueries = append(m.dnsQueries, &queryCopy)
+
+		m.dnsTotals.add(query)
+		if query.Name != "" {
+			m.domainLocked(query.Name, query.Timestamp).add(query)
+		}
+	}
+	if len(m.dnsQueries) > maxDNSQueries {
+		m.dnsQueries = append([]*models.DNSQuery(nil), m.dnsQueries[len(m.dnsQueries)-maxDNSQueries:]...)
+	}
+}
+
+// domainLocked returns the totals of a domain, creating them if needed
+func (m *MemoryStorage) domainLocked(domain string, now time.Time) *domainTotals {
+	totals, ok := m.domains[domain]
+	if !ok {
+		if len(m.domains) >= maxDomains {
+			m.evictDomainsLocked()
+		}
+		totals = &domainTotals{stats: models.DomainStats{Domain: domain}}
+		m.domains[domain] = totals
+	}
+	if now.After(totals.stats.LastSeen) {
+		totals.stats.LastSeen = now
+	}
+	return totals
+}
+
+// evictDomainsLocked drops the least recently seen tenth of the domains
+func (m *MemoryStorage) evictDomainsLocked() {
+	totals := make([]*domainTotals, 0, len(m.domains))
+	for _, t := range m.domains {
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].stats.LastSeen.Before(totals[j].stats.LastSeen)
+	})
+	for _, t := range totals[:len(totals)/10+1] {
+		delete(m.domains, t.stats.Domain)
+	}
+}
+
+// addDomainBytesLocked credits the growth of a flow's byte counter to its
+// domain. prev is the previous copy of the flow, if any.
+func (m *MemoryStorage) addDomainBytesLocked(flow, prev *models.Flow) {
+	if flow.Domain == "" {
+		return
+	}
+	delta := flow.Bytes
+	// Counters restart when a flow is exported on the active timeout
+	if prev != nil && prev.Domain == flow.Domain && prev.Bytes <= flow.Bytes {
+		delta -= prev.Bytes
+	}
+	if delta > 0 {
+		m.domainLocked(flow.Domain, flow.LastSeen).stats.Bytes += delta
+	}
+}
+
+// GetDNSQueries returns the most recent lookups matching filter, newest
+// first. A zero limit returns all of them.
+func (m *MemoryStorage) GetDNSQueries(filter *models.DNSFilter, limit int) []*models.DNSQuery {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*models.DNSQuery, 0)
+	for i := len(m.dnsQueries) - 1; i >= 0; i-- {
+		query := m.dnsQueries[i]
+		if filter.Interface != "" && query.Interface != filter.Interface {
+			continue
+		}
+		if filter.Domain != "" && !matchDomain(query.Name, filter.Domain) {
+			continue
+		}
+		if filter.RCode != "" && !strings.EqualFold(query.RCode, filter.RCode) {
+			continue
+		}
+		if filter.Client != "" && query.ClientIP != filter.Client {
+			continue
+		}
+		queryCopy := *query
+		queryCopy.Answers = append([]string(nil), query.Answers...)
+		result = append(result, &queryCopy)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
+
+// DomainSorts are the orderings accepted by GetDomainStats
+var DomainSorts = []string{"queries", "nxdomain", "bytes"}
+
+// GetDomainStats returns the per-domain totals, top first by "queries",
+// "nxdomain" or "bytes". A zero limit returns all of them.
+func (m *MemoryStorage) GetDomainStats(sortBy string, limit int) []*models.DomainStats {
+	m.mu.RLock()
+	result := make([]*models.DomainStats, 0, len(m.domains))
+	for _, totals := range m.domains {
+		stats := totals.stats
+		if stats.Queries > 0 {
+			stats.NXDomainRate = float64(stats.NXDomain) / float64(stats.Queries)
+		}
+		if totals.answered > 0 {
+			stats.AvgLatencyMs = totals.latencySum / float64(totals.answered)
+		}
+		result = append(result, &stats)
+	}
+	m.mu.RUnlock()
+
+	metric := func(s *models.DomainStats) uint64 { return s.Queries }
+	switch sortBy {
+	case "nxdomain":
+		metric = func(s *models.DomainStats) uint64 { return s.NXDomain }
+	case "bytes":
+		metric = func(s *models.DomainStats) uint64 { return s.Bytes }
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := metric(result[i]), metric(result[j])
+		if a != b {
+			return a > b
+		}
+		return result[i].Domain < result[j].Domain
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// GetDNSStats returns the totals of every lookup
+func (m *MemoryStorage) GetDNSStats() *models.DNSStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := m.dnsTotals.stats
+	if stats.Queries > 0 {
+		stats.NXDomainRate = float64(stats.NXDomain) / float64(stats.Queries)
+	}
+	if stats.Answered > 0 {
+		stats.AvgLatencyMs = m.dnsTotals.latencySum / float64(stats.Answered)
+	}
+	return &stats
+}
+
+// matchDomain reports whether name is domain or one of its subdomains,
+// ignoring case
+func matchDomain(name, domain string) bool {
+	name = strings.ToLower(name)
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
@@ -67,7 +67,9 @@ func (f *FileStorage) SaveSnapshot(snapshot *models.TrafficSnapshot) error {
 	return err
 }
 
-func (f *FileStorage) GetHistoricalData(start, end time.Time) ([]models.HistoricalData, error) {
+// GetHistoricalData returns the samples between start and end for iface, or
+// the totals of all interfaces when iface is empty
+func (f *FileStorage) GetHistoricalData(start, end time.Time, iface string) ([]models.HistoricalData, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -105,13 +107,13 @@ func (f *FileStorage) GetHistoricalData(start, end time.Time) ([]models.Historic
 				continue
 			}
 
-			if snapshot.Interface != nil {
+			if stats := snapshotInterface(&snapshot, iface); stats != nil {
 				result = append(result, models.HistoricalData{
 					Timestamp:  snapshot.Timestamp,
-					InBytes:    snapshot.Interface.InBytesPerSec,
-					OutBytes:   snapshot.Interface.OutBytesPerSec,
-					InPackets:  snapshot.Interface.InPacketsPerSec,
-					OutPackets: snapshot.Interface.OutPacketsPerSec,
+					InBytes:    stats.InBytesPerSec,
+					OutBytes:   stats.OutBytesPerSec,
+					InPackets:  stats.InPacketsPerSec,
+					OutPackets: stats.OutPacketsPerSec,
 				})
 			}
 		}
@@ -119,4 +121,21 @@ func (f *FileStorage) GetHistoricalData(start, end time.Time) ([]models.Historic
 
 	fmt.Printf("Returning %d historical data points\n", len(result))
 	return result, nil
-}
\ No newline at end of file
+}
+
+// snapshotInterface picks the stats of iface out of a snapshot. Snapshots
+// written before multi-interface support only carry the Interface field.
+func snapshotInterface(snapshot *models.TrafficSnapshot, iface string) *models.InterfaceStats {
+	if iface == "" {
+		return snapshot.Interface
+	}
+	for _, stats := range snapshot.Interfaces {
+		if stats.Interface == iface {
+			return stats
+		}
+	}
+	if snapshot.Interface != nil && snapshot.Interface.Interface == iface {
+		return snapshot.Interface
+	}
+	return nil
+}
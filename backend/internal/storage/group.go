@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// groupKeys extract the value of each grouping dimension from a flow
+var groupKeys = map[string]func(flow *models.Flow) string{
+	"interface":    func(flow *models.Flow) string { return flow.Interface },
+	"protocol":     func(flow *models.Flow) string { return flow.Protocol },
+	"app_protocol": func(flow *models.Flow) string { return flow.AppProtocol },
+	"domain":       func(flow *models.Flow) string { return flow.Domain },
+	"src_mac":      func(flow *models.Flow) string { return flow.SrcMAC },
+	"dst_mac":      func(flow *models.Flow) string { return flow.DstMAC },
+	"sni": func(flow *models.Flow) string {
+		if flow.TLS == nil {
+			return ""
+		}
+		return flow.TLS.SNI
+	},
+	"process": func(flow *models.Flow) string {
+		if flow.Process == nil {
+			return ""
+		}
+		return flow.Process.Name
+	},
+	"workload": func(flow *models.Flow) string {
+		if flow.Workload == nil {
+			return ""
+		}
+		return flow.Workload.Name()
+	},
+}
+
+// GroupDimensions returns the names accepted by GroupFlows
+func GroupDimensions() []string {
+	names := make([]string, 0, len(groupKeys))
+	for name := range groupKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GroupFlows totals flows by a dimension such as "process", busiest first
+func GroupFlows(flows []*models.Flow, by string) ([]*models.FlowGroup, error) {
+	keyOf, ok := groupKeys[by]
+	if !ok {
+		return nil, fmt.Errorf("unknown group_by %q, expected one of %s", by, strings.Join(GroupDimensions(), ", "))
+	}
+
+	groups := make(map[string]*models.FlowGroup)
+	for _, flow := range flows {
+		key := keyOf(flow)
+		group, ok := groups[key]
+		if !ok {
+			group = &models.FlowGroup{Key: key}
+			groups[key] = group
+		}
+		group.Connections++
+		group.Bytes += flow.Bytes
+		group.BytesPerSec += flow.BytesPerSec
+		group.Packets += flow.Packets
+		group.PacketsPerSec += flow.PacketsPerSec
+	}
+
+	result := make([]*models.FlowGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.BytesPerSec != b.BytesPerSec {
+			return a.BytesPerSec > b.BytesPerSec
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Key < b.Key
+	})
+	return result, nil
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+const (
+	// maxHTTPRequests is how many requests the HTTP log keeps
+	maxHTTPRequests = 10000
+	// maxHTTPHosts bounds the per-host totals; the least recently seen
+	// hosts are dropped beyond it
+	maxHTTPHosts = 10000
+)
+
+// hostTotals accumulates the stats of one host
+type hostTotals struct {
+	stats      models.HTTPHostStats
+	answered   uint64
+	latencySum float64
+}
+
+func (t *hostTotals) add(req *models.HTTPRequest) {
+	t.stats.Requests++
+	t.stats.Bytes += uint64(req.RequestSize + req.ResponseSize)
+	switch {
+	case req.StatusCode == 0:
+		t.stats.NoResponse++
+		return
+	case req.StatusCode >= 500:
+		t.stats.ServerErrors++
+	case req.StatusCode >= 400:
+		t.stats.ClientErrors++
+	}
+	t.answered++
+	t.latencySum += req.LatencyMs
+}
+
+// AddHTTPRequests appends finished requests to the HTTP log and the totals
+func (m *MemoryStorage) AddHTTPRequests(requests []*models.HTTPRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, req := range requests {
+		reqCopy := *req
+		m.httpRequests = append(m.httpRequests, &reqCopy)
+
+		m.httpStatus[req.StatusCode]++
+		m.hostLocked(req.Host, req.Timestamp).add(req)
+	}
+	if len(m.httpRequests) > maxHTTPRequests {
+		m.httpRequests = append([]*models.HTTPRequest(nil), m.httpRequests[len(m.httpRequests)-maxHTTPRequests:]...)
+	}
+}
+
+// hostLocked returns the totals of a host, creating them if needed
+func (m *MemoryStorage) hostLocked(host string, now time.Time) *hostTotals {
+	totals, ok := m.httpHosts[host]
+	if !ok {
+		if len(m.httpHosts) >= maxHTTPHosts {
+			m.evictHostsLocked()
+		}
+		totals = &hostTotals{stats: models.HTTPHostStats{Host: host}}
+		m.httpHosts[host] = totals
+	}
+	if now.After(totals.stats.LastSeen) {
+		totals.stats.LastSeen = now
+	}
+	return totals
+}
+
+// evictHostsLocked drops the least recently seen tenth of the hosts
+func (m *MemoryStorage) evictHostsLocked() {
+	totals := make([]*hostTotals, 0, len(m.httpHosts))
+	for _, t := range m.httpHosts {
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].stats.LastSeen.Before(totals[j].stats.LastSeen)
+	})
+	for _, t := range totals[:len(totals)/10+1] {
+		delete(m.httpHosts, t.stats.Host)
+	}
+}
+
+// GetHTTPRequests returns the most recent requests matching filter, newest
+// first. A zero limit returns all of them.
+func (m *MemoryStorage) GetHTTPRequests(filter *models.HTTPFilter, limit int) []*models.HTTPRequest {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*models.HTTPRequest, 0)
+	for i := len(m.httpRequests) - 1; i >= 0; i-- {
+		req := m.httpRequests[i]
+		if filter.Interface != "" && req.Interface != filter.Interface {
+			continue
+		}
+		if filter.Host != "" && !matchDomain(req.Host, filter.Host) {
+			continue
+		}
+		if filter.Method != "" && !strings.EqualFold(req.Method, filter.Method) {
+			continue
+		}
+		if filter.Path != "" && !strings.HasPrefix(req.Path, filter.Path) {
+			continue
+		}
+		if filter.Client != "" && req.ClientIP != filter.Client {
+			continue
+		}
+		if filter.MinStatus != 0 && req.StatusCode < filter.MinStatus {
+			continue
+		}
+		if filter.MaxStatus != 0 && req.StatusCode > filter.MaxStatus {
+			continue
+		}
+		reqCopy := *req
+		result = append(result, &reqCopy)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
+
+// HTTPHostSorts are the orderings accepted by GetHTTPHostStats
+var HTTPHostSorts = []string{"requests", "errors", "bytes"}
+
+// GetHTTPHostStats returns the per-host totals, top first by "requests",
+// "errors" (4xx and 5xx) or "bytes". A zero limit returns all of them.
+func (m *MemoryStorage) GetHTTPHostStats(sortBy string, limit int) []*models.HTTPHostStats {
+	m.mu.RLock()
+	result := make([]*models.HTTPHostStats, 0, len(m.httpHosts))
+	for _, totals := range m.httpHosts {
+		stats := totals.stats
+		if totals.answered > 0 {
+			stats.AvgLatencyMs = totals.latencySum / float64(totals.answered)
+		}
+		result = append(result, &stats)
+	}
+	m.mu.RUnlock()
+
+	metric := func(s *models.HTTPHostStats) uint64 { return s.Requests }
+	switch sortBy {
+	case "errors":
+		metric = func(s *models.HTTPHostStats) uint64 { return s.ClientErrors + s.ServerErrors }
+	case "bytes":
+		metric = func(s *models.HTTPHostStats) uint64 { return s.Bytes }
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := metric(result[i]), metric(result[j])
+		if a != b {
+			return a > b
+		}
+		return result[i].Host < result[j].Host
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// GetHTTPStatusStats returns the number of responses per status code
+func (m *MemoryStorage) GetHTTPStatusStats() []*models.HTTPStatusStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*models.HTTPStatusStats, 0, len(m.httpStatus))
+	for status, count := range m.httpStatus {
+		result = append(result, &models.HTTPStatusStats{StatusCode: status, Requests: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StatusCode < result[j].StatusCode
+	})
+	return result
+}
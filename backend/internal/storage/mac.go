@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// UpdateMACStats replaces the per-address counters of iface
+func (m *MemoryStorage) UpdateMACStats(iface string, stats []*models.MACStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(stats) == 0 {
+		delete(m.macs, iface)
+		return
+	}
+	statsCopy := make([]*models.MACStats, len(stats))
+	for i, s := range stats {
+		macCopy := *s
+		macCopy.EtherTypes = make(map[string]uint64, len(s.EtherTypes))
+		for name, count := range s.EtherTypes {
+			macCopy.EtherTypes[name] = count
+		}
+		statsCopy[i] = &macCopy
+	}
+	m.macs[iface] = statsCopy
+}
+
+// MACSorts are the orderings accepted by GetMACStats
+var MACSorts = []string{"bytes", "sent", "received", "broadcast", "multicast"}
+
+// GetMACStats returns the per-address counters matching filter, top first
+// by total bytes, bytes "sent" or "received", or bytes sent to "broadcast"
+// or "multicast" addresses. A zero limit returns all of them.
+func (m *MemoryStorage) GetMACStats(filter *models.MACFilter, sortBy string, limit int) []*models.MACStats {
+	m.mu.RLock()
+	result := make([]*models.MACStats, 0)
+	for iface, stats := range m.macs {
+		if filter.Interface != "" && iface != filter.Interface {
+			continue
+		}
+		for _, s := range stats {
+			if filter.Kind != "" && s.Kind != filter.Kind {
+				continue
+			}
+			if filter.Vendor != "" && !strings.Contains(strings.ToLower(s.Vendor), strings.ToLower(filter.Vendor)) {
+				continue
+			}
+			// The ether types map isn't modified once stored
+			macCopy := *s
+			result = append(result, &macCopy)
+		}
+	}
+	m.mu.RUnlock()
+
+	metric := func(s *models.MACStats) uint64 { return s.InBytes + s.OutBytes }
+	switch sortBy {
+	case "sent":
+		metric = func(s *models.MACStats) uint64 { return s.OutBytes }
+	case "received":
+		metric = func(s *models.MACStats) uint64 { return s.InBytes }
+	case "broadcast":
+		metric = func(s *models.MACStats) uint64 { return s.BroadcastBytes }
+	case "multicast":
+		metric = func(s *models.MACStats) uint64 { return s.MulticastBytes }
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := metric(result[i]), metric(result[j])
+		if a != b {
+			return a > b
+		}
+		if result[i].Interface != result[j].Interface {
+			return result[i].Interface < result[j].Interface
+		}
+		return result[i].MAC < result[j].MAC
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
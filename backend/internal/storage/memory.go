@@ -1,7 +1,10 @@
 package storage
 
 import (
-	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,111 +12,360 @@ import (
 )
 
 type MemoryStorage struct {
-	mu          sync.RWMutex
-	connections map[string]*models.Connection
-	interfaces  map[string]*models.InterfaceStats
-	snapshots   []models.TrafficSnapshot
-	maxSnapshots int
+	mu             sync.RWMutex
+	connections    map[string]*models.Flow
+	interfaces     map[string]*models.InterfaceStats
+	captureStats   map[string]*models.CaptureStats
+	vlans          map[string][]*models.VLANStats
+	macs           map[string][]*models.MACStats
+	dnsQueries     []*models.DNSQuery // oldest first
+	dnsTotals      dnsTotals
+	domains        map[string]*domainTotals
+	httpRequests   []*models.HTTPRequest // oldest first
+	httpHosts      map[string]*hostTotals
+	httpStatus     map[int]uint64
+	neighbors      map[string][]*models.Neighbor
+	neighborEvents []*models.NeighborEvent // oldest first
+	snapshots      []models.TrafficSnapshot
+	maxSnapshots   int
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		connections:  make(map[string]*models.Connection),
+		connections:  make(map[string]*models.Flow),
 		interfaces:   make(map[string]*models.InterfaceStats),
+		captureStats: make(map[string]*models.CaptureStats),
+		vlans:        make(map[string][]*models.VLANStats),
+		macs:         make(map[string][]*models.MACStats),
+		domains:      make(map[string]*domainTotals),
+		httpHosts:    make(map[string]*hostTotals),
+		httpStatus:   make(map[int]uint64),
+		neighbors:    make(map[string][]*models.Neighbor),
 		snapshots:    make([]models.TrafficSnapshot, 0),
 		maxSnapshots: 3600, // Keep 1 hour of snapshots
 	}
 }
 
-func (m *MemoryStorage) UpdateConnection(conn *models.Connection) {
+func (m *MemoryStorage) UpdateFlow(flow *models.Flow) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := connectionKey(conn)
-	if existing, ok := m.connections[key]; ok {
-		// Average the bytes per second
-		existing.BytesPerSec = (existing.BytesPerSec + conn.BytesPerSec) / 2
-		existing.Bytes = conn.Bytes
-		existing.Packets = conn.Packets
-		existing.LastSeen = conn.LastSeen
-	} else {
-		m.connections[key] = conn
-	}
+	key := flowKey(flow)
+	m.addDomainBytesLocked(flow, m.connections[key])
+	// Store a copy; the capture goroutine keeps mutating flow
+	m.connections[key] = flow.Clone()
+}
+
+// RemoveFlow drops a flow that the capture expired
+func (m *MemoryStorage) RemoveFlow(flow *models.Flow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.connections, flowKey(flow))
 }
 
 func (m *MemoryStorage) UpdateInterface(stats *models.InterfaceStats) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.interfaces[stats.Interface] = stats
+	// Store a copy; the capture goroutine resets the per-second counters
+	statsCopy := *stats
+	m.interfaces[stats.Interface] = &statsCopy
+}
+
+func (m *MemoryStorage) UpdateCaptureStats(stats *models.CaptureStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statsCopy := *stats
+	m.captureStats[stats.Interface] = &statsCopy
+}
+
+// UpdateVLANStats replaces the per-VLAN counters of iface
+func (m *MemoryStorage) UpdateVLANStats(iface string, stats []*models.VLANStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(stats) == 0 {
+		delete(m.vlans, iface)
+		return
+	}
+	statsCopy := make([]*models.VLANStats, len(stats))
+	for i, s := range stats {
+		vlanCopy := *s
+		statsCopy[i] = &vlanCopy
+	}
+	m.vlans[iface] = statsCopy
+}
+
+// GetVLANStats returns the per-VLAN counters of iface, or of every interface
+// when iface is empty
+func (m *MemoryStorage) GetVLANStats(iface string) []*models.VLANStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.vlanStatsLocked(iface)
+}
+
+func (m *MemoryStorage) vlanStatsLocked(iface string) []*models.VLANStats {
+	names := make([]string, 0, len(m.vlans))
+	for name := range m.vlans {
+		if iface == "" || name == iface {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]*models.VLANStats, 0)
+	for _, name := range names {
+		for _, stats := range m.vlans[name] {
+			statsCopy := *stats
+			result = append(result, &statsCopy)
+		}
+	}
+	return result
+}
+
+// GetCaptureStats returns the capture counters of iface, or of every
+// interface when iface is empty
+func (m *MemoryStorage) GetCaptureStats(iface string) []*models.CaptureStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.captureStatsLocked(iface)
+}
+
+func (m *MemoryStorage) captureStatsLocked(iface string) []*models.CaptureStats {
+	names := make([]string, 0, len(m.captureStats))
+	for name := range m.captureStats {
+		if iface == "" || name == iface {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]*models.CaptureStats, 0, len(names))
+	for _, name := range names {
+		statsCopy := *m.captureStats[name]
+		result = append(result, &statsCopy)
+	}
+	return result
 }
 
-func (m *MemoryStorage) GetSnapshot() *models.TrafficSnapshot {
+// GetSnapshot returns the current state of iface, or of every interface when
+// iface is empty. In the latter case Interface holds the summed totals.
+func (m *MemoryStorage) GetSnapshot(iface string) *models.TrafficSnapshot {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	// Create a snapshot of current state
 	snapshot := &models.TrafficSnapshot{
 		Timestamp:   time.Now(),
-		Connections: make([]*models.Connection, 0, len(m.connections)),
+		Interfaces:  make([]*models.InterfaceStats, 0, len(m.interfaces)),
+		Connections: make([]*models.Flow, 0, len(m.connections)),
 	}
 
 	// Copy interface stats
-	for _, iface := range m.interfaces {
-		snapshot.Interface = &models.InterfaceStats{
-			Interface:        iface.Interface,
-			InBytes:          iface.InBytes,
-			OutBytes:         iface.OutBytes,
-			InBytesPerSec:    iface.InBytesPerSec,
-			OutBytesPerSec:   iface.OutBytesPerSec,
-			InPackets:        iface.InPackets,
-			OutPackets:       iface.OutPackets,
-			InPacketsPerSec:  iface.InPacketsPerSec,
-			OutPacketsPerSec: iface.OutPacketsPerSec,
+	names := make([]string, 0, len(m.interfaces))
+	for name := range m.interfaces {
+		if iface == "" || name == iface {
+			names = append(names, name)
 		}
-		break // Only one interface for now
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		statsCopy := *m.interfaces[name]
+		snapshot.Interfaces = append(snapshot.Interfaces, &statsCopy)
+	}
+	snapshot.Interface = sumInterfaceStats(snapshot.Interfaces)
+	snapshot.CaptureStats = m.captureStatsLocked(iface)
+	if vlans := m.vlanStatsLocked(iface); len(vlans) > 0 {
+		snapshot.VLANs = vlans
 	}
 
 	// Copy active connections
-	cutoff := time.Now().Add(-5 * time.Second)
 	for _, conn := range m.connections {
-		if conn.LastSeen.After(cutoff) {
-			connCopy := *conn
-			snapshot.Connections = append(snapshot.Connections, &connCopy)
+		if iface != "" && conn.Interface != iface {
+			continue
+		}
+		if m.activeLocked(conn) {
+			snapshot.Connections = append(snapshot.Connections, conn.Clone())
 		}
 	}
 
 	return snapshot
 }
 
-func (m *MemoryStorage) GetFilteredConnections(filter *models.Filter) []*models.Connection {
+// activeLocked reports whether conn saw packets in the last 5 seconds of its
+// interface's clock: the time of the latest capture stats, which is packet
+// time for replays, or the wall clock until they arrive
+func (m *MemoryStorage) activeLocked(conn *models.Flow) bool {
+	now := time.Now()
+	if stats, ok := m.captureStats[conn.Interface]; ok {
+		now = stats.Timestamp
+	}
+	return conn.LastSeen.After(now.Add(-5 * time.Second))
+}
+
+// sumInterfaceStats returns a copy of the only entry, or the totals of several.
+// Totals including sampled interfaces carry the highest of their rates, and
+// the error of the sum of their estimates.
+func sumInterfaceStats(stats []*models.InterfaceStats) *models.InterfaceStats {
+	switch len(stats) {
+	case 0:
+		return nil
+	case 1:
+		statsCopy := *stats[0]
+		return &statsCopy
+	}
+
+	total := &models.InterfaceStats{Interface: "all"}
+	var variance float64 // of the packet total, as absolute errors add up in quadrature
+	for _, iface := range stats {
+		total.InBytes += iface.InBytes
+		total.OutBytes += iface.OutBytes
+		total.InBytesPerSec += iface.InBytesPerSec
+		total.OutBytesPerSec += iface.OutBytesPerSec
+		total.InPackets += iface.InPackets
+		total.OutPackets += iface.OutPackets
+		total.InPacketsPerSec += iface.InPacketsPerSec
+		total.OutPacketsPerSec += iface.OutPacketsPerSec
+		total.SamplingRate = max(total.SamplingRate, iface.SamplingRate)
+		absolute := iface.EstimatedError * float64(iface.InPackets+iface.OutPackets)
+		variance += absolute * absolute
+	}
+	if packets := total.InPackets + total.OutPackets; packets > 0 && variance > 0 {
+		total.EstimatedError = math.Sqrt(variance) / float64(packets)
+	}
+	return total
+}
+
+func (m *MemoryStorage) GetFilteredConnections(filter *models.Filter) []*models.Flow {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	result := make([]*models.Connection, 0)
-	cutoff := time.Now().Add(-5 * time.Second)
+	result := make([]*models.Flow, 0)
 
 	for _, conn := range m.connections {
-		if conn.LastSeen.Before(cutoff) {
+		if !m.activeLocked(conn) {
 			continue
 		}
 
-		// Apply filters
-		if filter.IP != "" && conn.SrcIP != filter.IP && conn.DstIP != filter.IP {
+		if !matchFilter(conn, filter) {
 			continue
 		}
-		if filter.Port != 0 && conn.SrcPort != filter.Port && conn.DstPort != filter.Port {
-			continue
+
+		result = append(result, conn.Clone())
+	}
+
+	return result
+}
+
+// matchFilter reports whether a flow satisfies every criterion of filter
+func matchFilter(conn *models.Flow, filter *models.Filter) bool {
+	if filter.Interface != "" && conn.Interface != filter.Interface {
+		return false
+	}
+	if filter.IP != "" && conn.SrcIP != filter.IP && conn.DstIP != filter.IP {
+		return false
+	}
+	if filter.Port != 0 && conn.SrcPort != filter.Port && conn.DstPort != filter.Port {
+		return false
+	}
+	if filter.VLAN != 0 && conn.VLAN != filter.VLAN && conn.InnerVLAN != filter.VLAN {
+		return false
+	}
+	if filter.Protocol != "" && !matchProtocol(conn.Protocol, filter.Protocol) {
+		return false
+	}
+	if filter.AppProtocol != "" && !strings.EqualFold(conn.AppProtocol, filter.AppProtocol) {
+		return false
+	}
+	if filter.Process != "" && !matchProcess(conn.Process, filter.Process) {
+		return false
+	}
+	if filter.Workload != "" && !matchWorkload(conn.Workload, filter.Workload) {
+		return false
+	}
+	if filter.Domain != "" && !matchDomain(conn.Domain, filter.Domain) {
+		return false
+	}
+	if filter.SNI != "" && (conn.TLS == nil || !matchDomain(conn.TLS.SNI, filter.SNI)) {
+		return false
+	}
+	if filter.ICMPError && conn.ICMPErrors == 0 {
+		return false
+	}
+
+	// ICMP filters only match ICMP flows
+	if filter.ICMPType != nil || filter.ICMPCode != nil {
+		icmp := conn.ICMP
+		if icmp == nil {
+			return false
 		}
-		if filter.Protocol != "" && conn.Protocol != filter.Protocol {
-			continue
+		if filter.ICMPType != nil && icmp.Type != *filter.ICMPType {
+			return false
+		}
+		if filter.ICMPCode != nil && icmp.Code != *filter.ICMPCode {
+			return false
 		}
+	}
 
-		connCopy := *conn
-		result = append(result, &connCopy)
+	// TCP health filters only match TCP flows
+	if filter.MinRetransmitRate > 0 || filter.MinRTTMs > 0 || filter.ZeroWindow || filter.Reset {
+		tcp := conn.TCP
+		if tcp == nil {
+			return false
+		}
+		if tcp.RetransmitRate < filter.MinRetransmitRate {
+			return false
+		}
+		if tcp.HandshakeRTTMs < filter.MinRTTMs {
+			return false
+		}
+		if filter.ZeroWindow && tcp.ZeroWindows == 0 {
+			return false
+		}
+		if filter.Reset && tcp.Resets == 0 {
+			return false
+		}
 	}
 
-	return result
+	return true
+}
+
+// matchProcess matches a process by PID or command name
+func matchProcess(proc *models.ProcessInfo, want string) bool {
+	if proc == nil {
+		return false
+	}
+	if pid, err := strconv.Atoi(want); err == nil {
+		return proc.PID == pid
+	}
+	return proc.Name == want
+}
+
+// matchWorkload matches a workload by pod name (optionally namespace/pod),
+// container name or container ID prefix
+func matchWorkload(workload *models.WorkloadInfo, want string) bool {
+	if workload == nil {
+		return false
+	}
+	if ns, pod, ok := strings.Cut(want, "/"); ok {
+		return workload.PodNamespace == ns && workload.PodName == pod
+	}
+	return workload.PodName == want ||
+		workload.ContainerName == want ||
+		strings.HasPrefix(workload.ContainerID, want)
+}
+
+// matchProtocol compares protocols case-insensitively; "icmp" covers both
+// ICMP and ICMPv6
+func matchProtocol(protocol, want string) bool {
+	if strings.EqualFold(protocol, want) {
+		return true
+	}
+	return strings.EqualFold(want, "icmp") && strings.EqualFold(protocol, "icmpv6")
 }
 
 func (m *MemoryStorage) AddSnapshot(snapshot models.TrafficSnapshot) {
@@ -156,9 +408,8 @@ func (m *MemoryStorage) GetHistoricalData(start, end time.Time, interval time.Du
 	return result
 }
 
-func connectionKey(conn *models.Connection) string {
-	return conn.SrcIP + ":" + fmt.Sprint(conn.SrcPort) + "-" +
-		conn.DstIP + ":" + fmt.Sprint(conn.DstPort) + "-" + conn.Protocol
+func flowKey(flow *models.Flow) string {
+	return flow.Interface + "|" + flow.Key
 }
 
 // ClearConnections clears all connection data (used when switching interfaces)
@@ -166,7 +417,63 @@ func (m *MemoryStorage) ClearConnections() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	m.connections = make(map[string]*models.Connection)
+	m.connections = make(map[string]*models.Flow)
 	// Also clear interface stats for the old interface
 	m.interfaces = make(map[string]*models.InterfaceStats)
-}
\ No newline at end of file
+	m.captureStats = make(map[string]*models.CaptureStats)
+	m.vlans = make(map[string][]*models.VLANStats)
+	m.macs = make(map[string][]*models.MACStats)
+	m.dnsQueries = nil
+	m.dnsTotals = dnsTotals{}
+	m.domains = make(map[string]*domainTotals)
+	m.httpRequests = nil
+	m.httpHosts = make(map[string]*hostTotals)
+	m.httpStatus = make(map[int]uint64)
+	m.neighbors = make(map[string][]*models.Neighbor)
+	m.neighborEvents = nil
+}
+
+// ClearInterface drops the connections, stats and logs of a single
+// interface. The DNS and HTTP totals span the interfaces and are kept.
+func (m *MemoryStorage) ClearInterface(iface string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, conn := range m.connections {
+		if conn.Interface == iface {
+			delete(m.connections, key)
+		}
+	}
+	delete(m.interfaces, iface)
+	delete(m.captureStats, iface)
+	delete(m.vlans, iface)
+	delete(m.macs, iface)
+	delete(m.neighbors, iface)
+
+	queries := m.dnsQueries[:0]
+	for _, query := range m.dnsQueries {
+		if query.Interface != iface {
+			queries = append(queries, query)
+		}
+	}
+	clear(m.dnsQueries[len(queries):])
+	m.dnsQueries = queries
+
+	requests := m.httpRequests[:0]
+	for _, req := range m.httpRequests {
+		if req.Interface != iface {
+			requests = append(requests, req)
+		}
+	}
+	clear(m.httpRequests[len(requests):])
+	m.httpRequests = requests
+
+	events := m.neighborEvents[:0]
+	for _, event := range m.neighborEvents {
+		if event.Interface != iface {
+			events = append(events, event)
+		}
+	}
+	clear(m.neighborEvents[len(events):])
+	m.neighborEvents = events
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+func TestClearInterface(t *testing.T) {
+	m := NewMemoryStorage()
+	now := time.Now()
+	for _, iface := range []string{"eth0", "eth1"} {
+		m.UpdateFlow(&models.Flow{Connection: models.Connection{Interface: iface, LastSeen: now}, Key: "flow"})
+		m.UpdateInterface(&models.InterfaceStats{Interface: iface})
+		m.AddDNSQueries([]*models.DNSQuery{{Interface: iface, Name: "example.com", Timestamp: now, RCode: "NOERROR"}})
+		m.AddHTTPRequests([]*models.HTTPRequest{{Interface: iface, Host: "example.com", Timestamp: now, StatusCode: 200}})
+		m.AddNeighborEvents([]*models.NeighborEvent{{Interface: iface, Timestamp: now, IP: "10.0.0.1"}})
+	}
+
+	m.ClearInterface("eth0")
+
+	if flows := m.GetFilteredConnections(&models.Filter{}); len(flows) != 1 || flows[0].Interface != "eth1" {
+		t.Errorf("flows left: %+v", flows)
+	}
+	if queries := m.GetDNSQueries(&models.DNSFilter{}, 0); len(queries) != 1 || queries[0].Interface != "eth1" {
+		t.Errorf("DNS queries left: %+v", queries)
+	}
+	if requests := m.GetHTTPRequests(&models.HTTPFilter{}, 0); len(requests) != 1 || requests[0].Interface != "eth1" {
+		t.Errorf("HTTP requests left: %+v", requests)
+	}
+	if events := m.GetNeighborEvents("", "", 0); len(events) != 1 || events[0].Interface != "eth1" {
+		t.Errorf("neighbor events left: %+v", events)
+	}
+	// Totals span the interfaces
+	if stats := m.GetDNSStats(); stats.Queries != 2 {
+		t.Errorf("DNS totals cleared: %+v", stats)
+	}
+}
+
+func TestSumInterfaceStats(t *testing.T) {
+	total := sumInterfaceStats([]*models.InterfaceStats{
+		{Interface: "eth0", InPackets: 300, OutPackets: 100, SamplingRate: 4, EstimatedError: 0.2},
+		{Interface: "eth1", InPackets: 600, SamplingRate: 8, EstimatedError: 0.3},
+		{Interface: "lo", OutPackets: 100},
+	})
+	if total.InPackets != 900 || total.OutPackets != 200 || total.SamplingRate != 8 {
+		t.Errorf("totals %+v", total)
+	}
+	// ±80 and ±180 packets out of 1100
+	if want := math.Sqrt(80*80+180*180) / 1100; math.Abs(total.EstimatedError-want) > 1e-9 {
+		t.Errorf("estimated error %v, want %v", total.EstimatedError, want)
+	}
+
+	if total := sumInterfaceStats([]*models.InterfaceStats{{Interface: "eth0"}, {Interface: "eth1"}}); total.SamplingRate != 0 || total.EstimatedError != 0 {
+		t.Errorf("unsampled totals %+v", total)
+	}
+}
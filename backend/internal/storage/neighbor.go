@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/raojinlin/traffic-sniff/internal/models"
+)
+
+// maxNeighborEvents is how many anomalies the neighbor event log keeps
+const maxNeighborEvents = 1000
+
+// UpdateNeighbors replaces the neighbor table of iface
+func (m *MemoryStorage) UpdateNeighbors(iface string, neighbors []*models.Neighbor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(neighbors) == 0 {
+		delete(m.neighbors, iface)
+		return
+	}
+	neighborsCopy := make([]*models.Neighbor, len(neighbors))
+	for i, n := range neighbors {
+		neighborCopy := *n
+		neighborsCopy[i] = &neighborCopy
+	}
+	m.neighbors[iface] = neighborsCopy
+}
+
+// AddNeighborEvents appends anomalies to the neighbor event log
+func (m *MemoryStorage) AddNeighborEvents(events []*models.NeighborEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, event := range events {
+		eventCopy := *event
+		m.neighborEvents = append(m.neighborEvents, &eventCopy)
+	}
+	if len(m.neighborEvents) > maxNeighborEvents {
+		m.neighborEvents = append([]*models.NeighborEvent(nil), m.neighborEvents[len(m.neighborEvents)-maxNeighborEvents:]...)
+	}
+}
+
+// GetNeighbors returns the neighbors matching filter, ordered by interface,
+// VLAN and address
+func (m *MemoryStorage) GetNeighbors(filter *models.NeighborFilter) []*models.Neighbor {
+	m.mu.RLock()
+	result := make([]*models.Neighbor, 0)
+	for iface, neighbors := range m.neighbors {
+		if filter.Interface != "" && iface != filter.Interface {
+			continue
+		}
+		for _, n := range neighbors {
+			if filter.IP != "" && n.IP != filter.IP {
+				continue
+			}
+			if filter.MAC != "" && n.MAC != filter.MAC {
+				continue
+			}
+			if filter.Vendor != "" && !strings.Contains(strings.ToLower(n.Vendor), strings.ToLower(filter.Vendor)) {
+				continue
+			}
+			neighborCopy := *n
+			result = append(result, &neighborCopy)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		if a.VLAN != b.VLAN {
+			return a.VLAN < b.VLAN
+		}
+		return bytes.Compare(net.ParseIP(a.IP).To16(), net.ParseIP(b.IP).To16()) < 0
+	})
+	return result
+}
+
+// GetNeighborEvents returns the most recent anomalies on iface of type typ,
+// newest first. Empty arguments match everything and a zero limit returns
+// all of them.
+func (m *MemoryStorage) GetNeighborEvents(iface, typ string, limit int) []*models.NeighborEvent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*models.NeighborEvent, 0)
+	for i := len(m.neighborEvents) - 1; i >= 0; i-- {
+		event := m.neighborEvents[i]
+		if iface != "" && event.Interface != iface {
+			continue
+		}
+		if typ != "" && event.Type != typ {
+			continue
+		}
+		eventCopy := *event
+		result = append(result, &eventCopy)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}